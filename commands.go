@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"video-ad-tracker/internal/config"
+	"video-ad-tracker/internal/services"
+)
+
+// Build retention policies for the tables the service writes
+func retentionPolicies(cfg *config.Config) []services.RetentionPolicy {
+	return []services.RetentionPolicy{
+		// Clicks the aggregation worker has not folded into the rollups yet are kept until it has
+		{Name: "raw_events", Table: "click_events", Column: "timestamp", MaxAge: cfg.RetentionRawEvents, Condition: "processed"},
+		{Name: "conversions", Table: "conversions", Column: "converted_at", MaxAge: cfg.RetentionRawEvents},
+		{Name: "viewer_sessions", Table: "viewer_sessions", Column: "last_seen_at", MaxAge: cfg.RetentionRawEvents},
+		// Once a salt is gone its hashes can no longer be brute-forced back to addresses
+		{Name: "privacy_salts", Table: "privacy_salts", Column: "day", MaxAge: saltRetention(cfg.PrivacySaltRetention)},
+		// Minute buckets only serve recent windows, the coarser ones outlive the raw events
+		{Name: "rollups_minute", Table: "click_rollups_minute", Column: "bucket", MaxAge: cfg.RetentionRawEvents},
+		{Name: "rollups_hour", Table: "click_rollups_hour", Column: "bucket", MaxAge: cfg.RetentionRollups},
+		{Name: "rollups_day", Table: "click_rollups_day", Column: "bucket", MaxAge: cfg.RetentionRollups},
+		{Name: "anomalies", Table: "anomalies", Column: "bucket", MaxAge: cfg.RetentionRollups},
+		{Name: "audit_logs", Table: "privacy_requests", Column: "created_at", MaxAge: cfg.RetentionAuditLogs},
+		{Name: "webhook_deliveries", Table: "webhook_deliveries", Column: "created_at", MaxAge: cfg.RetentionAuditLogs},
+	}
+}
+
+// Salt days are UTC dates compared against a cutoff in server time, so the
+// salt still in use could be purged with anything shorter than two days
+func saltRetention(maxAge time.Duration) time.Duration {
+	if minimum := 2 * 24 * time.Hour; maxAge < minimum {
+		return minimum
+	}
+	return maxAge
+}
+
+// Run a one-off command given on the command line
+func runCommand(name string, args []string, retentionService *services.RetentionService) error {
+	switch name {
+	case "purge":
+		flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+		dryRun := flags.Bool("dry-run", false, "report what would be deleted without deleting")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+
+		results, err := retentionService.Purge(context.Background(), *dryRun)
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
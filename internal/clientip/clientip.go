@@ -0,0 +1,180 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarding headers a resolver can be told to read
+const (
+	HeaderForwarded     = "Forwarded"
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// Resolver determines the originating client address of a request,
+// honouring a forwarding header only when it was added by trusted proxies
+type Resolver struct {
+	trustedProxies  []*net.IPNet
+	header          string
+	trustSuppliedIP bool
+}
+
+// Create new client IP resolver from a list of CIDRs or bare IP addresses
+// and the one forwarding header the proxies set. Only that header is read:
+// proxies pass on headers they do not set themselves, so a client could
+// otherwise name any address in another one.
+func NewResolver(trustedProxies []string, header string, trustSuppliedIP bool) (*Resolver, error) {
+	r := &Resolver{trustSuppliedIP: trustSuppliedIP}
+	for _, known := range []string{HeaderForwarded, HeaderXForwardedFor, HeaderXRealIP} {
+		if strings.EqualFold(strings.TrimSpace(header), known) {
+			r.header = known
+		}
+	}
+	if r.header == "" {
+		return nil, fmt.Errorf("unsupported forwarding header %q", header)
+	}
+
+	for _, entry := range trustedProxies {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		r.trustedProxies = append(r.trustedProxies, network)
+	}
+	return r, nil
+}
+
+// Get the address of the peer connected to the server
+func (r *Resolver) ConnectionIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(req.RemoteAddr))
+	if err != nil {
+		host = strings.TrimSpace(req.RemoteAddr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Resolve the client IP for a request. A caller-supplied address is used only
+// when enabled and the caller is authenticated.
+func (r *Resolver) ClientIP(req *http.Request, suppliedIP string, authenticated bool) string {
+	if r.trustSuppliedIP && authenticated {
+		if ip := net.ParseIP(strings.TrimSpace(suppliedIP)); ip != nil {
+			return ip.String()
+		}
+	}
+
+	remote := r.ConnectionIP(req)
+	if remote == "" || !r.isTrusted(net.ParseIP(remote)) {
+		return remote
+	}
+
+	switch r.header {
+	case HeaderForwarded:
+		if hops := forwardedFor(req.Header.Values(HeaderForwarded)); len(hops) > 0 {
+			return r.walkHops(hops, remote)
+		}
+	case HeaderXForwardedFor:
+		if hops := xForwardedFor(req.Header.Values(HeaderXForwardedFor)); len(hops) > 0 {
+			return r.walkHops(hops, remote)
+		}
+	case HeaderXRealIP:
+		if ip := net.ParseIP(strings.TrimSpace(req.Header.Get(HeaderXRealIP))); ip != nil {
+			return ip.String()
+		}
+	}
+
+	return remote
+}
+
+// Walk forwarding hops from nearest to furthest, returning the first address
+// that is not a trusted proxy
+func (r *Resolver) walkHops(hops []string, remote string) string {
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// Unknown or obfuscated hop, trust nothing beyond it
+			return client
+		}
+		client = ip.String()
+		if !r.isTrusted(ip) {
+			return client
+		}
+	}
+	return client
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse RFC 7239 Forwarded headers into the list of "for" addresses
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "for") {
+					continue
+				}
+				hop = stripPort(strings.Trim(strings.TrimSpace(val), `"`))
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// Parse X-Forwarded-For headers into a list of addresses
+func xForwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, stripPort(strings.TrimSpace(hop)))
+		}
+	}
+	return hops
+}
+
+// Remove an optional port and IPv6 brackets from a forwarded node
+func stripPort(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if strings.Count(node, ":") == 1 {
+		host, _, err := net.SplitHostPort(node)
+		if err == nil {
+			return host
+		}
+	}
+	return node
+}
@@ -0,0 +1,96 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testProxies = []string{"10.0.0.0/8", "192.0.2.1", "2001:db8:ffff::/48"}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{"untrusted peer ignores headers", HeaderXForwardedFor, "198.51.100.7:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "198.51.100.7"},
+		{"trusted peer without header", HeaderXForwardedFor, "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"single hop", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"walks back over trusted hops", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7, 10.1.2.3"}}, "198.51.100.7"},
+		{"hops across repeated headers", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9", "10.1.2.3"}}, "203.0.113.9"},
+		{"bare trusted address", HeaderXForwardedFor, "192.0.2.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9, 192.0.2.1"}}, "203.0.113.9"},
+		{"only trusted hops", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"10.0.0.2, 10.0.0.3"}}, "10.0.0.2"},
+		{"unparseable hop stops the walk", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9, unknown, 10.1.2.3"}}, "10.1.2.3"},
+		{"hop with a port", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9:4711"}}, "203.0.113.9"},
+		{"ipv6 hop", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8::1"},
+		{"ipv6 hop with a port", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"[2001:db8::1]:4711"}}, "2001:db8::1"},
+		{"ipv6 trusted peer", HeaderXForwardedFor, "[2001:db8:ffff::2]:5000", map[string][]string{"X-Forwarded-For": {"2001:db8::1, 2001:db8:ffff::3"}}, "2001:db8::1"},
+		{"ipv6 untrusted peer", HeaderXForwardedFor, "[2001:db8::7]:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "2001:db8::7"},
+
+		{"forwarded", HeaderForwarded, "10.0.0.1:5000", map[string][]string{"Forwarded": {`for=203.0.113.9;proto=https, for=10.1.2.3`}}, "203.0.113.9"},
+		{"forwarded ipv6 with a port", HeaderForwarded, "10.0.0.1:5000", map[string][]string{"Forwarded": {`For="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{"forwarded obfuscated hop", HeaderForwarded, "10.0.0.1:5000", map[string][]string{"Forwarded": {`for=_hidden, for=198.51.100.7`}}, "198.51.100.7"},
+		{"x-real-ip", HeaderXRealIP, "10.0.0.1:5000", map[string][]string{"X-Real-IP": {" 203.0.113.9 "}}, "203.0.113.9"},
+
+		// A client can add any header, the proxy only sets the configured one
+		{"spoofed forwarded beside x-forwarded-for", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{
+			"Forwarded":       {"for=6.6.6.6"},
+			"X-Forwarded-For": {"203.0.113.9"},
+		}, "203.0.113.9"},
+		{"spoofed x-forwarded-for beside forwarded", HeaderForwarded, "10.0.0.1:5000", map[string][]string{
+			"X-Forwarded-For": {"6.6.6.6"},
+			"Forwarded":       {"for=203.0.113.9"},
+		}, "203.0.113.9"},
+		{"spoofed x-real-ip without the header", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Real-IP": {"6.6.6.6"}}, "10.0.0.1"},
+		{"spoofed hop in front of the proxy's", HeaderXForwardedFor, "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"6.6.6.6, 203.0.113.9"}}, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewResolver(testProxies, tt.header, false)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/clicks", nil)
+			req.RemoteAddr = tt.remote
+			for name, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+			assert.Equal(t, tt.want, r.ClientIP(req, "", false))
+		})
+	}
+}
+
+func TestClientIPSuppliedAddress(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/clicks", nil)
+	req.RemoteAddr = "198.51.100.7:5000"
+
+	trusting, err := NewResolver(nil, HeaderXForwardedFor, true)
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.9", trusting.ClientIP(req, "203.0.113.9", true))
+	assert.Equal(t, "198.51.100.7", trusting.ClientIP(req, "203.0.113.9", false), "unauthenticated")
+	assert.Equal(t, "198.51.100.7", trusting.ClientIP(req, "not an ip", true))
+
+	r, err := NewResolver(nil, HeaderXForwardedFor, false)
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.7", r.ClientIP(req, "203.0.113.9", true))
+}
+
+func TestNewResolver(t *testing.T) {
+	r, err := NewResolver(nil, "x-forwarded-for", false)
+	require.NoError(t, err)
+	assert.Equal(t, HeaderXForwardedFor, r.header)
+
+	_, err = NewResolver(nil, "X-Client-IP", false)
+	assert.Error(t, err)
+	_, err = NewResolver(nil, "", false)
+	assert.Error(t, err)
+	_, err = NewResolver([]string{"10.0.0.0/33"}, HeaderXForwardedFor, false)
+	assert.Error(t, err)
+}
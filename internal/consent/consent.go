@@ -0,0 +1,149 @@
+package consent
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// Status values stored with each event
+const (
+	StatusConsented     = "consented"      // GDPR applies and purpose 1 was consented to
+	StatusNotConsented  = "not_consented"  // GDPR applies and purpose 1 was not consented to
+	StatusInvalid       = "invalid"        // GDPR applies but the consent string is missing or malformed
+	StatusOptedOut      = "opted_out"      // Global Privacy Control or Do Not Track was sent
+	StatusNotApplicable = "not_applicable" // GDPR does not apply and no opt-out signal was sent
+)
+
+// Purpose 1 of the IAB TCF: store and/or access information on a device
+const PurposeStorage = 1
+
+var (
+	ErrInvalidTCString    = errors.New("invalid TCF consent string")
+	ErrUnsupportedVersion = errors.New("unsupported TCF consent string version")
+)
+
+// TCString holds the parts of a TCF v2 core segment the service acts on
+type TCString struct {
+	Version           int
+	CmpID             int
+	CmpVersion        int
+	VendorListVersion int
+	PolicyVersion     int
+	PurposesConsent   [24]bool
+	PurposesLegitInt  [24]bool
+}
+
+// Check whether consent was given for a purpose, numbered from 1
+func (t *TCString) HasPurpose(purpose int) bool {
+	if purpose < 1 || purpose > len(t.PurposesConsent) {
+		return false
+	}
+	return t.PurposesConsent[purpose-1]
+}
+
+// Parse the core segment of an IAB TCF v2 consent string
+func Parse(value string) (*TCString, error) {
+	core, _, _ := strings.Cut(strings.TrimSpace(value), ".")
+	if core == "" {
+		return nil, ErrInvalidTCString
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(core, "="))
+	if err != nil {
+		return nil, ErrInvalidTCString
+	}
+
+	r := &bitReader{data: data}
+	tc := &TCString{}
+	tc.Version = r.int(6)
+	if r.err == nil && tc.Version != 2 {
+		return nil, ErrUnsupportedVersion
+	}
+
+	r.skip(36) // Created
+	r.skip(36) // LastUpdated
+	tc.CmpID = r.int(12)
+	tc.CmpVersion = r.int(12)
+	r.skip(6)  // ConsentScreen
+	r.skip(12) // ConsentLanguage
+	tc.VendorListVersion = r.int(12)
+	tc.PolicyVersion = r.int(6)
+	r.skip(1)  // IsServiceSpecific
+	r.skip(1)  // UseNonStandardTexts
+	r.skip(12) // SpecialFeatureOptIns
+	for i := range tc.PurposesConsent {
+		tc.PurposesConsent[i] = r.int(1) == 1
+	}
+	for i := range tc.PurposesLegitInt {
+		tc.PurposesLegitInt[i] = r.int(1) == 1
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return tc, nil
+}
+
+// Signals are the consent inputs attached to a tracking request
+type Signals struct {
+	GDPRApplies          bool
+	ConsentString        string
+	GlobalPrivacyControl bool
+	DoNotTrack           bool
+}
+
+// Decision states what may be stored for an event
+type Decision struct {
+	Status string
+	// Whether IPs and user agents may be stored
+	StoreIdentifiers bool
+}
+
+// Decide what may be stored given the request's consent signals
+func Evaluate(signals Signals) Decision {
+	if signals.GlobalPrivacyControl || signals.DoNotTrack {
+		return Decision{Status: StatusOptedOut}
+	}
+	if !signals.GDPRApplies {
+		return Decision{Status: StatusNotApplicable, StoreIdentifiers: true}
+	}
+
+	tc, err := Parse(signals.ConsentString)
+	if err != nil {
+		return Decision{Status: StatusInvalid}
+	}
+	if !tc.HasPurpose(PurposeStorage) {
+		return Decision{Status: StatusNotConsented}
+	}
+	return Decision{Status: StatusConsented, StoreIdentifiers: true}
+}
+
+// Reads big-endian bit fields from a byte slice
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) int(bits int) int {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos+bits > len(r.data)*8 {
+		r.err = ErrInvalidTCString
+		return 0
+	}
+
+	value := 0
+	for i := 0; i < bits; i++ {
+		bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+		value = value<<1 | int(bit)
+		r.pos++
+	}
+	return value
+}
+
+func (r *bitReader) skip(bits int) {
+	r.int(bits)
+}
@@ -0,0 +1,122 @@
+package consent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Core segments encoded field by field from the TCF v2 specification: CMP
+// 300 version 2, vendor list 150, policy version 4, and the purposes below
+const (
+	// Purposes 1, 2, 3, 4, 7, 9 and 10, legitimate interest for 2 and 7,
+	// vendors 1, 2, 8 and 91 as a bit field
+	purposeOneOn = "CPN4VrAPN4VrAEsACBENCWEAAPLAAEIAAAAAAtsEAAAAAAAAAAAAAIAAAAA"
+	// Purposes 2, 3 and 4, legitimate interest for 2, vendor 8
+	purposeOneOff = "CPN4VrAPN4VrAEsACBENCWEAAHAAAEAAAAAAAEAEAAAAAA"
+	// Purposes 1 and 3, vendors 1-10, 25, 100-200 and 755 as ranges
+	vendorRanges = "CPN4VrAPN4VrAEsACBENCWEAAKAAAAAAAAAAF5wBIAAgAUABmAMgBkALzAAAAAA"
+	// As purposeOneOn but from CMP 4031, which encodes to - and _
+	urlAlphabet = "CPN4VrAPN4VrA-_ACBENCWEAAPLAAEIAAAAAAtsEAAAAAAAAAAAAAIAAAAA"
+	// Version 1 with purpose 1
+	versionOne = "BPN4VrAPN4VrAEsACBENCWEAAIAAAAAAAAAAAAoAAAAA"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		wantErr  error
+		cmpID    int
+		purposes []int
+		legitInt []int
+	}{
+		{"purpose 1 on", purposeOneOn, nil, 300, []int{1, 2, 3, 4, 7, 9, 10}, []int{2, 7}},
+		{"purpose 1 off", purposeOneOff, nil, 300, []int{2, 3, 4}, []int{2}},
+		{"range encoded vendors", vendorRanges, nil, 300, []int{1, 3}, nil},
+		{"base64url padding", purposeOneOn + "=", nil, 300, []int{1, 2, 3, 4, 7, 9, 10}, []int{2, 7}},
+		{"surrounding whitespace", " " + purposeOneOn + "\n", nil, 300, []int{1, 2, 3, 4, 7, 9, 10}, []int{2, 7}},
+		{"url safe alphabet", urlAlphabet, nil, 4031, []int{1, 2, 3, 4, 7, 9, 10}, []int{2, 7}},
+		{"further segments are ignored", purposeOneOff + ".YAAAAAAAAAAA", nil, 300, []int{2, 3, 4}, []int{2}},
+
+		{"standard base64 alphabet", strings.NewReplacer("-", "+", "_", "/").Replace(urlAlphabet), ErrInvalidTCString, 0, nil, nil},
+		{"truncated in the purposes", purposeOneOn[:24], ErrInvalidTCString, 0, nil, nil},
+		{"truncated in legitimate interest", purposeOneOn[:32], ErrInvalidTCString, 0, nil, nil},
+		{"version 1", versionOne, ErrUnsupportedVersion, 0, nil, nil},
+		{"empty", "", ErrInvalidTCString, 0, nil, nil},
+		{"empty core segment", ".YAAAAAAAAAAA", ErrInvalidTCString, 0, nil, nil},
+		{"not base64", "CPN4!rAP", ErrInvalidTCString, 0, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := Parse(tt.value)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Nil(t, tc)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, 2, tc.Version)
+			assert.Equal(t, tt.cmpID, tc.CmpID)
+			assert.Equal(t, 2, tc.CmpVersion)
+			assert.Equal(t, 150, tc.VendorListVersion)
+			assert.Equal(t, 4, tc.PolicyVersion)
+			assert.Equal(t, tt.purposes, setBits(tc.PurposesConsent))
+			assert.Equal(t, tt.legitInt, setBits(tc.PurposesLegitInt))
+			for _, purpose := range tt.purposes {
+				assert.True(t, tc.HasPurpose(purpose), "purpose %d", purpose)
+			}
+		})
+	}
+}
+
+// Purposes, numbered from 1, that are set
+func setBits(purposes [24]bool) []int {
+	var set []int
+	for i, on := range purposes {
+		if on {
+			set = append(set, i+1)
+		}
+	}
+	return set
+}
+
+func TestHasPurposeOutOfRange(t *testing.T) {
+	tc := &TCString{}
+	tc.PurposesConsent[0] = true
+	tc.PurposesConsent[23] = true
+	assert.False(t, tc.HasPurpose(0))
+	assert.False(t, tc.HasPurpose(25))
+	assert.True(t, tc.HasPurpose(24))
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name    string
+		signals Signals
+		want    Decision
+	}{
+		{"consented", Signals{GDPRApplies: true, ConsentString: purposeOneOn}, Decision{Status: StatusConsented, StoreIdentifiers: true}},
+		{"range encoded vendors", Signals{GDPRApplies: true, ConsentString: vendorRanges}, Decision{Status: StatusConsented, StoreIdentifiers: true}},
+		{"purpose 1 refused", Signals{GDPRApplies: true, ConsentString: purposeOneOff}, Decision{Status: StatusNotConsented}},
+		{"missing string", Signals{GDPRApplies: true}, Decision{Status: StatusInvalid}},
+		{"truncated string", Signals{GDPRApplies: true, ConsentString: purposeOneOn[:24]}, Decision{Status: StatusInvalid}},
+		{"unsupported version", Signals{GDPRApplies: true, ConsentString: versionOne}, Decision{Status: StatusInvalid}},
+		{"gdpr does not apply", Signals{}, Decision{Status: StatusNotApplicable, StoreIdentifiers: true}},
+		{"string without gdpr", Signals{ConsentString: purposeOneOff}, Decision{Status: StatusNotApplicable, StoreIdentifiers: true}},
+
+		// Opt-out signals win over whatever the string says
+		{"gpc over consent", Signals{GDPRApplies: true, ConsentString: purposeOneOn, GlobalPrivacyControl: true}, Decision{Status: StatusOptedOut}},
+		{"dnt over consent", Signals{GDPRApplies: true, ConsentString: purposeOneOn, DoNotTrack: true}, Decision{Status: StatusOptedOut}},
+		{"gpc without gdpr", Signals{GlobalPrivacyControl: true}, Decision{Status: StatusOptedOut}},
+		{"dnt over an invalid string", Signals{GDPRApplies: true, ConsentString: "garbage", DoNotTrack: true}, Decision{Status: StatusOptedOut}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Evaluate(tt.signals))
+		})
+	}
+}
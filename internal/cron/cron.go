@@ -0,0 +1,205 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far ahead Next looks before giving up on a schedule that never
+// fires, such as the 30th of February
+const searchYears = 5
+
+// Schedule is a parsed five field cron expression
+type Schedule struct {
+	minute, hour, dom, month, dow uint64 // Bit i set when value i matches
+
+	// Vixie cron semantics: when both day fields are restricted a day
+	// matches either of them, otherwise it must match both
+	domStar, dowStar bool
+}
+
+// Shorthands for common schedules
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is accepted for Sunday as well as 0
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// Parse a cron expression of minute, hour, day of month, month and day of
+// week. Each field takes *, values, ranges (1-5), steps (*/15, 0-30/10)
+// and comma separated lists of those; months and weekdays also take their
+// three letter English names. The @hourly, @daily, @weekly, @monthly and
+// @yearly shorthands are understood too.
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := macros[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	s := &Schedule{
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+	if s.minute, err = minuteField.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if s.hour, err = hourField.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.dom, err = domField.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.month, err = monthField.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.dow, err = dowField.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func (f field) parse(spec string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(spec, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(item, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepSpec)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q in %s", stepSpec, f.name)
+			}
+		}
+
+		var low, high int
+		switch {
+		case rangeSpec == "*":
+			low, high = f.min, f.max
+		case strings.Contains(rangeSpec, "-"):
+			lowSpec, highSpec, _ := strings.Cut(rangeSpec, "-")
+			var err error
+			if low, err = f.value(lowSpec); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(highSpec); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q in %s", rangeSpec, f.name)
+			}
+		default:
+			var err error
+			if low, err = f.value(rangeSpec); err != nil {
+				return 0, err
+			}
+			high = low
+			// A single value with a step runs to the end, as in 5/15
+			if hasStep {
+				high = f.max
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f field) value(spec string) (int, error) {
+	if v, ok := f.names[strings.ToLower(spec)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(spec)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s must be between %d and %d, got %q", f.name, f.min, f.max, spec)
+	}
+	return v, nil
+}
+
+// Get the first time after t that the schedule fires, in t's location, or
+// the zero time if it does not fire within the next years. Times skipped
+// by a daylight saving change do not fire; times repeated by one fire once.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	after := wallClock(t)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(searchYears, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if !next.After(t) {
+				next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			}
+			t = next
+			continue
+		}
+		// Past the end of a repeated hour the wall clock steps back over
+		// times that already fired
+		if s.minute&(1<<uint(t.Minute())) == 0 || !wallClock(t).After(after) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Read the date and time of day of t as if it were UTC
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
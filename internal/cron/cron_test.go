@@ -0,0 +1,121 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"*/15 9-17 * * mon-fri", false},
+		{"0,30 0-23/2 1,15 jan-jun,DEC 0", false},
+		{"5/15 * * * *", false},
+		{"0 0 * * 7", false},
+		{"  @daily ", false},
+		{"@WEEKLY", false},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"5-1 * * * *", true},
+		{"* * * foo *", true},
+		{"@fortnightly", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := Parse(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	s, err := Parse("5/20 9-17/4 1,15 feb * ")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<5|1<<25|1<<45), s.minute)
+	assert.Equal(t, uint64(1<<9|1<<13|1<<17), s.hour)
+	assert.Equal(t, uint64(1<<1|1<<15), s.dom)
+	assert.Equal(t, uint64(1<<2), s.month)
+	assert.False(t, s.domStar)
+	assert.True(t, s.dowStar)
+
+	// 7 is Sunday as well
+	s, err = Parse("0 0 * * 7")
+	require.NoError(t, err)
+	assert.NotZero(t, s.dow&1)
+}
+
+func TestNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	// Instants in New York around its 2024 clock changes, given in UTC
+	edt := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour+4, minute, 0, 0, time.UTC).In(newYork)
+	}
+	est := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour+5, minute, 0, 0, time.UTC).In(newYork)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"next minute", "* * * * *", time.Date(2024, 5, 1, 10, 0, 30, 0, time.UTC), time.Date(2024, 5, 1, 10, 1, 0, 0, time.UTC)},
+		{"strictly after", "0 10 * * *", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)},
+		{"weekdays skip the weekend", "0 9 * * mon-fri", time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC), time.Date(2024, 5, 6, 9, 0, 0, 0, time.UTC)},
+		{"day of month or weekday", "0 0 13 * fri", time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 9, 6, 0, 0, 0, 0, time.UTC)},
+		{"month rollover", "0 0 1 * *", time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"never fires", "0 0 30 2 *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+		{"weekly on sunday", "@weekly", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)},
+		{"kept in the location", "0 9 * * *", time.Date(2024, 5, 1, 12, 0, 0, 0, newYork), time.Date(2024, 5, 2, 9, 0, 0, 0, newYork)},
+
+		// Spring forward: 02:00 to 02:59 do not exist on March 10
+		{"gap skips the day", "30 2 * * *", est(3, 9, 12, 0), edt(3, 11, 2, 30)},
+		{"hourly across the gap", "0 * * * *", est(3, 10, 1, 30), edt(3, 10, 3, 0)},
+		{"minutes across the gap", "*/20 * * * *", est(3, 10, 1, 50), edt(3, 10, 3, 0)},
+		{"gap in berlin", "0 2 * * *", time.Date(2024, 3, 30, 12, 0, 0, 0, berlin), time.Date(2024, 4, 1, 2, 0, 0, 0, berlin)},
+
+		// Fall back: 01:00 to 01:59 happen twice on November 3
+		{"repeated time fires on the first pass", "30 1 * * *", edt(11, 2, 12, 0), edt(11, 3, 1, 30)},
+		{"repeated time fires once", "30 1 * * *", edt(11, 3, 1, 30), est(11, 4, 1, 30)},
+		{"hourly skips the repeated hour", "0 * * * *", edt(11, 3, 1, 0), est(11, 3, 2, 0)},
+		{"minutes skip the repeated hour", "*/15 * * * *", edt(11, 3, 1, 50), est(11, 3, 2, 0)},
+		{"from the second pass of the repeat", "45 1 * * *", est(11, 3, 1, 10), est(11, 3, 1, 45)},
+		{"repeat in berlin", "30 2 * * *", time.Date(2024, 10, 27, 2, 30, 0, 0, time.FixedZone("CEST", 2*3600)).In(berlin), time.Date(2024, 10, 28, 2, 30, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.spec)
+			require.NoError(t, err)
+
+			got := s.Next(tt.from)
+			if tt.want.IsZero() {
+				assert.True(t, got.IsZero(), "got %s", got)
+				return
+			}
+			assert.True(t, tt.want.Equal(got), "want %s, got %s", tt.want, got)
+			assert.Equal(t, tt.from.Location(), got.Location())
+		})
+	}
+}
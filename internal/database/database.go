@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -38,6 +39,7 @@ func createTables(db *sql.DB) error {
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`ALTER TABLE ads ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE`,
 		`CREATE TABLE IF NOT EXISTS click_events (
 			id SERIAL PRIMARY KEY,
 			ad_id INTEGER NOT NULL REFERENCES ads(id) ON DELETE CASCADE,
@@ -49,11 +51,172 @@ func createTables(db *sql.DB) error {
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`ALTER TABLE click_events ADD COLUMN IF NOT EXISTS connection_ip VARCHAR(45)`,
+		// Widened to hold hashes; checked first since the ALTER rewrites the table
+		widenColumn("click_events", "ip_address", 64),
+		widenColumn("click_events", "connection_ip", 64),
+		`ALTER TABLE click_events ADD COLUMN IF NOT EXISTS consent_status VARCHAR(20) NOT NULL DEFAULT 'not_applicable'`,
+		`ALTER TABLE click_events ADD COLUMN IF NOT EXISTS viewer_id VARCHAR(128)`,
+		`ALTER TABLE click_events ADD COLUMN IF NOT EXISTS session_id VARCHAR(32)`,
+		`ALTER TABLE click_events ADD COLUMN IF NOT EXISTS click_uid VARCHAR(32)`,
+		`ALTER TABLE click_events ADD COLUMN IF NOT EXISTS device_type VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_events ADD COLUMN IF NOT EXISTS os VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_events ADD COLUMN IF NOT EXISTS browser VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_events ADD COLUMN IF NOT EXISTS country VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`CREATE TABLE IF NOT EXISTS viewer_sessions (
+			session_id VARCHAR(32) PRIMARY KEY,
+			viewer_id VARCHAR(128) NOT NULL,
+			started_at TIMESTAMP NOT NULL,
+			last_seen_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_viewer_sessions_viewer_last_seen ON viewer_sessions(viewer_id, last_seen_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_viewer_sessions_last_seen ON viewer_sessions(last_seen_at)`,
+		`CREATE TABLE IF NOT EXISTS privacy_salts (
+			day DATE PRIMARY KEY,
+			salt BYTEA NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS privacy_requests (
+			id SERIAL PRIMARY KEY,
+			receipt_id VARCHAR(64) NOT NULL UNIQUE,
+			request_type VARCHAR(20) NOT NULL,
+			subject_type VARCHAR(20) NOT NULL,
+			subject_hash VARCHAR(64) NOT NULL,
+			requested_by VARCHAR(200),
+			reference VARCHAR(200),
+			events_matched INTEGER NOT NULL DEFAULT 0,
+			events_deleted INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS conversions (
+			id SERIAL PRIMARY KEY,
+			conversion_id VARCHAR(128) UNIQUE,
+			click_event_id INTEGER REFERENCES click_events(id) ON DELETE SET NULL,
+			ad_id INTEGER REFERENCES ads(id) ON DELETE CASCADE,
+			viewer_id VARCHAR(128),
+			value DECIMAL(12,2) NOT NULL DEFAULT 0,
+			attributed BOOLEAN NOT NULL DEFAULT FALSE,
+			converted_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_conversions_ad_converted ON conversions(ad_id, converted_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_conversions_viewer_id ON conversions(viewer_id)`,
+		`CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+			id SERIAL PRIMARY KEY,
+			url VARCHAR(2000) NOT NULL,
+			event_types TEXT[] NOT NULL,
+			secret VARCHAR(128) NOT NULL,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id SERIAL PRIMARY KEY,
+			subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+			event_type VARCHAR(50) NOT NULL,
+			payload JSONB NOT NULL,
+			status VARCHAR(20) NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_status_code INTEGER,
+			last_error TEXT,
+			next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			delivered_at TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status_next ON webhook_deliveries(status, next_attempt_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_subscription ON webhook_deliveries(subscription_id, created_at)`,
+		`CREATE TABLE IF NOT EXISTS click_rollups_minute (
+			bucket TIMESTAMP NOT NULL,
+			ad_id INTEGER NOT NULL REFERENCES ads(id) ON DELETE CASCADE,
+			clicks BIGINT NOT NULL DEFAULT 0,
+			consented_clicks BIGINT NOT NULL DEFAULT 0,
+			playback_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+			playback_count BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (bucket, ad_id)
+		)`,
+		`ALTER TABLE click_rollups_minute ADD COLUMN IF NOT EXISTS device_type VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_minute ADD COLUMN IF NOT EXISTS os VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_minute ADD COLUMN IF NOT EXISTS browser VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_minute ADD COLUMN IF NOT EXISTS country VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_minute ADD COLUMN IF NOT EXISTS not_applicable_clicks BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE click_rollups_minute DROP CONSTRAINT IF EXISTS click_rollups_minute_pkey`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_click_rollups_minute_key ON click_rollups_minute(bucket, ad_id, device_type, os, browser, country)`,
+		`CREATE TABLE IF NOT EXISTS click_rollups_hour (
+			bucket TIMESTAMP NOT NULL,
+			ad_id INTEGER NOT NULL REFERENCES ads(id) ON DELETE CASCADE,
+			clicks BIGINT NOT NULL DEFAULT 0,
+			consented_clicks BIGINT NOT NULL DEFAULT 0,
+			playback_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+			playback_count BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (bucket, ad_id)
+		)`,
+		`ALTER TABLE click_rollups_hour ADD COLUMN IF NOT EXISTS device_type VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_hour ADD COLUMN IF NOT EXISTS os VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_hour ADD COLUMN IF NOT EXISTS browser VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_hour ADD COLUMN IF NOT EXISTS country VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_hour ADD COLUMN IF NOT EXISTS not_applicable_clicks BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE click_rollups_hour DROP CONSTRAINT IF EXISTS click_rollups_hour_pkey`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_click_rollups_hour_key ON click_rollups_hour(bucket, ad_id, device_type, os, browser, country)`,
+		`CREATE TABLE IF NOT EXISTS click_rollups_day (
+			bucket TIMESTAMP NOT NULL,
+			ad_id INTEGER NOT NULL REFERENCES ads(id) ON DELETE CASCADE,
+			clicks BIGINT NOT NULL DEFAULT 0,
+			consented_clicks BIGINT NOT NULL DEFAULT 0,
+			playback_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+			playback_count BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (bucket, ad_id)
+		)`,
+		`ALTER TABLE click_rollups_day ADD COLUMN IF NOT EXISTS device_type VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_day ADD COLUMN IF NOT EXISTS os VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_day ADD COLUMN IF NOT EXISTS browser VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_day ADD COLUMN IF NOT EXISTS country VARCHAR(16) NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE click_rollups_day ADD COLUMN IF NOT EXISTS not_applicable_clicks BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE click_rollups_day DROP CONSTRAINT IF EXISTS click_rollups_day_pkey`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_click_rollups_day_key ON click_rollups_day(bucket, ad_id, device_type, os, browser, country)`,
+		`CREATE TABLE IF NOT EXISTS reports (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(200) NOT NULL,
+			query TEXT NOT NULL,
+			format VARCHAR(10) NOT NULL,
+			delivery VARCHAR(20) NOT NULL,
+			recipients TEXT[] NOT NULL DEFAULT '{}',
+			schedule VARCHAR(100) NOT NULL,
+			active BOOLEAN DEFAULT true,
+			next_run_at TIMESTAMP NOT NULL,
+			last_run_at TIMESTAMP,
+			last_error TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_reports_next_run ON reports(next_run_at) WHERE active`,
+		`CREATE TABLE IF NOT EXISTS anomalies (
+			id SERIAL PRIMARY KEY,
+			ad_id INTEGER NOT NULL REFERENCES ads(id) ON DELETE CASCADE,
+			bucket TIMESTAMP NOT NULL,
+			kind VARCHAR(10) NOT NULL,
+			observed DOUBLE PRECISION NOT NULL,
+			expected DOUBLE PRECISION NOT NULL,
+			score DOUBLE PRECISION NOT NULL,
+			detected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (ad_id, bucket)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_anomalies_bucket ON anomalies(bucket)`,
+		`CREATE TABLE IF NOT EXISTS anomaly_checks (
+			id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+			judged_until TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			name VARCHAR(100) PRIMARY KEY,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
 		`CREATE INDEX IF NOT EXISTS idx_click_events_ad_id ON click_events(ad_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_click_events_timestamp ON click_events(timestamp)`,
 		`CREATE INDEX IF NOT EXISTS idx_click_events_processed ON click_events(processed)`,
 		`CREATE INDEX IF NOT EXISTS idx_click_events_ad_timestamp ON click_events(ad_id, timestamp)`,
 		`CREATE INDEX IF NOT EXISTS idx_click_events_processed_timestamp ON click_events(processed, timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_click_events_ip_address ON click_events(ip_address)`,
+		`CREATE INDEX IF NOT EXISTS idx_click_events_connection_ip ON click_events(connection_ip)`,
+		`CREATE INDEX IF NOT EXISTS idx_click_events_viewer_id ON click_events(viewer_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_click_events_click_uid ON click_events(click_uid)`,
 	}
 
 	for _, query := range queries {
@@ -62,6 +225,10 @@ func createTables(db *sql.DB) error {
 		}
 	}
 
+	if err := runMigrations(db); err != nil {
+		return err
+	}
+
 	if err := insertSampleAds(db); err != nil {
 		log.Printf("Warning: failed to insert sample ads: %v", err)
 	}
@@ -69,6 +236,131 @@ func createTables(db *sql.DB) error {
 	return nil
 }
 
+// A data migration that runs once per database
+type migration struct {
+	name string
+	run  func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	// Before the aggregation worker, analytics reads marked clicks processed
+	// without writing any rollups, so those clicks were never counted
+	{"backfill_click_rollups", rebuildRollups},
+	// consented_clicks used to include clicks without any consent signal
+	{"split_not_applicable_clicks", rebuildRollups},
+}
+
+// Run the migrations not yet recorded in schema_migrations. The marker is
+// written in the same transaction as the migration, so a failed migration
+// is retried on the next start, and a second instance starting at the same
+// time waits on the marker row and then skips it.
+func runMigrations(db *sql.DB) error {
+	for _, m := range migrations {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec("INSERT INTO schema_migrations (name) VALUES ($1) ON CONFLICT (name) DO NOTHING", m.name)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		claimed, err := result.RowsAffected()
+		if err != nil || claimed == 0 {
+			tx.Rollback()
+			if err != nil {
+				return fmt.Errorf("migration %s: %w", m.name, err)
+			}
+			continue
+		}
+
+		start := time.Now()
+		if err := m.run(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		log.Printf("Applied migration %s in %v", m.name, time.Since(start))
+	}
+	return nil
+}
+
+// Rollup tables with the unit of their buckets
+var rollupTables = []struct {
+	table string
+	unit  string
+}{
+	{"click_rollups_day", "day"},
+	{"click_rollups_hour", "hour"},
+	{"click_rollups_minute", "minute"},
+}
+
+// Recompute the rollups from the processed click events still on record.
+// Buckets that start before the oldest of them are left alone, since the
+// events behind them may already have been purged.
+//
+// The rollup tables are locked against writes, in the order the aggregation
+// worker and erasures write them. Their transactions either committed
+// before the lock, and are read back from click_events, or commit after the
+// rebuild and apply their changes on top of it.
+func rebuildRollups(tx *sql.Tx) error {
+	if _, err := tx.Exec("LOCK TABLE click_rollups_day, click_rollups_hour, click_rollups_minute IN EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+
+	var oldest sql.NullTime
+	if err := tx.QueryRow("SELECT MIN(timestamp) FROM click_events WHERE processed").Scan(&oldest); err != nil {
+		return err
+	}
+	if !oldest.Valid {
+		return nil
+	}
+
+	for _, r := range rollupTables {
+		// First whole bucket at or after the oldest event
+		from := `CASE WHEN date_trunc('` + r.unit + `', $1::timestamp) = $1::timestamp
+			THEN $1::timestamp
+			ELSE date_trunc('` + r.unit + `', $1::timestamp) + interval '1 ` + r.unit + `' END`
+
+		if _, err := tx.Exec("DELETE FROM "+r.table+" WHERE bucket >= "+from, oldest.Time); err != nil {
+			return err
+		}
+
+		query := `
+			INSERT INTO ` + r.table + ` (bucket, ad_id, device_type, os, browser, country, clicks, consented_clicks, not_applicable_clicks, playback_sum, playback_count)
+			SELECT date_trunc('` + r.unit + `', timestamp), ad_id, device_type, os, browser, country,
+				COUNT(*),
+				COUNT(*) FILTER (WHERE consent_status = 'consented'),
+				COUNT(*) FILTER (WHERE consent_status = 'not_applicable'),
+				COALESCE(SUM(video_playback_time), 0),
+				COUNT(*)
+			FROM click_events
+			WHERE processed AND timestamp >= ` + from + `
+			GROUP BY 1, 2, 3, 4, 5, 6
+		`
+		if _, err := tx.Exec(query, oldest.Time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build a statement that widens a VARCHAR column only when it is narrower
+func widenColumn(table, column string, length int) string {
+	return fmt.Sprintf(`DO $$
+		BEGIN
+			IF EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = '%[1]s' AND column_name = '%[2]s' AND character_maximum_length < %[3]d
+			) THEN
+				ALTER TABLE %[1]s ALTER COLUMN %[2]s TYPE VARCHAR(%[3]d);
+			END IF;
+		END $$`, table, column, length)
+}
+
 // Insert sample advertisement data
 func insertSampleAds(db *sql.DB) error {
 	var count int
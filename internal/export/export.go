@@ -0,0 +1,174 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Supported export formats
+const (
+	CSV    = "csv"
+	NDJSON = "ndjson"
+	XLSX   = "xlsx"
+)
+
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// Field is one entry of the metadata written ahead of the rows
+type Field struct {
+	Key   string
+	Value string
+}
+
+// Writer writes rows of values in the order of the columns it was created
+// with. Values may be ints, floats, strings or times; times are written in
+// RFC3339. Close must be called to finish the file.
+type Writer interface {
+	Write(values []interface{}) error
+	Close() error
+}
+
+// Check whether a format is supported
+func Valid(format string) bool {
+	switch format {
+	case CSV, NDJSON, XLSX:
+		return true
+	}
+	return false
+}
+
+// Get the media type of a format
+func ContentType(format string) string {
+	switch format {
+	case CSV:
+		return "text/csv; charset=utf-8"
+	case NDJSON:
+		return "application/x-ndjson"
+	case XLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "application/octet-stream"
+}
+
+// Create a writer for a format. The metadata and column header are written
+// straight away: the metadata as a first {"metadata": {...}} line in NDJSON
+// and as a separate sheet in XLSX. CSV leaves it out, as spreadsheets would
+// read anything ahead of the header as rows.
+func New(format string, w io.Writer, columns []string, metadata []Field) (Writer, error) {
+	switch format {
+	case CSV:
+		return newCSVWriter(w, columns)
+	case NDJSON:
+		return newNDJSONWriter(w, columns, metadata)
+	case XLSX:
+		return newXLSXWriter(w, columns, metadata)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Format a value as text
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer, columns []string) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w)}
+	if err := cw.w.Write(columns); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) Write(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = formatValue(value)
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type ndjsonWriter struct {
+	w       io.Writer
+	columns []string
+}
+
+func newNDJSONWriter(w io.Writer, columns []string, metadata []Field) (*ndjsonWriter, error) {
+	meta := make(map[string]string, len(metadata))
+	for _, field := range metadata {
+		meta[field.Key] = field.Value
+	}
+	line, err := json.Marshal(map[string]interface{}{"metadata": meta})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+
+	return &ndjsonWriter{w: w, columns: columns}, nil
+}
+
+// Objects are built by hand to keep the keys in column order
+func (nw *ndjsonWriter) Write(values []interface{}) error {
+	line := []byte{'{'}
+	for i, column := range nw.columns {
+		if i > 0 {
+			line = append(line, ',')
+		}
+		key, err := json.Marshal(column)
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		if i < len(values) {
+			value = values[i]
+		}
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339)
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		line = append(line, key...)
+		line = append(line, ':')
+		line = append(line, encoded...)
+	}
+	line = append(line, '}', '\n')
+
+	_, err := nw.w.Write(line)
+	return err
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nil
+}
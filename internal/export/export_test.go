@@ -0,0 +1,161 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testColumns  = []string{"ad_id", "bucket", "total_clicks", "avg_playback_time", "country"}
+	testMetadata = []Field{{Key: "report", Value: "series"}, {Key: "filter", Value: "country:DE"}}
+	testBucket   = time.Date(2024, 3, 31, 0, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	testRows     = [][]interface{}{
+		{1, testBucket, 12, 3.5, "DE"},
+		{2, testBucket, int64(0), 0.0, `<"A&B">`},
+	}
+)
+
+// Write the test rows in a format
+func writeTestExport(t *testing.T, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := New(format, &buf, testColumns, testMetadata)
+	require.NoError(t, err)
+	for _, row := range testRows {
+		require.NoError(t, w.Write(row))
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestCSVIsHeaderAndRowsOnly(t *testing.T) {
+	out := writeTestExport(t, CSV)
+
+	assert.Equal(t, "ad_id,bucket,total_clicks,avg_playback_time,country\n"+
+		"1,2024-03-31T00:00:00+02:00,12,3.5,DE\n"+
+		"2,2024-03-31T00:00:00+02:00,0,0,\"<\"\"A&B\"\">\"\n", string(out))
+}
+
+func TestNDJSON(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(string(writeTestExport(t, NDJSON)), "\n"), "\n")
+	require.Len(t, lines, 3)
+
+	assert.JSONEq(t, `{"metadata": {"report": "series", "filter": "country:DE"}}`, lines[0])
+	// Keys stay in column order
+	assert.Equal(t, `{"ad_id":1,"bucket":"2024-03-31T00:00:00+02:00","total_clicks":12,"avg_playback_time":3.5,"country":"DE"}`, lines[1])
+	var row map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &row))
+	assert.Equal(t, `<"A&B">`, row["country"])
+}
+
+// Cells of a worksheet as parsed from its XML
+type xlsxTestSheet struct {
+	Rows []struct {
+		R     string `xml:"r,attr"`
+		Cells []struct {
+			R      string `xml:"r,attr"`
+			T      string `xml:"t,attr"`
+			V      string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// Read the parts of a workbook, parsing each as XML
+func readXLSX(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	parts := map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		r.Close()
+
+		decoder := xml.NewDecoder(bytes.NewReader(content))
+		for {
+			_, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err, "part %s is not well-formed", f.Name)
+		}
+		parts[f.Name] = content
+	}
+	return parts
+}
+
+func TestXLSX(t *testing.T) {
+	parts := readXLSX(t, writeTestExport(t, XLSX))
+
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml", "xl/worksheets/sheet2.xml"} {
+		assert.Contains(t, parts, name)
+	}
+
+	var data xlsxTestSheet
+	require.NoError(t, xml.Unmarshal(parts["xl/worksheets/sheet1.xml"], &data))
+	require.Len(t, data.Rows, 3)
+
+	header := data.Rows[0]
+	assert.Equal(t, "1", header.R)
+	require.Len(t, header.Cells, len(testColumns))
+	for i, column := range testColumns {
+		assert.Equal(t, "inlineStr", header.Cells[i].T)
+		assert.Equal(t, column, header.Cells[i].Inline)
+	}
+
+	first := data.Rows[1]
+	assert.Equal(t, "2", first.R)
+	assert.Equal(t, []string{"A2", "B2", "C2", "D2", "E2"}, []string{first.Cells[0].R, first.Cells[1].R, first.Cells[2].R, first.Cells[3].R, first.Cells[4].R})
+	// Numbers are stored as numbers, times and text as inline strings
+	assert.Equal(t, "", first.Cells[0].T)
+	assert.Equal(t, "1", first.Cells[0].V)
+	assert.Equal(t, "inlineStr", first.Cells[1].T)
+	assert.Equal(t, "2024-03-31T00:00:00+02:00", first.Cells[1].Inline)
+	assert.Equal(t, "3.5", first.Cells[3].V)
+	assert.Equal(t, `<"A&B">`, data.Rows[2].Cells[4].Inline)
+
+	var metadata xlsxTestSheet
+	require.NoError(t, xml.Unmarshal(parts["xl/worksheets/sheet2.xml"], &metadata))
+	require.Len(t, metadata.Rows, len(testMetadata))
+	for i, field := range testMetadata {
+		assert.Equal(t, field.Key, metadata.Rows[i].Cells[0].Inline)
+		assert.Equal(t, field.Value, metadata.Rows[i].Cells[1].Inline)
+	}
+}
+
+func TestXLSXRowLimit(t *testing.T) {
+	w, err := newXLSXWriter(io.Discard, []string{"ad_id"}, nil)
+	require.NoError(t, err)
+
+	// The header is the first row
+	w.rows = MaxXLSXRows - 1
+	assert.NoError(t, w.Write([]interface{}{1}))
+	assert.ErrorIs(t, w.Write([]interface{}{2}), ErrTooManyRows)
+}
+
+func TestXLSXColumn(t *testing.T) {
+	tests := map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA", 16383: "XFD"}
+	for i, want := range tests {
+		assert.Equal(t, want, xlsxColumn(i), "column %d", i)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	_, err := New("pdf", io.Discard, testColumns, nil)
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+	assert.False(t, Valid("pdf"))
+	assert.True(t, Valid(XLSX))
+}
@@ -0,0 +1,157 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Most rows a worksheet can hold, including the header
+const MaxXLSXRows = 1048576
+
+var ErrTooManyRows = errors.New("export exceeds the rows of a worksheet")
+
+// Fixed parts of a workbook with a data sheet and a metadata sheet
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+<Override PartName="/xl/worksheets/sheet2.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`
+
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets>
+<sheet name="data" sheetId="1" r:id="rId1"/>
+<sheet name="metadata" sheetId="2" r:id="rId2"/>
+</sheets>
+</workbook>`
+
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet2.xml"/>
+</Relationships>`
+
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// xlsxWriter streams the data sheet into the zip archive as rows arrive.
+// Every other part is written up front, since an archive entry cannot be
+// reopened once the next one has started.
+type xlsxWriter struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+func newXLSXWriter(w io.Writer, columns []string, metadata []Field) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+
+	var metadataSheet strings.Builder
+	metadataSheet.WriteString(xlsxSheetStart)
+	for i, field := range metadata {
+		writeXLSXRow(&metadataSheet, i+1, []interface{}{field.Key, field.Value})
+	}
+	metadataSheet.WriteString(xlsxSheetEnd)
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/worksheets/sheet2.xml", metadataSheet.String()},
+	}
+	for _, part := range parts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	xw := &xlsxWriter{zip: zw, sheet: bufio.NewWriter(f)}
+	if _, err := xw.sheet.WriteString(xlsxSheetStart); err != nil {
+		return nil, err
+	}
+
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	if err := xw.Write(header); err != nil {
+		return nil, err
+	}
+	return xw, nil
+}
+
+func (xw *xlsxWriter) Write(values []interface{}) error {
+	if xw.rows >= MaxXLSXRows {
+		return ErrTooManyRows
+	}
+	xw.rows++
+	return writeXLSXRow(xw.sheet, xw.rows, values)
+}
+
+func (xw *xlsxWriter) Close() error {
+	if _, err := xw.sheet.WriteString(xlsxSheetEnd); err != nil {
+		return err
+	}
+	if err := xw.sheet.Flush(); err != nil {
+		return err
+	}
+	return xw.zip.Close()
+}
+
+// Write one row of cells. Numbers are stored as numbers, everything else as
+// inline strings, so no shared string table has to be kept in memory.
+func writeXLSXRow(w io.StringWriter, row int, values []interface{}) error {
+	r := strconv.Itoa(row)
+	var b strings.Builder
+	b.WriteString(`<row r="` + r + `">`)
+	for i, value := range values {
+		ref := xlsxColumn(i) + r
+		switch value.(type) {
+		case int, int64, float64:
+			b.WriteString(`<c r="` + ref + `"><v>` + formatValue(value) + `</v></c>`)
+		default:
+			b.WriteString(`<c r="` + ref + `" t="inlineStr"><is><t>`)
+			xml.EscapeText(&b, []byte(formatValue(value)))
+			b.WriteString(`</t></is></c>`)
+		}
+	}
+	b.WriteString(`</row>`)
+
+	_, err := w.WriteString(b.String())
+	return err
+}
+
+// Get the letters of a zero-based column index: A to Z, then AA and on
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
@@ -0,0 +1,195 @@
+package forecast
+
+import "math"
+
+// Methods used to project a series, depending on how much history it has
+const (
+	HoltWinters = "holt_winters" // Level, trend and season, needs two full periods
+	Holt        = "holt"         // Level and trend, needs two values
+	Naive       = "naive"        // Repeats the last value
+)
+
+// Standard normal quantiles of the supported two-sided prediction intervals,
+// by coverage in percent
+var Quantiles = map[int]float64{
+	80: 1.2816,
+	90: 1.6449,
+	95: 1.9600,
+	99: 2.5758,
+}
+
+// Smoothing parameters tried when fitting, the pair or triple with the
+// smallest one-step-ahead squared error wins
+var smoothingGrid = []float64{0.05, 0.1, 0.2, 0.3, 0.5, 0.7, 0.9}
+
+// Point is the forecast of one step ahead
+type Point struct {
+	Value float64
+	Lower float64
+	Upper float64
+}
+
+// Result holds the forecast of a series and the fitted parameters
+type Result struct {
+	Method string
+	Alpha  float64
+	Beta   float64
+	Gamma  float64
+	Points []Point
+}
+
+// Project a series of counts horizon steps ahead with additive Holt-Winters
+// of the given seasonal period, falling back to Holt's linear trend or the
+// last value when there is too little history. Intervals cover the normal
+// quantile z and are never narrower than the Poisson noise of the forecast.
+// Counts cannot go negative, so neither can values or lower bounds.
+func Forecast(series []float64, period, horizon int, z float64) Result {
+	n := len(series)
+	switch {
+	case period > 1 && n >= 2*period:
+		return fitBest(series, period, horizon, z, smoothingGrid)
+	case n >= 2:
+		return fitBest(series, 0, horizon, z, []float64{0})
+	default:
+		return naive(series, horizon, z)
+	}
+}
+
+// Grid search the smoothing parameters and forecast with the best fit.
+// A period of zero fits Holt's method without a season.
+func fitBest(series []float64, period, horizon int, z float64, gammas []float64) Result {
+	best := model{sse: math.Inf(1)}
+	for _, alpha := range smoothingGrid {
+		for _, beta := range smoothingGrid {
+			for _, gamma := range gammas {
+				m := fit(series, period, alpha, beta, gamma)
+				if m.sse < best.sse {
+					best = m
+				}
+			}
+		}
+	}
+
+	result := Result{Method: Holt, Alpha: best.alpha, Beta: best.beta, Gamma: best.gamma}
+	if period > 0 {
+		result.Method = HoltWinters
+	}
+
+	variance := 0.0
+	if best.errors > 0 {
+		variance = best.sse / float64(best.errors)
+	}
+
+	// Variance of the h-step error grows with the weight each unseen step
+	// puts on level, trend and season
+	spread := 0.0
+	for h := 1; h <= horizon; h++ {
+		value := best.level + float64(h)*best.trend
+		if period > 0 {
+			value += best.season[(len(series)+h-1)%period]
+		}
+
+		j := h - 1
+		if j > 0 {
+			c := best.alpha * (1 + float64(j)*best.beta)
+			if period > 0 && j%period == 0 {
+				c += best.gamma
+			}
+			spread += c * c
+		}
+		sd := math.Sqrt(variance * (1 + spread))
+
+		result.Points = append(result.Points, point(value, sd, z))
+	}
+	return result
+}
+
+// Smoothed state after running through a series
+type model struct {
+	alpha, beta, gamma float64
+	level, trend       float64
+	season             []float64
+	sse                float64
+	errors             int
+}
+
+// Run additive Holt-Winters over a series, or Holt's method when period is
+// zero. The initial state is taken from the first two periods, or the first
+// two values, and the one-step errors of the values after it are summed.
+func fit(series []float64, period int, alpha, beta, gamma float64) model {
+	m := model{alpha: alpha, beta: beta, gamma: gamma}
+
+	var start int
+	if period > 0 {
+		first, second := mean(series[:period]), mean(series[period:2*period])
+		m.level = first
+		m.trend = (second - first) / float64(period)
+		m.season = make([]float64, period)
+		for i := range m.season {
+			m.season[i] = series[i] - first
+		}
+		start = period
+	} else {
+		m.level = series[1]
+		m.trend = series[1] - series[0]
+		start = 2
+	}
+
+	for t := start; t < len(series); t++ {
+		predicted := m.level + m.trend
+		if period > 0 {
+			predicted += m.season[t%period]
+		}
+		e := series[t] - predicted
+		m.sse += e * e
+		m.errors++
+		m.update(series[t], t, period)
+	}
+	return m
+}
+
+func (m *model) update(value float64, t, period int) {
+	seasonal := 0.0
+	if period > 0 {
+		seasonal = m.season[t%period]
+	}
+
+	level := m.alpha*(value-seasonal) + (1-m.alpha)*(m.level+m.trend)
+	m.trend = m.beta*(level-m.level) + (1-m.beta)*m.trend
+	m.level = level
+	if period > 0 {
+		m.season[t%period] = m.gamma*(value-level) + (1-m.gamma)*seasonal
+	}
+}
+
+// Repeat the last value, with only Poisson noise as the spread
+func naive(series []float64, horizon int, z float64) Result {
+	last := 0.0
+	if len(series) > 0 {
+		last = series[len(series)-1]
+	}
+
+	result := Result{Method: Naive}
+	for h := 0; h < horizon; h++ {
+		result.Points = append(result.Points, point(last, 0, z))
+	}
+	return result
+}
+
+func point(value, sd, z float64) Point {
+	value = math.Max(value, 0)
+	sd = math.Max(sd, math.Sqrt(value))
+	return Point{
+		Value: value,
+		Lower: math.Max(value-z*sd, 0),
+		Upper: value + z*sd,
+	}
+}
+
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,120 @@
+package forecast
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Day of week effect of the synthetic series
+var weekly = []float64{0, 15, 30, 20, -10, -25, -30}
+
+// Daily clicks with a weekly season, a slow trend and, with noise, uniform
+// noise of that amplitude
+func seasonalSeries(days int, noise float64, rng *rand.Rand) []float64 {
+	series := make([]float64, days)
+	for t := range series {
+		series[t] = expectedClicks(t)
+		if noise > 0 {
+			series[t] += (rng.Float64()*2 - 1) * noise
+		}
+	}
+	return series
+}
+
+func expectedClicks(t int) float64 {
+	return 200 + 0.5*float64(t) + weekly[t%7]
+}
+
+func TestForecastWeeklySeason(t *testing.T) {
+	const days, horizon = 56, 14
+	result := Forecast(seasonalSeries(days, 0, nil), 7, horizon, Quantiles[95])
+
+	assert.Equal(t, HoltWinters, result.Method)
+	require.Len(t, result.Points, horizon)
+	for h, p := range result.Points {
+		assert.InDelta(t, expectedClicks(days+h), p.Value, 1, "day %d", h+1)
+		assert.LessOrEqual(t, p.Lower, p.Value)
+		assert.GreaterOrEqual(t, p.Upper, p.Value)
+	}
+}
+
+func TestForecastNoisyWeeklySeason(t *testing.T) {
+	const days, horizon = 84, 21
+	series := seasonalSeries(days, 40, rand.New(rand.NewSource(1)))
+	result := fitBest(series, 7, horizon, Quantiles[95], smoothingGrid)
+
+	assert.Equal(t, HoltWinters, result.Method)
+	require.Len(t, result.Points, horizon)
+	for h, p := range result.Points {
+		truth := expectedClicks(days + h)
+		assert.InDelta(t, truth, p.Value, 40, "day %d", h+1)
+		assert.True(t, p.Lower <= truth && truth <= p.Upper, "day %d: %v outside [%v, %v]", h+1, truth, p.Lower, p.Upper)
+	}
+
+	// Intervals widen with the horizon, compared on the same day of the week
+	// so the season does not move the Poisson floor
+	width := func(p Point) float64 { return p.Upper - p.Lower }
+	for h := 0; h+7 < horizon; h++ {
+		assert.Greater(t, width(result.Points[h+7]), width(result.Points[h]), "day %d against day %d", h+8, h+1)
+	}
+	assert.Greater(t, width(result.Points[horizon-1]), width(result.Points[0]))
+}
+
+func TestForecastIntervalCoverage(t *testing.T) {
+	series := seasonalSeries(56, 40, rand.New(rand.NewSource(2)))
+	narrow := Forecast(series, 7, 7, Quantiles[80])
+	wide := Forecast(series, 7, 7, Quantiles[99])
+
+	for h := range narrow.Points {
+		assert.Equal(t, narrow.Points[h].Value, wide.Points[h].Value)
+		assert.Less(t, wide.Points[h].Lower, narrow.Points[h].Lower)
+		assert.Greater(t, wide.Points[h].Upper, narrow.Points[h].Upper)
+	}
+}
+
+func TestForecastFallbacks(t *testing.T) {
+	tests := []struct {
+		name   string
+		series []float64
+		method string
+	}{
+		{"two weeks", seasonalSeries(14, 0, nil), HoltWinters},
+		{"under two weeks", seasonalSeries(13, 0, nil), Holt},
+		{"two days", []float64{10, 12}, Holt},
+		{"one day", []float64{10}, Naive},
+		{"no history", nil, Naive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Forecast(tt.series, 7, 3, Quantiles[95])
+			assert.Equal(t, tt.method, result.Method)
+			assert.Len(t, result.Points, 3)
+		})
+	}
+}
+
+func TestForecastNaiveRepeatsLastDay(t *testing.T) {
+	result := Forecast([]float64{16}, 7, 2, Quantiles[95])
+	for _, p := range result.Points {
+		assert.Equal(t, 16.0, p.Value)
+		// Only the Poisson noise of 16 clicks
+		assert.InDelta(t, 16+Quantiles[95]*4, p.Upper, 1e-9)
+		assert.InDelta(t, 16-Quantiles[95]*4, p.Lower, 1e-9)
+	}
+}
+
+func TestForecastNeverNegative(t *testing.T) {
+	series := []float64{100, 80, 60, 40, 20, 5}
+	result := Forecast(series, 7, 10, Quantiles[95])
+
+	assert.Equal(t, Holt, result.Method)
+	for _, p := range result.Points {
+		assert.False(t, math.Signbit(p.Value) || math.Signbit(p.Lower), "%+v", p)
+		assert.GreaterOrEqual(t, p.Upper, p.Value)
+	}
+	assert.Zero(t, result.Points[len(result.Points)-1].Value)
+}
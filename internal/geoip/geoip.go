@@ -0,0 +1,246 @@
+package geoip
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Country reported for addresses not covered by the database
+const Unknown = "unknown"
+
+// DB maps networks to ISO 3166-1 alpha-2 country codes
+type DB struct {
+	networks map[int]map[netip.Prefix]string // By prefix length
+	lengths  []int                           // Prefix lengths present, longest first
+}
+
+// Load a database from one or more CSV files, told apart by their header.
+// A file is either a list of network,country_code pairs, for example
+//
+//	network,country_code
+//	203.0.113.0/24,AU
+//	2001:db8::/32,DE
+//
+// where the header line is optional and lines starting with # are skipped,
+// or part of the MaxMind GeoLite2 Country CSV database as downloaded: the
+// locations file (GeoLite2-Country-Locations-en.csv) along with either or
+// both blocks files (GeoLite2-Country-Blocks-IPv4.csv and -IPv6.csv).
+// Blocks take the country of their geoname_id, falling back to the
+// registered country. When networks overlap the most specific one wins.
+func Load(paths ...string) (*DB, error) {
+	p := newParser()
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = p.read(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return p.finish()
+}
+
+// Parse a database from files in the formats read by Load
+func Parse(files ...io.Reader) (*DB, error) {
+	p := newParser()
+	for _, file := range files {
+		if err := p.read(file); err != nil {
+			return nil, err
+		}
+	}
+	return p.finish()
+}
+
+// A GeoLite2 network, resolved to a country once every file is read
+type geoLite2Block struct {
+	line         int
+	prefix       netip.Prefix
+	geonameID    string
+	registeredID string
+}
+
+// Builds a database from files in any order
+type parser struct {
+	db        *DB
+	locations map[string]string // GeoLite2 geoname_id to country code
+	blocks    []geoLite2Block
+}
+
+func newParser() *parser {
+	return &parser{
+		db:        &DB{networks: map[int]map[netip.Prefix]string{}},
+		locations: map[string]string{},
+	}
+}
+
+// Read one file, picking its format from the first line
+func (p *parser) read(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	first, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{}
+	for i, name := range first {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	switch {
+	case strings.TrimSpace(first[0]) == "geoname_id":
+		return readRecords(reader, func(line int, record []string) error {
+			country := field(record, columns, "country_iso_code")
+			if country != "" {
+				p.locations[field(record, columns, "geoname_id")] = country
+			}
+			return nil
+		})
+	case strings.TrimSpace(first[0]) == "network" && len(first) > 1 && strings.TrimSpace(first[1]) == "geoname_id":
+		return readRecords(reader, func(line int, record []string) error {
+			prefix, err := netip.ParsePrefix(field(record, columns, "network"))
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			p.blocks = append(p.blocks, geoLite2Block{
+				line:         line,
+				prefix:       prefix,
+				geonameID:    field(record, columns, "geoname_id"),
+				registeredID: field(record, columns, "registered_country_geoname_id"),
+			})
+			return nil
+		})
+	}
+
+	pair := func(line int, record []string) error {
+		if len(record) != 2 {
+			return fmt.Errorf("line %d: expected network,country_code", line)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := p.db.add(prefix, record[1]); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		return nil
+	}
+	if strings.TrimSpace(first[0]) != "network" {
+		line, _ := reader.FieldPos(0)
+		if err := pair(line, first); err != nil {
+			return err
+		}
+	}
+	return readRecords(reader, pair)
+}
+
+// Resolve the GeoLite2 blocks and index the networks by prefix length
+func (p *parser) finish() (*DB, error) {
+	if len(p.blocks) > 0 && len(p.locations) == 0 {
+		return nil, errors.New("GeoLite2 blocks need the locations file to resolve their countries")
+	}
+	for _, block := range p.blocks {
+		country := p.locations[block.geonameID]
+		if country == "" {
+			country = p.locations[block.registeredID]
+		}
+		// Blocks only known as anonymous proxies or satellite providers
+		if country == "" {
+			continue
+		}
+		if err := p.db.add(block.prefix, country); err != nil {
+			return nil, fmt.Errorf("line %d: %w", block.line, err)
+		}
+	}
+
+	for length := range p.db.networks {
+		p.db.lengths = append(p.db.lengths, length)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(p.db.lengths)))
+	return p.db, nil
+}
+
+// Call f with the line number and fields of every remaining record
+func readRecords(reader *csv.Reader, f func(line int, record []string) error) error {
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+		if err := f(line, record); err != nil {
+			return err
+		}
+	}
+}
+
+// Get a named field of a record, empty when the record is too short
+func field(record []string, columns map[string]int, name string) string {
+	i, ok := columns[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// Map a network to a country. IPv4-mapped IPv6 networks are stored as the
+// IPv4 networks they cover, as lookups unmap addresses.
+func (db *DB) add(prefix netip.Prefix, country string) error {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if len(country) != 2 {
+		return errors.New("country code must have two letters")
+	}
+
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	prefix = prefix.Masked()
+	if db.networks[prefix.Bits()] == nil {
+		db.networks[prefix.Bits()] = map[netip.Prefix]string{}
+	}
+	db.networks[prefix.Bits()][prefix] = country
+	return nil
+}
+
+// Get the country of an IP address. A nil database knows no countries.
+func (db *DB) Country(ip string) string {
+	if db == nil {
+		return Unknown
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Unknown
+	}
+	addr = addr.Unmap()
+
+	for _, length := range db.lengths {
+		if length > addr.BitLen() {
+			continue
+		}
+		prefix, err := addr.Prefix(length)
+		if err != nil {
+			continue
+		}
+		if country, ok := db.networks[length][prefix]; ok {
+			return country
+		}
+	}
+	return Unknown
+}
@@ -0,0 +1,135 @@
+package geoip
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPairs = `network,country_code
+# Overlapping networks, the most specific wins
+203.0.0.0/8,AU
+203.0.113.0/24,nz
+203.0.113.128/25,FJ
+198.51.100.7/32,US
+2001:db8::/32,DE
+2001:db8:1234::/48,AT
+::ffff:192.0.2.0/120,JP
+
+192.0.0.0/16,KR
+`
+
+func TestCountry(t *testing.T) {
+	db, err := Parse(strings.NewReader(testPairs))
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"203.1.2.3", "AU"},
+		{"203.0.113.5", "NZ"},
+		{"203.0.113.200", "FJ"},
+		{"198.51.100.7", "US"},
+		{"198.51.100.8", Unknown},
+		{"2001:db8::1", "DE"},
+		{"2001:db8:1234:5::1", "AT"},
+		{"2001:db9::1", Unknown},
+
+		// IPv4-mapped IPv6 addresses are looked up as IPv4
+		{"::ffff:203.0.113.200", "FJ"},
+		{"::ffff:cb00:7105", "NZ"},
+		{"::ffff:203.9.9.9", "AU"},
+		// and so are mapped networks in the file, below their IPv4 covers
+		{"192.0.2.1", "JP"},
+		{"::ffff:192.0.2.1", "JP"},
+		{"192.0.3.1", "KR"},
+
+		{"", Unknown},
+		{"not an ip", Unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			assert.Equal(t, tt.want, db.Country(tt.ip))
+		})
+	}
+}
+
+func TestCountryWithoutDatabase(t *testing.T) {
+	var db *DB
+	assert.Equal(t, Unknown, db.Country("203.0.113.5"))
+}
+
+func TestParseWithoutHeader(t *testing.T) {
+	db, err := Parse(strings.NewReader("203.0.113.0/24, AU\n2001:db8::/32,de\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "AU", db.Country("203.0.113.1"))
+	assert.Equal(t, "DE", db.Country("2001:db8::1"))
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing country":  "network,country_code\n203.0.113.0/24\n",
+		"extra field":      "203.0.113.0/24,AU,x\n",
+		"bad network":      "network,country_code\n203.0.113.0/33,AU\n",
+		"bare address":     "203.0.113.7,AU\n",
+		"long country":     "203.0.113.0/24,AUS\n",
+		"unbalanced quote": "\"203.0.113.0/24,AU\n",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(input))
+			assert.Error(t, err)
+		})
+	}
+}
+
+// Excerpts of the GeoLite2 Country CSV files as MaxMind ships them
+const (
+	geoLite2Locations = `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,is_in_european_union
+1835841,en,AS,Asia,KR,"Korea, Republic of",0
+2077456,en,OC,Oceania,AU,Australia,0
+2921044,en,EU,Europe,DE,Germany,1
+6255148,en,EU,Europe,,,0
+`
+	geoLite2BlocksIPv4 = `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,is_anycast
+1.11.0.0/16,1835841,1835841,,0,0,
+203.0.0.0/8,2077456,2077456,,0,0,
+203.0.113.0/24,,2921044,,0,0,
+198.51.100.0/24,,,,1,0,
+192.0.2.0/24,6255148,6255148,,0,0,
+`
+	geoLite2BlocksIPv6 = `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,is_anycast
+2001:db8::/32,2921044,2921044,,0,0,
+`
+)
+
+func TestParseGeoLite2(t *testing.T) {
+	// Blocks may come before their locations
+	db, err := Parse(strings.NewReader(geoLite2BlocksIPv4), strings.NewReader(geoLite2Locations), strings.NewReader(geoLite2BlocksIPv6))
+	require.NoError(t, err)
+
+	assert.Equal(t, "KR", db.Country("1.11.2.3"))
+	assert.Equal(t, "AU", db.Country("203.1.2.3"))
+	// Falls back to the registered country
+	assert.Equal(t, "DE", db.Country("203.0.113.5"))
+	assert.Equal(t, "DE", db.Country("2001:db8::1"))
+	assert.Equal(t, "DE", db.Country("::ffff:203.0.113.5"))
+	// Blocks without a country, and continents without one, are skipped
+	assert.Equal(t, Unknown, db.Country("198.51.100.7"))
+	assert.Equal(t, Unknown, db.Country("192.0.2.1"))
+}
+
+func TestParseGeoLite2WithoutLocations(t *testing.T) {
+	_, err := Parse(strings.NewReader(geoLite2BlocksIPv4))
+	assert.Error(t, err)
+}
+
+func TestParseMixedFormats(t *testing.T) {
+	db, err := Parse(strings.NewReader(geoLite2Locations), strings.NewReader(geoLite2BlocksIPv4), strings.NewReader("203.0.113.0/25,FJ\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "FJ", db.Country("203.0.113.5"))
+	assert.Equal(t, "DE", db.Country("203.0.113.200"))
+}
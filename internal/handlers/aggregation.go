@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+	"video-ad-tracker/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Get the backlog and last run of the aggregation worker
+func (h *Handlers) GetAggregationStatus(c *gin.Context) {
+	status, err := h.aggregation.Status()
+	if err != nil {
+		h.logger.Errorf("Failed to get aggregation status: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve aggregation status",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    status,
+	})
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Get recorded spikes and drops in click volume
+func (h *Handlers) GetAnomalies(c *gin.Context) {
+	query, fieldErrors := validation.AnomalyQuery(c.Request.URL.Query(), time.Now())
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	anomalies, err := h.anomalyService.ListAnomalies(query)
+	if err != nil {
+		h.logger.Errorf("Failed to get anomalies: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve anomalies",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    anomalies,
+	})
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Record a conversion postback
+func (h *Handlers) RecordConversion(c *gin.Context) {
+	var req models.ConversionRequest
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, validation.MaxRequestBytes)
+	fieldErrors := validation.DecodeStrict(body, &req)
+	if fieldErrors == nil {
+		fieldErrors = validation.Conversion(req)
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	conversion, err := h.conversionService.RecordConversion(req)
+	if err != nil {
+		h.logger.Errorf("Failed to record conversion: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to record conversion",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    conversion,
+	})
+}
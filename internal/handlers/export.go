@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"video-ad-tracker/internal/export"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Output held back before the first bytes go out, so a query that fails
+// early can still be answered with an error instead of a truncated file
+const exportBufferSize = 32 << 10
+
+// Export an analytics query as CSV, NDJSON or XLSX
+func (h *Handlers) ExportAnalytics(c *gin.Context) {
+	values := c.Request.URL.Query()
+	query, fieldErrors := validation.AnalyticsQuery(values, time.Now())
+	format, formatErrors := validation.ExportFormat(values.Get("format"))
+	fieldErrors = append(fieldErrors, formatErrors...)
+	if query.Compare != "" {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "compare", Code: validation.CodeInvalid, Message: "is not supported for exports"})
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	location := query.Location
+	if location == nil {
+		location = time.UTC
+	}
+	filename := fmt.Sprintf("analytics-%s-%s.%s", query.From.In(location).Format("20060102T1504"), query.To.In(location).Format("20060102T1504"), format)
+	c.Header("Content-Type", export.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	// CSV has no room for metadata that spreadsheets would not take for
+	// rows, so every format also gets it as headers
+	metadata := h.analyticsService.ExportMetadata(query, time.Now())
+	for _, field := range metadata {
+		if field.Value != "" {
+			c.Header(exportMetadataHeader(field.Key), field.Value)
+		}
+	}
+
+	out := bufio.NewWriterSize(c.Writer, exportBufferSize)
+	err := h.analyticsService.Export(c.Request.Context(), out, format, query, metadata)
+	if err == nil {
+		err = out.Flush()
+	}
+	// Raised before anything is written
+	if errors.Is(err, models.ErrSeriesOutOfRange) {
+		clearExportHeaders(c)
+		c.JSON(http.StatusBadRequest, seriesOutOfRange())
+		return
+	}
+	if err != nil {
+		h.logger.Errorf("Failed to export analytics: %v", err)
+		// Once rows have gone out the status is sent, and the file just ends early
+		if !c.Writer.Written() {
+			clearExportHeaders(c)
+			c.JSON(http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Error:   "Failed to export analytics",
+			})
+		}
+	}
+}
+
+// Remove the headers describing the file from a response that turns into
+// an error, so the JSON body is not labelled as the export
+func clearExportHeaders(c *gin.Context) {
+	header := c.Writer.Header()
+	header.Del("Content-Type")
+	header.Del("Content-Disposition")
+	for key := range header {
+		if strings.HasPrefix(key, "X-Export-") {
+			header.Del(key)
+		}
+	}
+}
+
+// Get the header carrying a metadata field, e.g. X-Export-Time-Frame for
+// time_frame
+func exportMetadataHeader(key string) string {
+	words := strings.Split(key, "_")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return "X-Export-" + strings.Join(words, "-")
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"video-ad-tracker/internal/export"
+	"video-ad-tracker/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Analytics service whose exports fail with err before writing anything
+type failingExports struct {
+	AnalyticsServiceInterface
+	err error
+}
+
+func (f failingExports) Export(context.Context, io.Writer, string, models.AnalyticsQuery, []export.Field) error {
+	return f.err
+}
+
+func (f failingExports) ExportMetadata(models.AnalyticsQuery, time.Time) []export.Field {
+	return []export.Field{{Key: "report", Value: "series"}, {Key: "time_frame", Value: "7d"}}
+}
+
+func TestExportErrorDropsFileHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"series out of range", models.ErrSeriesOutOfRange, http.StatusBadRequest},
+		{"query failure", errors.New("connection reset"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handlers{analyticsService: failingExports{err: tt.err}, logger: logger}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/ads/analytics/export?format=csv&timeframe=7d&granularity=day", nil)
+
+			h.ExportAnalytics(c)
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+			assert.Empty(t, w.Header().Get("Content-Disposition"))
+			for key := range w.Header() {
+				assert.NotContains(t, key, "X-Export-")
+			}
+		})
+	}
+}
@@ -1,9 +1,16 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/http"
+	"time"
+	"video-ad-tracker/internal/clientip"
+	"video-ad-tracker/internal/export"
 	"video-ad-tracker/internal/middleware"
 	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/validation"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -15,41 +22,155 @@ type AdServiceInterface interface {
 }
 
 type AnalyticsServiceInterface interface {
-	GetAnalytics(timeFrame string) ([]models.Analytics, error)
-	GetHourlyBreakdown() ([]models.Analytics, error)
+	GetAnalytics(query models.AnalyticsQuery) ([]models.Analytics, error)
+	Export(ctx context.Context, out io.Writer, format string, query models.AnalyticsQuery, metadata []export.Field) error
+	ExportMetadata(query models.AnalyticsQuery, generatedAt time.Time) []export.Field
+	GetHourlyBreakdown(location *time.Location, compare string) ([]models.Analytics, error)
+	GetPlaybackDistribution(query models.AnalyticsQuery) ([]models.PlaybackDistribution, error)
+	GetLeaderboard(query models.LeaderboardQuery) (*models.Leaderboard, error)
+	GetForecast(query models.ForecastQuery) ([]models.Forecast, error)
 }
 
 // ClickServiceInterface defines the interface for click operations
 type ClickServiceInterface interface {
-	RecordClick(req models.ClickRequest, clientIP string) error
+	RecordClick(req models.ClickRequest, meta models.ClickMetadata) (*models.ClickResult, error)
 }
+
+// PrivacyServiceInterface defines the interface for data subject requests
+type PrivacyServiceInterface interface {
+	Export(req models.SubjectRequest) (*models.SubjectExport, error)
+	Erase(req models.SubjectRequest) (*models.PrivacyReceipt, error)
+	GetReceipt(receiptID string) (*models.PrivacyReceipt, error)
+}
+
+// ConversionServiceInterface defines the interface for conversion tracking
+type ConversionServiceInterface interface {
+	RecordConversion(req models.ConversionRequest) (*models.Conversion, error)
+}
+
+// WebhookServiceInterface defines the interface for webhook management
+type WebhookServiceInterface interface {
+	CreateSubscription(req models.WebhookSubscriptionRequest) (*models.WebhookSubscription, error)
+	ListSubscriptions() ([]models.WebhookSubscription, error)
+	DeleteSubscription(id int) (bool, error)
+	ListDeliveries(subscriptionID int, status string, limit int) ([]models.WebhookDelivery, error)
+	RetryDelivery(id int) (bool, error)
+}
+
+// AggregationServiceInterface defines the interface for the aggregation worker
+type AggregationServiceInterface interface {
+	Status() (*models.AggregationStatus, error)
+}
+
+// LiveAnalyticsInterface defines the interface for live analytics counters
+type LiveAnalyticsInterface interface {
+	Snapshot(adIDs []int) models.LiveAnalytics
+}
+
+// AnomalyServiceInterface defines the interface for recorded anomalies
+type AnomalyServiceInterface interface {
+	ListAnomalies(query models.AnomalyQuery) ([]models.Anomaly, error)
+}
+
+// ReportServiceInterface defines the interface for scheduled reports
+type ReportServiceInterface interface {
+	CreateReport(req models.ReportRequest) (*models.Report, error)
+	ListReports() ([]models.Report, error)
+	DeleteReport(id int) (bool, error)
+	RunReport(ctx context.Context, id int) (*models.Report, error)
+}
+
+// First-party cookie holding the viewer ID
+const (
+	viewerCookieName   = "vat_vid"
+	viewerCookieMaxAge = 365 * 24 * 60 * 60
+)
+
+// Services groups the services used by the handlers
+type Services struct {
+	Ads         AdServiceInterface
+	Analytics   AnalyticsServiceInterface
+	Clicks      ClickServiceInterface
+	Privacy     PrivacyServiceInterface
+	Conversions ConversionServiceInterface
+	Webhooks    WebhookServiceInterface
+	Aggregation AggregationServiceInterface
+	Live        LiveAnalyticsInterface
+	Anomalies   AnomalyServiceInterface
+	Reports     ReportServiceInterface
+}
+
 type Handlers struct {
-	adService        AdServiceInterface
-	analyticsService AnalyticsServiceInterface
-	clickService     ClickServiceInterface
-	logger           *logrus.Logger
+	adService         AdServiceInterface
+	analyticsService  AnalyticsServiceInterface
+	clickService      ClickServiceInterface
+	privacyService    PrivacyServiceInterface
+	conversionService ConversionServiceInterface
+	webhookService    WebhookServiceInterface
+	aggregation       AggregationServiceInterface
+	liveAnalytics     LiveAnalyticsInterface
+	anomalyService    AnomalyServiceInterface
+	reportService     ReportServiceInterface
+	ipResolver        *clientip.Resolver
+	logger            *logrus.Logger
 }
 
 // Create new handlers
-func NewHandlers(adService AdServiceInterface, analyticsService AnalyticsServiceInterface, clickService ClickServiceInterface, logger *logrus.Logger) *Handlers {
+func NewHandlers(svc Services, ipResolver *clientip.Resolver, logger *logrus.Logger) *Handlers {
 	return &Handlers{
-		adService:        adService,
-		analyticsService: analyticsService,
-		clickService:     clickService,
-		logger:           logger,
+		adService:         svc.Ads,
+		analyticsService:  svc.Analytics,
+		clickService:      svc.Clicks,
+		privacyService:    svc.Privacy,
+		conversionService: svc.Conversions,
+		webhookService:    svc.Webhooks,
+		aggregation:       svc.Aggregation,
+		liveAnalytics:     svc.Live,
+		anomalyService:    svc.Anomalies,
+		reportService:     svc.Reports,
+		ipResolver:        ipResolver,
+		logger:            logger,
 	}
 }
 
-func Routes(router *gin.Engine, adService AdServiceInterface, analyticsService AnalyticsServiceInterface, clickService ClickServiceInterface) {
+func Routes(router *gin.Engine, ipResolver *clientip.Resolver, svc Services) {
 	logger := logrus.New()
-	handlers := NewHandlers(adService, analyticsService, clickService, logger)
+	handlers := NewHandlers(svc, ipResolver, logger)
 
 	api := router.Group("/api/v1")
 	{
 		api.GET("/ads", handlers.GetAds)
 		api.POST("/ads/click", handlers.RecordClick)
+		api.GET("/ads/top", handlers.GetTopAds)
+		api.GET("/ads/forecast", handlers.GetForecast)
 		api.GET("/ads/analytics", handlers.GetAnalytics)
 		api.GET("/ads/analytics/hourly", handlers.GetHourlyAnalytics)
+		api.GET("/ads/analytics/distribution", handlers.GetPlaybackDistribution)
+		api.GET("/ads/analytics/stream", handlers.StreamAnalytics)
+		api.GET("/ads/analytics/export", handlers.ExportAnalytics)
+		api.GET("/ads/anomalies", handlers.GetAnomalies)
+		api.POST("/conversions", middleware.RequireAPIKey(), handlers.RecordConversion)
+	}
+
+	webhooks := api.Group("/webhooks", middleware.RequireAPIKey())
+	{
+		webhooks.POST("", handlers.CreateWebhook)
+		webhooks.GET("", handlers.GetWebhooks)
+		webhooks.DELETE("/:id", handlers.DeleteWebhook)
+		webhooks.GET("/:id/deliveries", handlers.GetWebhookDeliveries)
+		webhooks.POST("/deliveries/:id/retry", handlers.RetryWebhookDelivery)
+	}
+
+	admin := api.Group("/admin", middleware.RequireAPIKey())
+	{
+		admin.POST("/privacy/export", handlers.ExportSubjectData)
+		admin.POST("/privacy/erase", handlers.EraseSubjectData)
+		admin.GET("/privacy/receipts/:id", handlers.GetPrivacyReceipt)
+		admin.GET("/aggregation/status", handlers.GetAggregationStatus)
+		admin.POST("/reports", handlers.CreateReport)
+		admin.GET("/reports", handlers.GetReports)
+		admin.DELETE("/reports/:id", handlers.DeleteReport)
+		admin.POST("/reports/:id/run", handlers.RunReport)
 	}
 
 	router.GET("/metrics", middleware.MetricsHandler())
@@ -76,21 +197,46 @@ func (h *Handlers) GetAds(c *gin.Context) {
 // Record click event
 func (h *Handlers) RecordClick(c *gin.Context) {
 	var req models.ClickRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Errorf("Invalid click request: %v", err)
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, validation.MaxRequestBytes)
+	fieldErrors := validation.DecodeStrict(body, &req)
+	if fieldErrors == nil {
+		fieldErrors = validation.Click(req)
+	}
+	if len(fieldErrors) > 0 {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
 			Success: false,
-			Error:   "Invalid request format",
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
 		})
 		return
 	}
 
-	clientIP := c.ClientIP()
-	if clientIP == "" {
-		clientIP = c.GetHeader("X-Forwarded-For")
+	meta := models.ClickMetadata{
+		ConnectionIP: h.ipResolver.ConnectionIP(c.Request),
+		ClientIP:     h.ipResolver.ClientIP(c.Request, req.IPAddress, middleware.IsAuthenticated(c)),
+		GPC:          c.GetHeader("Sec-GPC") == "1",
+		DoNotTrack:   c.GetHeader("DNT") == "1",
+		UserAgent:    c.Request.UserAgent(),
+	}
+	if cookie, err := c.Cookie(viewerCookieName); err == nil && validation.IsIdentifier(cookie) {
+		meta.ViewerCookie = cookie
 	}
 
-	err := h.clickService.RecordClick(req, clientIP)
+	result, err := h.clickService.RecordClick(req, meta)
+	if errors.Is(err, models.ErrAdNotFound) {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "Ad not found",
+		})
+		return
+	}
+	if errors.Is(err, models.ErrAdInactive) {
+		c.JSON(http.StatusUnprocessableEntity, models.APIResponse{
+			Success: false,
+			Error:   "Ad is not active",
+		})
+		return
+	}
 	if err != nil {
 		h.logger.Errorf("Failed to record click: %v", err)
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
@@ -100,26 +246,38 @@ func (h *Handlers) RecordClick(c *gin.Context) {
 		return
 	}
 
+	// Keep cookie based viewers identified across requests
+	if result.ViewerID != "" && req.DeviceID == "" {
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(viewerCookieName, result.ViewerID, viewerCookieMaxAge, "/", "", c.Request.TLS != nil, true)
+	}
+
 	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
-		Data:    map[string]string{"message": "Click recorded successfully"},
+		Data: map[string]string{
+			"message":  "Click recorded successfully",
+			"click_id": result.ClickID,
+		},
 	})
 }
 
 // Get analytics data
 func (h *Handlers) GetAnalytics(c *gin.Context) {
-	timeFrame := c.DefaultQuery("timeframe", "24h")
-
-	validTimeFrames := map[string]bool{"15m": true, "30m": true, "1h": true, "6h": true, "12h": true, "24h": true, "7d": true, "30d": true}
-	if !validTimeFrames[timeFrame] {
+	query, fieldErrors := validation.AnalyticsQuery(c.Request.URL.Query(), time.Now())
+	if len(fieldErrors) > 0 {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
 			Success: false,
-			Error:   "Invalid timeframe. Use: 15m, 30m, 1h, 6h, 12h, 24h, 7d, or 30d",
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
 		})
 		return
 	}
 
-	analytics, err := h.analyticsService.GetAnalytics(timeFrame)
+	analytics, err := h.analyticsService.GetAnalytics(query)
+	if errors.Is(err, models.ErrSeriesOutOfRange) {
+		c.JSON(http.StatusBadRequest, seriesOutOfRange())
+		return
+	}
 	if err != nil {
 		h.logger.Errorf("Failed to get analytics: %v", err)
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
@@ -135,9 +293,34 @@ func (h *Handlers) GetAnalytics(c *gin.Context) {
 	})
 }
 
+// Answer for a series that reaches back past the rollups it is built from
+func seriesOutOfRange() models.APIResponse {
+	return models.APIResponse{
+		Success: false,
+		Error:   "Invalid request",
+		Fields: []models.FieldError{{
+			Field:   "from",
+			Code:    validation.CodeInvalid,
+			Message: "reaches back past the minute rollups kept for this granularity and time zone; use a later start, a coarser granularity or a time zone offset by whole hours",
+		}},
+	}
+}
+
 // Get hourly analytics breakdown
 func (h *Handlers) GetHourlyAnalytics(c *gin.Context) {
-	analytics, err := h.analyticsService.GetHourlyBreakdown()
+	location, fieldErrors := validation.TimeZone(c.Query("tz"))
+	compare, compareErrors := validation.Compare(c.Query("compare"))
+	fieldErrors = append(fieldErrors, compareErrors...)
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	analytics, err := h.analyticsService.GetHourlyBreakdown(location, compare)
 	if err != nil {
 		h.logger.Errorf("Failed to get hourly analytics: %v", err)
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
@@ -152,3 +335,96 @@ func (h *Handlers) GetHourlyAnalytics(c *gin.Context) {
 		Data:    analytics,
 	})
 }
+
+// Get the playback time distribution per ad
+func (h *Handlers) GetPlaybackDistribution(c *gin.Context) {
+	query, fieldErrors := validation.AnalyticsQuery(c.Request.URL.Query(), time.Now())
+	if query.Granularity != "" {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "granularity", Code: validation.CodeInvalid, Message: "is not supported for distributions"})
+	}
+	if len(query.GroupBy) > 0 {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "group_by", Code: validation.CodeInvalid, Message: "is not supported for distributions"})
+	}
+	if query.Compare != "" {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "compare", Code: validation.CodeInvalid, Message: "is not supported for distributions"})
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	distributions, err := h.analyticsService.GetPlaybackDistribution(query)
+	if err != nil {
+		h.logger.Errorf("Failed to get playback distribution: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve playback distribution",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    distributions,
+	})
+}
+
+// Get the leaderboard of top or trending ads
+func (h *Handlers) GetTopAds(c *gin.Context) {
+	query, fieldErrors := validation.LeaderboardQuery(c.Request.URL.Query(), time.Now())
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	leaderboard, err := h.analyticsService.GetLeaderboard(query)
+	if err != nil {
+		h.logger.Errorf("Failed to get top ads: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve top ads",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    leaderboard,
+	})
+}
+
+// Get projected daily clicks per ad
+func (h *Handlers) GetForecast(c *gin.Context) {
+	query, fieldErrors := validation.ForecastQuery(c.Request.URL.Query())
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	forecasts, err := h.analyticsService.GetForecast(query)
+	if err != nil {
+		h.logger.Errorf("Failed to get forecast: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve forecast",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    forecasts,
+	})
+}
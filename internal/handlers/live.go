@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"time"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How often the live stream pushes an update
+const liveStreamInterval = 2 * time.Second
+
+// Stream live per ad counters as Server-Sent Events until the client leaves
+func (h *Handlers) StreamAnalytics(c *gin.Context) {
+	adIDs, fieldErrors := validation.AdIDs(c.Query("ad_id"))
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+
+	ticker := time.NewTicker(liveStreamInterval)
+	defer ticker.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		c.SSEvent("analytics", h.liveAnalytics.Snapshot(adIDs))
+
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-ticker.C:
+			return true
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"video-ad-tracker/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Export all data held about a data subject
+func (h *Handlers) ExportSubjectData(c *gin.Context) {
+	var req models.SubjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request format",
+		})
+		return
+	}
+
+	export, err := h.privacyService.Export(req)
+	if errors.Is(err, models.ErrInvalidSubject) {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.logger.Errorf("Failed to export subject data: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to export subject data",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    export,
+	})
+}
+
+// Erase all data held about a data subject
+func (h *Handlers) EraseSubjectData(c *gin.Context) {
+	var req models.SubjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request format",
+		})
+		return
+	}
+
+	receipt, err := h.privacyService.Erase(req)
+	if errors.Is(err, models.ErrInvalidSubject) {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.logger.Errorf("Failed to erase subject data: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to erase subject data",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    receipt,
+	})
+}
+
+// Get the receipt of an access or erasure request
+func (h *Handlers) GetPrivacyReceipt(c *gin.Context) {
+	receipt, err := h.privacyService.GetReceipt(c.Param("id"))
+	if err != nil {
+		h.logger.Errorf("Failed to get privacy receipt: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve receipt",
+		})
+		return
+	}
+	if receipt == nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "Receipt not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    receipt,
+	})
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Save a scheduled report
+func (h *Handlers) CreateReport(c *gin.Context) {
+	var req models.ReportRequest
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, validation.MaxRequestBytes)
+	fieldErrors := validation.DecodeStrict(body, &req)
+	if fieldErrors == nil {
+		fieldErrors = validation.Report(req, time.Now())
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	report, err := h.reportService.CreateReport(req)
+	if errors.Is(err, models.ErrDeliveryUnavailable) {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields: []models.FieldError{{
+				Field:   "delivery",
+				Code:    validation.CodeInvalid,
+				Message: "is not configured on this server",
+			}},
+		})
+		return
+	}
+	if err != nil {
+		h.logger.Errorf("Failed to create report: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to create report",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Data:    report,
+	})
+}
+
+// List scheduled reports
+func (h *Handlers) GetReports(c *gin.Context) {
+	reports, err := h.reportService.ListReports()
+	if err != nil {
+		h.logger.Errorf("Failed to get reports: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve reports",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    reports,
+	})
+}
+
+// Delete a scheduled report
+func (h *Handlers) DeleteReport(c *gin.Context) {
+	id, ok := h.idParam(c)
+	if !ok {
+		return
+	}
+
+	deleted, err := h.reportService.DeleteReport(id)
+	if err != nil {
+		h.logger.Errorf("Failed to delete report %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to delete report",
+		})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "Report not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    map[string]string{"message": "Report deleted"},
+	})
+}
+
+// Run a scheduled report now. Its schedule is left as it is.
+func (h *Handlers) RunReport(c *gin.Context) {
+	id, ok := h.idParam(c)
+	if !ok {
+		return
+	}
+
+	report, err := h.reportService.RunReport(c.Request.Context(), id)
+	if err != nil {
+		h.logger.Errorf("Failed to run report %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to run report",
+		})
+		return
+	}
+	if report == nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "Report not found",
+		})
+		return
+	}
+	// Generating or delivering the report failed; the reason is on the report
+	if report.LastError != "" {
+		c.JSON(http.StatusBadGateway, models.APIResponse{
+			Success: false,
+			Data:    report,
+			Error:   "Report run failed",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    report,
+	})
+}
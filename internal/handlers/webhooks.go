@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Create a webhook subscription
+func (h *Handlers) CreateWebhook(c *gin.Context) {
+	var req models.WebhookSubscriptionRequest
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, validation.MaxRequestBytes)
+	fieldErrors := validation.DecodeStrict(body, &req)
+	if fieldErrors == nil {
+		fieldErrors = validation.WebhookSubscription(req)
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request",
+			Fields:  fieldErrors,
+		})
+		return
+	}
+
+	subscription, err := h.webhookService.CreateSubscription(req)
+	if err != nil {
+		h.logger.Errorf("Failed to create webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to create webhook",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Data:    subscription,
+	})
+}
+
+// List webhook subscriptions
+func (h *Handlers) GetWebhooks(c *gin.Context) {
+	subscriptions, err := h.webhookService.ListSubscriptions()
+	if err != nil {
+		h.logger.Errorf("Failed to get webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve webhooks",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    subscriptions,
+	})
+}
+
+// Delete a webhook subscription
+func (h *Handlers) DeleteWebhook(c *gin.Context) {
+	id, ok := h.idParam(c)
+	if !ok {
+		return
+	}
+
+	deleted, err := h.webhookService.DeleteSubscription(id)
+	if err != nil {
+		h.logger.Errorf("Failed to delete webhook %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to delete webhook",
+		})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "Webhook not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    map[string]string{"message": "Webhook deleted"},
+	})
+}
+
+// Get the delivery log of a webhook subscription
+func (h *Handlers) GetWebhookDeliveries(c *gin.Context) {
+	id, ok := h.idParam(c)
+	if !ok {
+		return
+	}
+
+	status := c.Query("status")
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid limit. Use a number between 1 and 1000",
+		})
+		return
+	}
+
+	deliveries, err := h.webhookService.ListDeliveries(id, status, limit)
+	if err != nil {
+		h.logger.Errorf("Failed to get deliveries for webhook %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retrieve deliveries",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    deliveries,
+	})
+}
+
+// Requeue a dead-lettered delivery
+func (h *Handlers) RetryWebhookDelivery(c *gin.Context) {
+	id, ok := h.idParam(c)
+	if !ok {
+		return
+	}
+
+	retried, err := h.webhookService.RetryDelivery(id)
+	if err != nil {
+		h.logger.Errorf("Failed to retry delivery %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to retry delivery",
+		})
+		return
+	}
+	if !retried {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "No dead delivery with this ID",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    map[string]string{"message": "Delivery requeued"},
+	})
+}
+
+// Parse the numeric :id path parameter, responding with 400 when invalid
+func (h *Handlers) idParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid ID",
+		})
+		return 0, false
+	}
+	return id, true
+}
@@ -1,7 +1,11 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
 	"time"
+	"video-ad-tracker/internal/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
@@ -75,3 +79,49 @@ func Metrics() gin.HandlerFunc {
 func MetricsHandler() gin.HandlerFunc {
 	return gin.WrapH(promhttp.Handler())
 }
+
+// Context key set when the request carried a valid API key
+const authenticatedKey = "api_key_authenticated"
+
+// API key authentication middleware. Requests without a valid key are let
+// through unauthenticated; use RequireAPIKey to reject them.
+func APIKey(keys []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("X-API-Key")
+		if key == "" {
+			if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+				key = bearer
+			}
+		}
+
+		if key != "" {
+			for _, valid := range keys {
+				if valid != "" && subtle.ConstantTimeCompare([]byte(key), []byte(valid)) == 1 {
+					c.Set(authenticatedKey, true)
+					break
+				}
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// Reject requests that were not authenticated by APIKey
+func RequireAPIKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !IsAuthenticated(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, models.APIResponse{
+				Success: false,
+				Error:   "Valid API key required",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Check whether the request carried a valid API key
+func IsAuthenticated(c *gin.Context) bool {
+	return c.GetBool(authenticatedKey)
+}
@@ -1,9 +1,28 @@
 package models
 
 import (
+	"encoding/json"
+	"errors"
 	"time"
 )
 
+// Errors returned when a click references an ad that cannot accept clicks
+var (
+	ErrAdNotFound = errors.New("ad not found")
+	ErrAdInactive = errors.New("ad is inactive")
+)
+
+// ErrInvalidSubject is returned for unsupported or malformed data subjects
+var ErrInvalidSubject = errors.New("invalid data subject")
+
+// ErrSeriesOutOfRange is returned for series that could only be built from
+// rollups already purged for part of their window
+var ErrSeriesOutOfRange = errors.New("series reaches back past the retention of the rollups it needs")
+
+// ErrDeliveryUnavailable is returned for reports delivered by a method the
+// service is not configured for
+var ErrDeliveryUnavailable = errors.New("report delivery method is not configured")
+
 // Ad represents a video advertisement
 type Ad struct {
 	ID          int       `json:"id" db:"id"`
@@ -11,6 +30,7 @@ type Ad struct {
 	TargetURL   string    `json:"target_url" db:"target_url"`
 	Title       string    `json:"title" db:"title"`
 	Description string    `json:"description" db:"description"`
+	Active      bool      `json:"active" db:"active"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
 }
@@ -18,35 +38,408 @@ type Ad struct {
 // ClickEvent represents a user click on an ad
 type ClickEvent struct {
 	ID                int       `json:"id" db:"id"`
+	ClickID           string    `json:"click_id" db:"click_uid"`
 	AdID              int       `json:"ad_id" db:"ad_id"`
 	Timestamp         time.Time `json:"timestamp" db:"timestamp"`
 	IPAddress         string    `json:"ip_address" db:"ip_address"`
+	ConnectionIP      string    `json:"connection_ip" db:"connection_ip"`
 	VideoPlaybackTime float64   `json:"video_playback_time" db:"video_playback_time"`
 	UserAgent         string    `json:"user_agent" db:"user_agent"`
+	ConsentStatus     string    `json:"consent_status" db:"consent_status"`
+	ViewerID          string    `json:"viewer_id" db:"viewer_id"`
+	SessionID         string    `json:"session_id" db:"session_id"`
 	Processed         bool      `json:"processed" db:"processed"`
 }
 
 // ClickRequest represents the incoming click data
 type ClickRequest struct {
-	AdID              int     `json:"ad_id" binding:"required"`
+	AdID              int     `json:"ad_id"`
 	VideoPlaybackTime float64 `json:"video_playback_time"`
 	IPAddress         string  `json:"ip_address"`
 	UserAgent         string  `json:"user_agent"`
+	GDPR              *int    `json:"gdpr"`         // 1 when GDPR applies, 0 when it does not
+	ConsentString     string  `json:"gdpr_consent"` // IAB TCF v2 consent string
+	DeviceID          string  `json:"device_id"`    // Client supplied viewer ID, takes precedence over the cookie
+}
+
+// ClickMetadata carries request details resolved by the HTTP layer
+type ClickMetadata struct {
+	ConnectionIP string // Address of the peer connected to the server
+	ClientIP     string // Resolved originating client address
+	GPC          bool   // Sec-GPC: 1 header was sent
+	DoNotTrack   bool   // DNT: 1 header was sent
+	ViewerCookie string // Viewer ID from the first-party cookie
+	UserAgent    string // User-Agent header of the request
+}
+
+// ClickResult is returned once a click has been accepted
+type ClickResult struct {
+	ClickID  string // Public ID used to attribute conversions to the click
+	ViewerID string // Empty when consent does not allow identifying the viewer
+}
+
+// ConversionRequest is a conversion postback, identified by click or viewer
+type ConversionRequest struct {
+	ConversionID string  `json:"conversion_id"` // Advertiser ID used to ignore repeated postbacks
+	ClickID      string  `json:"click_id"`
+	ViewerID     string  `json:"viewer_id"`
+	Value        float64 `json:"value"`
+}
+
+// Conversion is a recorded conversion and the click it was attributed to
+type Conversion struct {
+	ID           int       `json:"id" db:"id"`
+	ConversionID string    `json:"conversion_id,omitempty" db:"conversion_id"`
+	ClickID      string    `json:"click_id,omitempty" db:"click_uid"`
+	AdID         int       `json:"ad_id,omitempty" db:"ad_id"`
+	ViewerID     string    `json:"viewer_id,omitempty" db:"viewer_id"`
+	Value        float64   `json:"value" db:"value"`
+	Attributed   bool      `json:"attributed" db:"attributed"`
+	ConvertedAt  time.Time `json:"converted_at" db:"converted_at"`
 }
 
 // Analytics represents aggregated ad performance metrics
 type Analytics struct {
-	AdID            int       `json:"ad_id"`
+	AdID                int                  `json:"ad_id"`
+	TotalClicks         int                  `json:"total_clicks"`
+	UniqueIPs           int                  `json:"unique_ips"` // Counted once per UTC day and address in hash privacy mode
+	ConsentedClicks     int                  `json:"consented_clicks"`
+	NonConsentedClicks  int                  `json:"non_consented_clicks"`
+	NotApplicableClicks int                  `json:"not_applicable_clicks"` // No consent signal and GDPR did not apply
+	UniqueViewers       int                  `json:"unique_viewers"`        // Distinct viewers active across all ads
+	UniqueClickers      int                  `json:"unique_clickers"`
+	ClicksPerSession    float64              `json:"clicks_per_session"`
+	Conversions         int                  `json:"conversions"`
+	ConversionRate      float64              `json:"conversion_rate"` // Conversions per 100 clicks
+	Revenue             float64              `json:"revenue"`
+	CTR                 float64              `json:"ctr"` // Click-through rate
+	AvgPlaybackTime     float64              `json:"avg_playback_time"`
+	PartialMetrics      []string             `json:"partial_metrics,omitempty"` // Metrics only covering the part of the window within raw retention
+	TimeFrame           string               `json:"time_frame"`                // Preset window, or "custom" for from/to
+	From                time.Time            `json:"from"`
+	To                  time.Time            `json:"to"`
+	Granularity         string               `json:"granularity,omitempty"`
+	Dimensions          map[string]string    `json:"dimensions,omitempty"` // Values of the group_by dimensions
+	Series              []AnalyticsPoint     `json:"series,omitempty"`
+	Comparison          *AnalyticsComparison `json:"comparison,omitempty"` // One point per bucket, including empty ones
+	LastUpdated         time.Time            `json:"last_updated"`
+}
+
+// Windows analytics can be compared against
+const (
+	ComparePreviousPeriod = "previous_period" // The window of the same length just before
+	ComparePreviousYear   = "previous_year"   // The same window one year earlier
+)
+
+// AnalyticsComparison holds the metrics of the same ad over an earlier
+// window and how the current window differs from them
+type AnalyticsComparison struct {
+	Mode     string                 `json:"mode"`
+	From     time.Time              `json:"from"`
+	To       time.Time              `json:"to"`
+	Previous map[string]float64     `json:"previous"`
+	Deltas   map[string]MetricDelta `json:"deltas"`
+}
+
+// MetricDelta is the change of a metric against the earlier window
+type MetricDelta struct {
+	Absolute float64  `json:"absolute"`
+	Percent  *float64 `json:"percent"` // Null when the earlier value is zero
+}
+
+// Dimensions analytics can be grouped by and filtered on
+var AnalyticsDimensions = []string{"device_type", "os", "browser", "country"}
+
+// AnalyticsPoint holds the additive metrics of an ad for one time bucket
+type AnalyticsPoint struct {
+	Bucket          time.Time `json:"bucket"`
 	TotalClicks     int       `json:"total_clicks"`
-	CTR             float64   `json:"ctr"` // Click-through rate
+	ConsentedClicks int       `json:"consented_clicks"`
 	AvgPlaybackTime float64   `json:"avg_playback_time"`
-	TimeFrame       string    `json:"time_frame"`
-	LastUpdated     time.Time `json:"last_updated"`
+}
+
+// AnalyticsSeriesRow is one point of a series together with the ad and
+// dimension values it belongs to, as streamed to exports
+type AnalyticsSeriesRow struct {
+	AdID       int
+	Dimensions map[string]string
+	Point      AnalyticsPoint
+}
+
+// PlaybackDistribution describes how video playback times of an ad's
+// clicks are spread, in seconds
+type PlaybackDistribution struct {
+	AdID      int               `json:"ad_id"`
+	Clicks    int               `json:"clicks"`
+	Min       float64           `json:"min"`
+	Max       float64           `json:"max"`
+	Mean      float64           `json:"mean"`
+	Median    float64           `json:"median"`
+	P90       float64           `json:"p90"`
+	P99       float64           `json:"p99"`
+	Histogram []HistogramBucket `json:"histogram"`
+	TimeFrame string            `json:"time_frame"`
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+}
+
+// HistogramBucket counts values in [From, To)
+type HistogramBucket struct {
+	From  float64  `json:"from"`
+	To    *float64 `json:"to,omitempty"` // Unbounded for the last bucket
+	Count int      `json:"count"`
+}
+
+// LiveAnalytics is one update of the live analytics stream
+type LiveAnalytics struct {
+	Timestamp     time.Time     `json:"timestamp"`
+	WindowSeconds int           `json:"window_seconds"` // Length of the rolling window
+	Since         time.Time     `json:"since"`          // Start of the total counts
+	Ads           []LiveAdStats `json:"ads"`
+}
+
+// LiveAdStats holds the live counters of one ad
+type LiveAdStats struct {
+	AdID            int     `json:"ad_id"`
+	TotalClicks     int     `json:"total_clicks"`  // Since the instance started
+	WindowClicks    int     `json:"window_clicks"` // Within the rolling window
+	ClicksPerMinute float64 `json:"clicks_per_minute"`
+	CTR             float64 `json:"ctr"` // Over the rolling window
+	AvgPlaybackTime float64 `json:"avg_playback_time"`
+}
+
+// Leaderboard modes and metrics
+const (
+	LeaderboardTop      = "top"      // Highest value of the metric in the window
+	LeaderboardTrending = "trending" // Largest rise in clicks over the ad's own baseline
+	MetricClicks        = "clicks"
+	MetricCTR           = "ctr"
+	MetricPlayback      = "playback"
+)
+
+// LeaderboardQuery selects the ranking of a leaderboard
+type LeaderboardQuery struct {
+	Mode   string
+	Metric string
+	Window string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// Leaderboard ranks ads over a window
+type Leaderboard struct {
+	Mode   string    `json:"mode"`
+	Metric string    `json:"metric"`
+	Window string    `json:"window"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Ads    []TopAd   `json:"ads"`
+}
+
+// TopAd is one entry of a leaderboard
+type TopAd struct {
+	Rank            int     `json:"rank"`
+	AdID            int     `json:"ad_id"`
+	Title           string  `json:"title"`
+	Value           float64 `json:"value"` // Of the ranked metric
+	TotalClicks     int     `json:"total_clicks"`
+	CTR             float64 `json:"ctr"`
+	AvgPlaybackTime float64 `json:"avg_playback_time"`
+	BaselineClicks  float64 `json:"baseline_clicks,omitempty"` // Trending only, average clicks per earlier window
+	Growth          float64 `json:"growth,omitempty"`          // Trending only, percent above the baseline
+}
+
+// AnalyticsQuery selects the window, and optionally the series buckets, of
+// an analytics request
+type AnalyticsQuery struct {
+	TimeFrame   string
+	From        time.Time
+	To          time.Time
+	Granularity string              // Empty for totals only
+	Location    *time.Location      // Time zone of series buckets and labels
+	GroupBy     []string            // Dimensions to break each ad down by
+	Filters     map[string][]string // Accepted values per dimension
+	Compare     string              // Earlier window to compare against, empty for none
+}
+
+// SubjectRequest identifies a data subject for access or erasure requests
+type SubjectRequest struct {
+	SubjectType string `json:"subject_type" binding:"required"` // "ip" or "viewer"
+	Subject     string `json:"subject" binding:"required"`
+	RequestedBy string `json:"requested_by"`
+	Reference   string `json:"reference"` // External ticket or case number
+}
+
+// SubjectExport is the machine-readable result of an access request
+type SubjectExport struct {
+	RequestID   string            `json:"request_id"`
+	SubjectType string            `json:"subject_type"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	EventCount  int               `json:"event_count"`
+	ClickEvents []ClickEvent      `json:"click_events"`
+	Conversions []Conversion      `json:"conversions"`
+	Webhooks    []WebhookDelivery `json:"webhook_deliveries"` // Queued or sent events carrying the subject's clicks
+}
+
+// PrivacyReceipt records the outcome of an access or erasure request
+type PrivacyReceipt struct {
+	ReceiptID     string    `json:"receipt_id"`
+	RequestType   string    `json:"request_type"`
+	SubjectType   string    `json:"subject_type"`
+	SubjectHash   string    `json:"subject_hash"` // HMAC-SHA256 of the subject, empty without a receipt key; the subject itself is not kept
+	RequestedBy   string    `json:"requested_by"`
+	Reference     string    `json:"reference"`
+	EventsMatched int       `json:"events_matched"`
+	EventsDeleted int       `json:"events_deleted"`
+	CompletedAt   time.Time `json:"completed_at"`
+}
+
+// Event types delivered to webhook subscribers
+const (
+	EventClickRecorded      = "click.recorded"
+	EventConversionRecorded = "conversion.recorded"
+	EventAnomalyDetected    = "anomaly.detected"
+)
+
+// WebhookSubscriptionRequest creates a webhook subscription
+type WebhookSubscriptionRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret"` // Generated when empty
+}
+
+// WebhookSubscription is an endpoint receiving events of the given types
+type WebhookSubscription struct {
+	ID         int       `json:"id" db:"id"`
+	URL        string    `json:"url" db:"url"`
+	EventTypes []string  `json:"event_types" db:"event_types"`
+	Secret     string    `json:"secret,omitempty" db:"secret"` // Only returned on creation
+	Active     bool      `json:"active" db:"active"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// WebhookDelivery is one event queued for, or delivered to, a subscription
+type WebhookDelivery struct {
+	ID             int             `json:"id" db:"id"`
+	SubscriptionID int             `json:"subscription_id" db:"subscription_id"`
+	EventType      string          `json:"event_type" db:"event_type"`
+	Status         string          `json:"status" db:"status"` // pending, delivered or dead
+	Attempts       int             `json:"attempts" db:"attempts"`
+	LastStatusCode int             `json:"last_status_code,omitempty" db:"last_status_code"`
+	LastError      string          `json:"last_error,omitempty" db:"last_error"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at" db:"next_attempt_at"`
+	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty" db:"delivered_at"`
+	Payload        json.RawMessage `json:"payload,omitempty" db:"payload"` // Only included in subject exports
+}
+
+// Ways a scheduled report is delivered
+const (
+	ReportDeliveryEmail     = "email"     // Attached to an email to the recipients
+	ReportDeliveryDirectory = "directory" // Written to the report directory
+)
+
+// ReportRequest creates a scheduled report
+type ReportRequest struct {
+	Name       string   `json:"name"`
+	Query      string   `json:"query"`  // Query string of /ads/analytics/export, e.g. timeframe=7d&granularity=day
+	Format     string   `json:"format"` // csv, ndjson or xlsx, csv when empty
+	Delivery   string   `json:"delivery"`
+	Recipients []string `json:"recipients"`
+	Schedule   string   `json:"schedule"` // Cron expression, in the time zone of the query's tz
+}
+
+// Report is a saved analytics export run on a schedule
+type Report struct {
+	ID         int        `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	Query      string     `json:"query" db:"query"`
+	Format     string     `json:"format" db:"format"`
+	Delivery   string     `json:"delivery" db:"delivery"`
+	Recipients []string   `json:"recipients" db:"recipients"`
+	Schedule   string     `json:"schedule" db:"schedule"`
+	Active     bool       `json:"active" db:"active"`
+	NextRunAt  time.Time  `json:"next_run_at" db:"next_run_at"`
+	LastRunAt  *time.Time `json:"last_run_at,omitempty" db:"last_run_at"`
+	LastError  string     `json:"last_error,omitempty" db:"last_error"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// AggregationStatus reports the backlog of the aggregation worker
+type AggregationStatus struct {
+	PendingClicks   int        `json:"pending_clicks"`
+	OldestPendingAt *time.Time `json:"oldest_pending_at,omitempty"`
+	LagSeconds      float64    `json:"lag_seconds"`
+	Interval        string     `json:"interval"`
+	BatchSize       int        `json:"batch_size"`
+	LastRunAt       *time.Time `json:"last_run_at,omitempty"`
+	LastProcessed   int        `json:"last_processed"`
+	LastDurationMs  int64      `json:"last_duration_ms"`
+	LastError       string     `json:"last_error,omitempty"`
+}
+
+// ForecastQuery selects the ads and horizon of a click forecast
+type ForecastQuery struct {
+	AdIDs    []int // Ads to forecast
+	Days     int   // Days to project, starting today
+	History  int   // Days of history to fit
+	Interval int   // Coverage of the prediction intervals in percent
+}
+
+// Forecast projects the daily clicks of one ad
+type Forecast struct {
+	AdID        int             `json:"ad_id"`
+	Method      string          `json:"method"`       // holt_winters, holt or naive
+	HistoryDays int             `json:"history_days"` // Days of history the fit used
+	Interval    int             `json:"interval"`
+	Points      []ForecastPoint `json:"points"`
+}
+
+// ForecastPoint is the projected clicks of one day
+type ForecastPoint struct {
+	Date   time.Time `json:"date"`
+	Clicks float64   `json:"clicks"`
+	Lower  float64   `json:"lower"`
+	Upper  float64   `json:"upper"`
+}
+
+// Kinds of anomalies in click volume
+const (
+	AnomalySpike = "spike"
+	AnomalyDrop  = "drop"
+)
+
+// Anomaly is an hour in which an ad's clicks strayed far from their baseline
+type Anomaly struct {
+	ID         int       `json:"id" db:"id"`
+	AdID       int       `json:"ad_id" db:"ad_id"`
+	Bucket     time.Time `json:"bucket" db:"bucket"` // Start of the hour
+	Kind       string    `json:"kind" db:"kind"`     // spike or drop
+	Observed   float64   `json:"observed" db:"observed"`
+	Expected   float64   `json:"expected" db:"expected"`
+	Score      float64   `json:"score" db:"score"` // Deviation in standard deviations
+	DetectedAt time.Time `json:"detected_at" db:"detected_at"`
+}
+
+// AnomalyQuery selects recorded anomalies
+type AnomalyQuery struct {
+	AdID  int // Zero for all ads
+	Since time.Time
+	Limit int
+}
+
+// FieldError describes why a single request field was rejected
+type FieldError struct {
+	Field   string `json:"field,omitempty"` // Empty when the whole body is at fault
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 // APIResponse represents a standard API response
 type APIResponse struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data,omitempty"`
-	Error   string      `json:"error,omitempty"`
+	Success bool         `json:"success"`
+	Data    interface{}  `json:"data,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Fields  []FieldError `json:"fields,omitempty"`
 }
@@ -0,0 +1,225 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mode controls how a personal field is stored
+type Mode string
+
+const (
+	ModeFull     Mode = "full"     // Store the value unchanged
+	ModeTruncate Mode = "truncate" // Zero the host part of an IP address
+	ModeHash     Mode = "hash"     // Store a salted hash, salt rotates daily so hashes only match within a UTC day
+	ModeDrop     Mode = "drop"     // Do not store the value
+)
+
+// ErrSharedAddress is returned when stored addresses cannot be told apart
+// from those of other hosts, as with truncated IPs
+var ErrSharedAddress = errors.New("stored addresses are shared by other hosts")
+
+// Options configures an Anonymizer
+type Options struct {
+	IPMode        Mode
+	UserAgentMode Mode
+	IPv4Prefix    int
+	IPv6Prefix    int
+}
+
+// Anonymizer applies the configured privacy modes to IPs and user agents
+type Anonymizer struct {
+	opts  Options
+	salts *SaltStore
+}
+
+// Create new anonymizer
+func NewAnonymizer(opts Options, salts *SaltStore) (*Anonymizer, error) {
+	switch opts.IPMode {
+	case ModeFull, ModeTruncate, ModeHash, ModeDrop:
+	default:
+		return nil, fmt.Errorf("invalid IP privacy mode %q", opts.IPMode)
+	}
+	switch opts.UserAgentMode {
+	case ModeFull, ModeHash, ModeDrop:
+	default:
+		return nil, fmt.Errorf("invalid user agent privacy mode %q", opts.UserAgentMode)
+	}
+	if opts.IPv4Prefix < 0 || opts.IPv4Prefix > 32 {
+		return nil, fmt.Errorf("invalid IPv4 prefix length %d", opts.IPv4Prefix)
+	}
+	if opts.IPv6Prefix < 0 || opts.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length %d", opts.IPv6Prefix)
+	}
+
+	return &Anonymizer{opts: opts, salts: salts}, nil
+}
+
+// Anonymize an IP address observed at the given time
+func (a *Anonymizer) IP(value string, at time.Time) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch a.opts.IPMode {
+	case ModeTruncate:
+		return a.truncateIP(value), nil
+	case ModeHash:
+		return a.hash(value, at)
+	case ModeDrop:
+		return "", nil
+	default:
+		return value, nil
+	}
+}
+
+// Anonymize a user agent observed at the given time
+func (a *Anonymizer) UserAgent(value string, at time.Time) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch a.opts.UserAgentMode {
+	case ModeHash:
+		return a.hash(value, at)
+	case ModeDrop:
+		return "", nil
+	default:
+		return value, nil
+	}
+}
+
+// Get every stored form an IP may have been written as, used to find the
+// events belonging to a data subject. Truncated addresses are shared by
+// every host in the prefix, so they return ErrSharedAddress instead.
+func (a *Anonymizer) IPCandidates(value string) ([]string, error) {
+	switch a.opts.IPMode {
+	case ModeTruncate:
+		return nil, ErrSharedAddress
+	case ModeHash:
+		salts, err := a.salts.All()
+		if err != nil {
+			return nil, err
+		}
+		candidates := make([]string, 0, len(salts))
+		for _, salt := range salts {
+			candidates = append(candidates, hashWithSalt(salt, value))
+		}
+		return candidates, nil
+	case ModeDrop:
+		return nil, nil
+	default:
+		return []string{value}, nil
+	}
+}
+
+// Zero all bits after the configured prefix length
+func (a *Anonymizer) truncateIP(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(a.opts.IPv4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(a.opts.IPv6Prefix, 128)).String()
+}
+
+func (a *Anonymizer) hash(value string, at time.Time) (string, error) {
+	salt, err := a.salts.ForDay(at)
+	if err != nil {
+		return "", err
+	}
+	return hashWithSalt(salt, value), nil
+}
+
+func hashWithSalt(salt []byte, value string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SaltStore hands out one random salt per UTC day, shared by all instances
+// through the privacy_salts table
+type SaltStore struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	salts map[string][]byte
+}
+
+// Create new salt store
+func NewSaltStore(db *sql.DB) *SaltStore {
+	return &SaltStore{
+		db:    db,
+		salts: make(map[string][]byte),
+	}
+}
+
+// Get the salt for the day containing t, creating it if necessary
+func (s *SaltStore) ForDay(t time.Time) ([]byte, error) {
+	day := t.UTC().Format("2006-01-02")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if salt, ok := s.salts[day]; ok {
+		return salt, nil
+	}
+
+	candidate := make([]byte, 32)
+	if _, err := rand.Read(candidate); err != nil {
+		return nil, err
+	}
+
+	// The first instance to insert wins, everyone reads back the same salt
+	_, err := s.db.Exec(
+		"INSERT INTO privacy_salts (day, salt) VALUES ($1::date, $2) ON CONFLICT (day) DO NOTHING",
+		day, candidate,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var salt []byte
+	if err := s.db.QueryRow("SELECT salt FROM privacy_salts WHERE day = $1::date", day).Scan(&salt); err != nil {
+		return nil, err
+	}
+
+	// Only keep today's salt around, older days are rarely hashed again
+	for cached := range s.salts {
+		if cached < day {
+			delete(s.salts, cached)
+		}
+	}
+	s.salts[day] = salt
+
+	return salt, nil
+}
+
+// Get all salts still on record
+func (s *SaltStore) All() ([][]byte, error) {
+	rows, err := s.db.Query("SELECT salt FROM privacy_salts ORDER BY day")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var salts [][]byte
+	for rows.Next() {
+		var salt []byte
+		if err := rows.Scan(&salt); err != nil {
+			return nil, err
+		}
+		salts = append(salts, salt)
+	}
+	return salts, rows.Err()
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Minimum time between reloads triggered by unknown ad IDs
+const adCacheMissReloadInterval = 5 * time.Second
+
+// AdCache keeps the set of known ad IDs and their active state in memory
+type AdCache struct {
+	db     *sql.DB
+	logger *logrus.Logger
+	ttl    time.Duration
+
+	reloadMu sync.Mutex
+	mu       sync.RWMutex
+	ads      map[int]bool
+	loadedAt time.Time
+}
+
+// Create new ad cache
+func NewAdCache(db *sql.DB, logger *logrus.Logger, ttl time.Duration) *AdCache {
+	return &AdCache{
+		db:     db,
+		logger: logger,
+		ttl:    ttl,
+	}
+}
+
+// Check that an ad exists and is active
+func (c *AdCache) Validate(adID int) error {
+	active, found, stale := c.lookup(adID)
+
+	// Reload when the set is stale, or when the ad is unknown and may have
+	// been created since the last load
+	if stale || (!found && c.sinceLoad() >= adCacheMissReloadInterval) {
+		if err := c.reload(); err != nil {
+			if c.isEmpty() {
+				return err
+			}
+			c.logger.Warnf("Failed to reload ad cache, serving stale entries: %v", err)
+		}
+		active, found, _ = c.lookup(adID)
+	}
+
+	if !found {
+		return models.ErrAdNotFound
+	}
+	if !active {
+		return models.ErrAdInactive
+	}
+	return nil
+}
+
+// Look up an ad in the cached set
+func (c *AdCache) lookup(adID int) (active, found, stale bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	active, found = c.ads[adID]
+	stale = c.ads == nil || time.Since(c.loadedAt) >= c.ttl
+	return active, found, stale
+}
+
+func (c *AdCache) sinceLoad() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return time.Since(c.loadedAt)
+}
+
+func (c *AdCache) isEmpty() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ads == nil
+}
+
+// Reload the ad set from the database
+func (c *AdCache) reload() error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	// Another caller may have reloaded while we were waiting
+	if !c.isEmpty() && c.sinceLoad() < time.Second {
+		return nil
+	}
+
+	rows, err := c.db.Query("SELECT id, active FROM ads")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ads := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		var active bool
+		if err := rows.Scan(&id, &active); err != nil {
+			return err
+		}
+		ads[id] = active
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.ads = ads
+	c.loadedAt = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
@@ -23,7 +23,7 @@ func NewAdService(db *sql.DB, logger *logrus.Logger) *AdService {
 // Get all advertisements
 func (s *AdService) GetAllAds() ([]models.Ad, error) {
 	query := `
-		SELECT id, image_url, target_url, title, description, created_at, updated_at 
+		SELECT id, image_url, target_url, title, description, active, created_at, updated_at 
 		FROM ads 
 		ORDER BY created_at DESC, id ASC
 	`
@@ -44,6 +44,7 @@ func (s *AdService) GetAllAds() ([]models.Ad, error) {
 			&ad.TargetURL,
 			&ad.Title,
 			&ad.Description,
+			&ad.Active,
 			&ad.CreatedAt,
 			&ad.UpdatedAt,
 		)
@@ -60,7 +61,7 @@ func (s *AdService) GetAllAds() ([]models.Ad, error) {
 // Get advertisement by ID
 func (s *AdService) GetAdByID(id int) (*models.Ad, error) {
 	query := `
-		SELECT id, image_url, target_url, title, description, created_at, updated_at 
+		SELECT id, image_url, target_url, title, description, active, created_at, updated_at 
 		FROM ads 
 		WHERE id = $1::integer
 	`
@@ -72,6 +73,7 @@ func (s *AdService) GetAdByID(id int) (*models.Ad, error) {
 		&ad.TargetURL,
 		&ad.Title,
 		&ad.Description,
+		&ad.Active,
 		&ad.CreatedAt,
 		&ad.UpdatedAt,
 	)
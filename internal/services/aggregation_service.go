@@ -0,0 +1,264 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	aggregationProcessedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "aggregation_clicks_processed_total",
+			Help: "Total number of click events folded into the rollups",
+		},
+	)
+
+	aggregationPendingClicks = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "aggregation_pending_clicks",
+			Help: "Click events waiting to be folded into the rollups",
+		},
+	)
+
+	aggregationLagSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "aggregation_lag_seconds",
+			Help: "Age of the oldest click event not yet folded into the rollups",
+		},
+	)
+
+	aggregationRunDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "aggregation_run_duration_seconds",
+			Help:    "Duration of aggregation runs in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	aggregationErrorsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "aggregation_errors_total",
+			Help: "Total number of failed aggregation runs",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(aggregationProcessedTotal)
+	prometheus.MustRegister(aggregationPendingClicks)
+	prometheus.MustRegister(aggregationLagSeconds)
+	prometheus.MustRegister(aggregationRunDuration)
+	prometheus.MustRegister(aggregationErrorsTotal)
+}
+
+// AggregationOptions configures the background aggregation worker
+type AggregationOptions struct {
+	Interval  time.Duration
+	BatchSize int
+}
+
+// AggregationService folds processed click events into the rollups
+type AggregationService struct {
+	db     *sql.DB
+	logger *logrus.Logger
+	opts   AggregationOptions
+
+	mu            sync.Mutex
+	lastRunAt     *time.Time
+	lastProcessed int
+	lastDuration  time.Duration
+	lastError     string
+}
+
+// Create new aggregation service
+func NewAggregationService(db *sql.DB, logger *logrus.Logger, opts AggregationOptions) *AggregationService {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 5 * time.Second
+	}
+	return &AggregationService{
+		db:     db,
+		logger: logger,
+		opts:   opts,
+	}
+}
+
+// Run aggregation on a fixed interval until the context is cancelled
+func (s *AggregationService) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.Run(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Errorf("Aggregation failed: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Process batches until the backlog is drained, returning the number of
+// click events folded into the rollups
+func (s *AggregationService) Run(ctx context.Context) (int, error) {
+	start := time.Now()
+
+	total := 0
+	var runErr error
+	for ctx.Err() == nil {
+		processed, err := s.processBatch(ctx)
+		total += processed
+		if err != nil {
+			runErr = err
+			break
+		}
+		// Keep draining while batches come back full
+		if processed < s.opts.BatchSize {
+			break
+		}
+	}
+
+	duration := time.Since(start)
+	aggregationRunDuration.Observe(duration.Seconds())
+	aggregationProcessedTotal.Add(float64(total))
+	if runErr != nil {
+		aggregationErrorsTotal.Inc()
+	}
+
+	if _, err := s.updateLag(); err != nil && runErr == nil {
+		s.logger.Warnf("Failed to measure aggregation lag: %v", err)
+	}
+
+	s.mu.Lock()
+	s.lastRunAt = &start
+	s.lastProcessed = total
+	s.lastDuration = duration
+	s.lastError = ""
+	if runErr != nil {
+		s.lastError = runErr.Error()
+	}
+	s.mu.Unlock()
+
+	return total, runErr
+}
+
+// Claim one batch of click events, mark them processed and add them to the
+// rollups in the same transaction, so an event is counted exactly once even
+// with several instances running the worker
+func (s *AggregationService) processBatch(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Claimed rows stay locked until commit, so workers on other instances
+	// skip past them to the next unclaimed batch instead of waiting or
+	// counting them twice
+	query := `
+		WITH claimed AS (
+			SELECT id FROM click_events
+			WHERE processed = false
+			ORDER BY id ASC
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE click_events ce SET processed = true, updated_at = NOW()
+		FROM claimed
+		WHERE ce.id = claimed.id
+		RETURNING ce.ad_id, ce.timestamp, ce.device_type, ce.os, ce.browser, ce.country,
+			ce.video_playback_time, ce.consent_status
+	`
+
+	rows, err := tx.QueryContext(ctx, query, s.opts.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	processed := 0
+	deltas := rollupDeltas{}
+	for rows.Next() {
+		var adID int
+		var timestamp time.Time
+		var dims clickDimensions
+		var playbackTime float64
+		var consentStatus string
+		err := rows.Scan(&adID, &timestamp, &dims.deviceType, &dims.os, &dims.browser, &dims.country, &playbackTime, &consentStatus)
+		if err != nil {
+			return 0, err
+		}
+		deltas.add(adID, timestamp, dims, playbackTime, consentStatus, 1)
+		processed++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	if err := deltas.apply(tx); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return processed, nil
+}
+
+// Measure the backlog and publish it as metrics
+func (s *AggregationService) updateLag() (*models.AggregationStatus, error) {
+	status := &models.AggregationStatus{}
+
+	var oldest sql.NullTime
+	err := s.db.QueryRow("SELECT COUNT(*), MIN(timestamp) FROM click_events WHERE processed = false").Scan(&status.PendingClicks, &oldest)
+	if err != nil {
+		return nil, err
+	}
+
+	if oldest.Valid {
+		status.OldestPendingAt = &oldest.Time
+		// Timestamps are wall-clock values read back labelled UTC
+		status.LagSeconds = wallClock(time.Now()).Sub(oldest.Time).Seconds()
+		if status.LagSeconds < 0 {
+			status.LagSeconds = 0
+		}
+	}
+
+	aggregationPendingClicks.Set(float64(status.PendingClicks))
+	aggregationLagSeconds.Set(status.LagSeconds)
+	return status, nil
+}
+
+// Get the current backlog and the outcome of the last run
+func (s *AggregationService) Status() (*models.AggregationStatus, error) {
+	status, err := s.updateLag()
+	if err != nil {
+		s.logger.Errorf("Failed to get aggregation status: %v", err)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status.Interval = s.opts.Interval.String()
+	status.BatchSize = s.opts.BatchSize
+	status.LastRunAt = s.lastRunAt
+	status.LastProcessed = s.lastProcessed
+	status.LastDurationMs = s.lastDuration.Milliseconds()
+	status.LastError = s.lastError
+	return status, nil
+}
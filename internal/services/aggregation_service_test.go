@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Workers racing over the same backlog must fold every click into the
+// rollups exactly once
+func TestAggregationConcurrentWorkersCountOnce(t *testing.T) {
+	db := testDB(t)
+	adIDs := []int{testAd(t, db), testAd(t, db), testAd(t, db)}
+
+	const clicks = 3000
+	_, err := db.Exec(`
+		INSERT INTO click_events (ad_id, timestamp, video_playback_time, consent_status, processed)
+		SELECT ($1::int[])[1 + g % 3],
+			TIMESTAMP '2024-03-01 00:00:00' + (g % 180) * INTERVAL '1 minute' + (g % 7) * INTERVAL '1 second',
+			g % 60,
+			CASE WHEN g % 2 = 0 THEN 'consented' ELSE 'not_applicable' END,
+			false
+		FROM generate_series(1, $2) g
+	`, pq.Array(adIDs), clicks)
+	require.NoError(t, err)
+
+	const workers = 8
+	s := NewAggregationService(db, testLogger(), AggregationOptions{BatchSize: 25})
+
+	var wg sync.WaitGroup
+	counts := make([]int, workers)
+	errs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				processed, err := s.processBatch(context.Background())
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				if processed == 0 {
+					return
+				}
+				counts[i] += processed
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	busy := 0
+	for i := range counts {
+		require.NoError(t, errs[i])
+		total += counts[i]
+		if counts[i] > 0 {
+			busy++
+		}
+	}
+	assert.Equal(t, clicks, total, "clicks claimed by all workers")
+	assert.Greater(t, busy, 1, "work was shared between workers")
+
+	var pending int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM click_events WHERE NOT processed").Scan(&pending))
+	assert.Zero(t, pending)
+
+	// Every rollup table holds exactly the raw counts, per ad
+	for _, table := range []string{rollupMinuteTable, rollupHourTable, rollupDayTable} {
+		rows, err := db.Query(`
+			SELECT e.ad_id, e.clicks, e.consented, e.playback, COALESCE(r.clicks, 0), COALESCE(r.consented, 0), COALESCE(r.playback, 0)
+			FROM (
+				SELECT ad_id, COUNT(*) as clicks, COUNT(*) FILTER (WHERE consent_status = 'consented') as consented,
+					SUM(video_playback_time)::float8 as playback
+				FROM click_events GROUP BY ad_id
+			) e
+			LEFT JOIN (
+				SELECT ad_id, SUM(clicks) as clicks, SUM(consented_clicks) as consented, SUM(playback_sum) as playback
+				FROM ` + table + ` GROUP BY ad_id
+			) r ON r.ad_id = e.ad_id
+		`)
+		require.NoError(t, err)
+		for rows.Next() {
+			var adID int
+			var rawClicks, rawConsented, rollupClicks, rollupConsented int64
+			var rawPlayback, rollupPlayback float64
+			require.NoError(t, rows.Scan(&adID, &rawClicks, &rawConsented, &rawPlayback, &rollupClicks, &rollupConsented, &rollupPlayback))
+			assert.Equal(t, rawClicks, rollupClicks, "%s clicks of ad %d", table, adID)
+			assert.Equal(t, rawConsented, rollupConsented, "%s consented clicks of ad %d", table, adID)
+			assert.InDelta(t, rawPlayback, rollupPlayback, 1e-6, "%s playback of ad %d", table, adID)
+		}
+		require.NoError(t, rows.Err())
+		rows.Close()
+	}
+}
@@ -3,8 +3,11 @@ package services
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/timeseries"
 
 	"github.com/sirupsen/logrus"
 )
@@ -12,100 +15,174 @@ import (
 type AnalyticsService struct {
 	db     *sql.DB
 	logger *logrus.Logger
+	// How long raw events, conversions, viewer sessions and minute rollups
+	// are kept before the retention worker purges them
+	rawRetention time.Duration
 }
 
+// Metrics taken over raw events, conversions and viewer sessions rather than
+// the rollups, by their JSON names
+var rawMetrics = []string{"unique_ips", "unique_viewers", "unique_clickers", "clicks_per_session", "conversions", "conversion_rate", "revenue"}
+
 // Create new analytics service
-func NewAnalyticsService(db *sql.DB, logger *logrus.Logger) *AnalyticsService {
+func NewAnalyticsService(db *sql.DB, logger *logrus.Logger, rawRetention time.Duration) *AnalyticsService {
 	return &AnalyticsService{
-		db:     db,
-		logger: logger,
+		db:           db,
+		logger:       logger,
+		rawRetention: rawRetention,
 	}
 }
 
-// Get real-time analytics for ads
-func (s *AnalyticsService) GetAnalytics(timeFrame string) ([]models.Analytics, error) {
-	// Process pending clicks first
-	if err := s.processUnprocessedClicks(); err != nil {
-		s.logger.Errorf("Failed to process unprocessed clicks: %v", err)
+// Get the metrics that only cover part of a window starting at from, as
+// the raw data they are taken over has been purged from its start
+func (s *AnalyticsService) partialMetrics(from time.Time) []string {
+	if s.rawRetention > 0 && from.Before(time.Now().Add(-s.rawRetention)) {
+		return rawMetrics
 	}
+	return nil
+}
 
-	// Get time window
-	timeWindow := s.getTimeWindow(timeFrame)
+// Get analytics for ads over the query window, with a per ad series when a
+// granularity is given and the metrics of an earlier window when a
+// comparison is asked for
+func (s *AnalyticsService) GetAnalytics(query models.AnalyticsQuery) ([]models.Analytics, error) {
+	analytics, err := s.getAnalytics(query)
+	if err != nil || query.Compare == "" {
+		return analytics, err
+	}
 
-	query := `
-		SELECT 
-			a.id as ad_id,
-			COUNT(ce.id) as total_clicks,
-			COALESCE(AVG(ce.video_playback_time), 0.0) as avg_playback_time
-		FROM ads a
-		LEFT JOIN click_events ce ON a.id = ce.ad_id 
-			AND ce.timestamp >= $1::timestamp
-		GROUP BY a.id, a.title
-		ORDER BY total_clicks DESC NULLS LAST, a.id ASC
-	`
+	location := query.Location
+	if location == nil {
+		location = time.UTC
+	}
+	previousQuery := query
+	previousQuery.From, previousQuery.To = previousWindow(query.Compare, query.From.In(location), query.To.In(location))
+	previousQuery.Granularity = ""
+	previousQuery.Compare = ""
 
-	rows, err := s.db.Query(query, timeWindow)
+	previous, err := s.getAnalytics(previousQuery)
 	if err != nil {
-		s.logger.Errorf("Failed to query analytics: %v", err)
 		return nil, err
 	}
-	defer rows.Close()
-
-	var analytics []models.Analytics
-	for rows.Next() {
-		var analytic models.Analytics
-		err := rows.Scan(
-			&analytic.AdID,
-			&analytic.TotalClicks,
-			&analytic.AvgPlaybackTime,
-		)
-		if err != nil {
-			s.logger.Errorf("Failed to scan analytics: %v", err)
-			return nil, err
-		}
-
-		// Calculate click-through rate
-		analytic.CTR = s.calculateCTR(analytic.AdID, timeWindow)
-		analytic.TimeFrame = timeFrame
-		analytic.LastUpdated = time.Now()
-
-		analytics = append(analytics, analytic)
+	previousByKey := make(map[string]models.Analytics, len(previous))
+	for _, analytic := range previous {
+		previousByKey[analyticsKey(analytic, query.GroupBy)] = analytic
 	}
 
+	// The earlier window starts first, so its partial metrics include those
+	// of the current one
+	partial := s.partialMetrics(previousQuery.From)
+	for i := range analytics {
+		// Groups not seen in the earlier window compare against zero
+		earlier := previousByKey[analyticsKey(analytics[i], query.GroupBy)]
+		analytics[i].Comparison = compareAnalytics(query.Compare, analytics[i], earlier, previousQuery.From.In(location), previousQuery.To.In(location), partial)
+	}
 	return analytics, nil
 }
 
-// Get hourly breakdown for the last 24 hours
-func (s *AnalyticsService) GetHourlyBreakdown() ([]models.Analytics, error) {
-	// Process pending clicks first
-	if err := s.processUnprocessedClicks(); err != nil {
-		s.logger.Errorf("Failed to process unprocessed clicks: %v", err)
-	}
-
-	query := `
-		WITH hourly_data AS (
-			SELECT 
-				a.id as ad_id,
-				COUNT(ce.id) as total_clicks,
-				COALESCE(AVG(ce.video_playback_time), 0.0) as avg_playback_time,
-				EXTRACT(hour FROM ce.timestamp) as hour
-			FROM ads a
-			LEFT JOIN click_events ce ON a.id = ce.ad_id 
-				AND ce.timestamp >= NOW() - INTERVAL '24 hours'
-			GROUP BY a.id, EXTRACT(hour FROM ce.timestamp)
+// Get analytics for a single window. Takes one query for all rows, plus one
+// for the series, however many ads there are.
+func (s *AnalyticsService) getAnalytics(query models.AnalyticsQuery) ([]models.Analytics, error) {
+	// Stored timestamps are in server local time
+	from := query.From.In(time.Local)
+	to := query.To.In(time.Local)
+	location := query.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	sel := newDimensionSelection(query.GroupBy, query.Filters)
+
+	// Additive counters come from the rollups, distinct counts can only be
+	// taken over the raw events and viewer sessions, so they only cover the
+	// part of the window within their retention and are flagged as partial
+	var args []interface{}
+	totalsQuery := rollupTotalsQuery(from, to, sel, &args)
+	args = append(args, from, to)
+	fromParam := fmt.Sprintf("$%d::timestamp", len(args)-1)
+	toParam := fmt.Sprintf("$%d::timestamp", len(args))
+	rawFilter := sel.filter("", &args)
+
+	// Every ad gets a row, or with group_by every combination seen in the
+	// window
+	groups := `SELECT id as ad_id FROM ads`
+	if sel.grouped() {
+		groups = `
+			SELECT ad_id` + sel.columns("") + ` FROM t
+			UNION
+			SELECT ad_id` + sel.columns("") + ` FROM cv`
+	}
+
+	// Conversions take their dimensions from the click they are attributed to
+	sqlQuery := `
+		WITH t AS (` + totalsQuery + `
+		), u AS (
+			-- Hashed addresses change with the daily salt, so in hash mode an
+			-- address counts once for every UTC day it was seen on
+			SELECT ad_id` + sel.columns("") + `,
+				COUNT(DISTINCT NULLIF(ip_address, '')) as unique_ips,
+				COUNT(DISTINCT viewer_id) as unique_clickers,
+				COUNT(DISTINCT session_id) as sessions,
+				COUNT(session_id) as session_clicks
+			FROM click_events
+			WHERE timestamp >= ` + fromParam + ` AND timestamp < ` + toParam + rawFilter + `
+			GROUP BY ad_id` + sel.columns("") + `
+		), cv AS (
+			SELECT ad_id` + sel.columns("") + `, COUNT(*) as conversions, SUM(value) as revenue
+			FROM (
+				SELECT c.ad_id, c.value,
+					COALESCE(ce.device_type, 'unknown') as device_type,
+					COALESCE(ce.os, 'unknown') as os,
+					COALESCE(ce.browser, 'unknown') as browser,
+					COALESCE(ce.country, 'unknown') as country
+				FROM conversions c
+				LEFT JOIN click_events ce ON ce.id = c.click_event_id
+				WHERE c.attributed AND c.converted_at >= ` + fromParam + ` AND c.converted_at < ` + toParam + `
+			) attributed
+			WHERE TRUE` + rawFilter + `
+			GROUP BY ad_id` + sel.columns("") + `
+		), site_viewers AS (
+			-- Not broken down: viewers active across all ads, the same on every row
+			SELECT COUNT(DISTINCT viewer_id) as site_unique_viewers
+			FROM viewer_sessions
+			WHERE last_seen_at >= ` + fromParam + ` AND started_at < ` + toParam + `
 		)
 		SELECT 
-			ad_id,
-			total_clicks,
-			avg_playback_time,
-			COALESCE(hour, -1) as hour
-		FROM hourly_data
-		ORDER BY ad_id ASC, hour ASC NULLS LAST
+			g.ad_id` + sel.columns("g") + `,
+			COALESCE(t.clicks, 0) as total_clicks,
+			COALESCE(u.unique_ips, 0) as unique_ips,
+			COALESCE(t.consented_clicks, 0) as consented_clicks,
+			COALESCE(t.not_applicable_clicks, 0) as not_applicable_clicks,
+			COALESCE(u.unique_clickers, 0) as unique_clickers,
+			COALESCE(u.sessions, 0) as sessions,
+			COALESCE(u.session_clicks, 0) as session_clicks,
+			COALESCE(t.playback_sum / NULLIF(t.playback_count, 0), 0.0) as avg_playback_time,
+			COALESCE(cv.conversions, 0) as conversions,
+			COALESCE(cv.revenue, 0.0) as revenue,
+			site_viewers.site_unique_viewers
+		FROM (` + groups + `
+		) g
+		CROSS JOIN site_viewers
+		LEFT JOIN t ON t.ad_id = g.ad_id` + sel.join("t", "g") + `
+		LEFT JOIN u ON u.ad_id = g.ad_id` + sel.join("u", "g") + `
+		LEFT JOIN cv ON cv.ad_id = g.ad_id` + sel.join("cv", "g") + `
+		ORDER BY total_clicks DESC, g.ad_id ASC` + sel.columns("g") + `
 	`
 
-	rows, err := s.db.Query(query)
+	var series map[string][]models.AnalyticsPoint
+	var emptySeries []models.AnalyticsPoint
+	var err error
+	if query.Granularity != "" {
+		series, emptySeries, err = s.getSeries(query.Granularity, location, from, to, sel)
+		if err != nil {
+			s.logger.Errorf("Failed to query analytics series: %v", err)
+			return nil, err
+		}
+	}
+
+	rows, err := s.db.Query(sqlQuery, args...)
 	if err != nil {
-		s.logger.Errorf("Failed to query hourly breakdown: %v", err)
+		s.logger.Errorf("Failed to query analytics: %v", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -113,109 +190,308 @@ func (s *AnalyticsService) GetHourlyBreakdown() ([]models.Analytics, error) {
 	var analytics []models.Analytics
 	for rows.Next() {
 		var analytic models.Analytics
-		var hour int
-		err := rows.Scan(
-			&analytic.AdID,
+		var sessions, sessionClicks int
+		dimensionValues := make([]string, len(sel.groupBy))
+		targets := []interface{}{&analytic.AdID}
+		for i := range dimensionValues {
+			targets = append(targets, &dimensionValues[i])
+		}
+		targets = append(targets,
 			&analytic.TotalClicks,
+			&analytic.UniqueIPs,
+			&analytic.ConsentedClicks,
+			&analytic.NotApplicableClicks,
+			&analytic.UniqueClickers,
+			&sessions,
+			&sessionClicks,
 			&analytic.AvgPlaybackTime,
-			&hour,
+			&analytic.Conversions,
+			&analytic.Revenue,
+			&analytic.UniqueViewers,
 		)
-		if err != nil {
-			s.logger.Errorf("Failed to scan hourly breakdown: %v", err)
+		if err := rows.Scan(targets...); err != nil {
+			s.logger.Errorf("Failed to scan analytics: %v", err)
 			return nil, err
 		}
 
-		analytic.CTR = s.calculateCTR(analytic.AdID, time.Now().Add(-24*time.Hour))
-		if hour == -1 {
-			analytic.TimeFrame = "no_clicks"
-		} else {
-			analytic.TimeFrame = fmt.Sprintf("hour_%d", hour)
+		analytic.NonConsentedClicks = analytic.TotalClicks - analytic.ConsentedClicks - analytic.NotApplicableClicks
+		analytic.ClicksPerSession = clicksPerSession(sessionClicks, sessions)
+		if analytic.TotalClicks > 0 {
+			analytic.ConversionRate = float64(analytic.Conversions) / float64(analytic.TotalClicks) * 100
+		}
+
+		// Calculate click-through rate
+		analytic.CTR = clickThroughRate(analytic.TotalClicks)
+		if sel.grouped() {
+			analytic.Dimensions = make(map[string]string, len(sel.groupBy))
+			for i, dimension := range sel.groupBy {
+				analytic.Dimensions[dimension] = dimensionValues[i]
+			}
+		}
+		analytic.PartialMetrics = s.partialMetrics(query.From)
+		analytic.TimeFrame = query.TimeFrame
+		analytic.From = query.From.In(location)
+		analytic.To = query.To.In(location)
+		if query.Granularity != "" {
+			analytic.Granularity = query.Granularity
+			analytic.Series = series[seriesKey(analytic.AdID, dimensionValues)]
+			if analytic.Series == nil {
+				analytic.Series = emptySeries
+			}
 		}
 		analytic.LastUpdated = time.Now()
 
 		analytics = append(analytics, analytic)
 	}
+	if err := rows.Err(); err != nil {
+		s.logger.Errorf("Failed to read analytics: %v", err)
+		return nil, err
+	}
 
 	return analytics, nil
 }
 
-// Process unprocessed click events
-func (s *AnalyticsService) processUnprocessedClicks() error {
-	clicks, err := s.getUnprocessedClicks()
-	if err != nil {
-		return err
+// Get hourly breakdown for the last 24 hours, with hours labelled in the
+// given time zone
+func (s *AnalyticsService) GetHourlyBreakdown(location *time.Location, compare string) ([]models.Analytics, error) {
+	now := time.Now()
+	return s.GetAnalytics(models.AnalyticsQuery{
+		TimeFrame:   "24h",
+		From:        now.Add(-24 * time.Hour),
+		To:          now,
+		Granularity: timeseries.Hour,
+		Location:    location,
+		Compare:     compare,
+	})
+}
+
+// Get the window to compare [from, to) against. Years are stepped back on
+// the calendar of the times' location.
+func previousWindow(mode string, from, to time.Time) (time.Time, time.Time) {
+	if mode == models.ComparePreviousYear {
+		return from.AddDate(-1, 0, 0), to.AddDate(-1, 0, 0)
 	}
+	return from.Add(-to.Sub(from)), from
+}
 
-	for _, click := range clicks {
-		if err := s.markClickProcessed(click.ID); err != nil {
-			s.logger.Errorf("Failed to mark click %d as processed: %v", click.ID, err)
-			continue
+// Identify the row of an ad and its group_by dimension values
+func analyticsKey(analytic models.Analytics, groupBy []string) string {
+	values := make([]string, len(groupBy))
+	for i, dimension := range groupBy {
+		values[i] = analytic.Dimensions[dimension]
+	}
+	return seriesKey(analytic.AdID, values)
+}
+
+// Compare the metrics of two windows, leaving out the partial metrics that
+// would only compare what is left of them
+func compareAnalytics(mode string, current, previous models.Analytics, from, to time.Time, partial []string) *models.AnalyticsComparison {
+	currentMetrics := comparableMetrics(current)
+	previousMetrics := comparableMetrics(previous)
+	for _, metric := range partial {
+		delete(currentMetrics, metric)
+		delete(previousMetrics, metric)
+	}
+
+	comparison := &models.AnalyticsComparison{
+		Mode:     mode,
+		From:     from,
+		To:       to,
+		Previous: previousMetrics,
+		Deltas:   make(map[string]models.MetricDelta, len(currentMetrics)),
+	}
+	for metric, value := range currentMetrics {
+		earlier := previousMetrics[metric]
+		delta := models.MetricDelta{Absolute: value - earlier}
+		if earlier != 0 {
+			percent := (value - earlier) / earlier * 100
+			delta.Percent = &percent
 		}
+		comparison.Deltas[metric] = delta
 	}
+	return comparison
+}
 
-	return nil
+// Metrics compared between windows, keyed by their JSON names
+func comparableMetrics(analytic models.Analytics) map[string]float64 {
+	return map[string]float64{
+		"total_clicks":          float64(analytic.TotalClicks),
+		"unique_ips":            float64(analytic.UniqueIPs),
+		"consented_clicks":      float64(analytic.ConsentedClicks),
+		"non_consented_clicks":  float64(analytic.NonConsentedClicks),
+		"not_applicable_clicks": float64(analytic.NotApplicableClicks),
+		"unique_clickers":       float64(analytic.UniqueClickers),
+		"clicks_per_session":    analytic.ClicksPerSession,
+		"conversions":           float64(analytic.Conversions),
+		"conversion_rate":       analytic.ConversionRate,
+		"revenue":               analytic.Revenue,
+		"ctr":                   analytic.CTR,
+		"avg_playback_time":     analytic.AvgPlaybackTime,
+	}
 }
 
-// Get unprocessed click events
-func (s *AnalyticsService) getUnprocessedClicks() ([]models.ClickEvent, error) {
-	query := `
-		SELECT id, ad_id, timestamp, ip_address, video_playback_time, user_agent, processed
-		FROM click_events 
-		WHERE processed = false
-		ORDER BY timestamp ASC, id ASC
-		LIMIT 1000
-	`
+// Get the series of whole buckets, in the given time zone, overlapping
+// [from, to) per ad and group_by dimension values, with a zero point for
+// every bucket without clicks. Rows without any clicks get the returned
+// empty series.
+func (s *AnalyticsService) getSeries(granularity string, location *time.Location, from, to time.Time, sel dimensionSelection) (map[string][]models.AnalyticsPoint, []models.AnalyticsPoint, error) {
+	buckets, query, args, err := s.seriesQuery(granularity, location, from, to, sel)
+	if err != nil || len(buckets) == 0 {
+		return nil, nil, err
+	}
 
-	rows, err := s.db.Query(query)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer rows.Close()
 
-	var clicks []models.ClickEvent
+	index := make(map[int64]int, len(buckets))
+	for i, bucket := range buckets {
+		index[bucket.Unix()] = i
+	}
+
+	type pointCounters struct {
+		clicks, consented, playbackCount int
+		playbackSum                      float64
+	}
+	counters := map[string][]pointCounters{}
 	for rows.Next() {
-		var click models.ClickEvent
-		err := rows.Scan(
-			&click.ID,
-			&click.AdID,
-			&click.Timestamp,
-			&click.IPAddress,
-			&click.VideoPlaybackTime,
-			&click.UserAgent,
-			&click.Processed,
-		)
-		if err != nil {
-			return nil, err
+		var adID, clicks, consented, playbackCount int
+		var bucket time.Time
+		var playbackSum float64
+		dimensionValues := make([]string, len(sel.groupBy))
+		targets := []interface{}{&adID}
+		for i := range dimensionValues {
+			targets = append(targets, &dimensionValues[i])
+		}
+		targets = append(targets, &bucket, &clicks, &consented, &playbackSum, &playbackCount)
+		if err := rows.Scan(targets...); err != nil {
+			return nil, nil, err
+		}
+		key := seriesKey(adID, dimensionValues)
+
+		seriesBucket := timeseries.Truncate(granularity, localTime(bucket).In(location))
+		i, ok := index[seriesBucket.Unix()]
+		if !ok {
+			continue
 		}
-		clicks = append(clicks, click)
+		if counters[key] == nil {
+			counters[key] = make([]pointCounters, len(buckets))
+		}
+		point := &counters[key][i]
+		point.clicks += clicks
+		point.consented += consented
+		point.playbackSum += playbackSum
+		point.playbackCount += playbackCount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	newSeries := func() []models.AnalyticsPoint {
+		points := make([]models.AnalyticsPoint, len(buckets))
+		for i, bucket := range buckets {
+			points[i].Bucket = bucket
+		}
+		return points
+	}
+
+	series := make(map[string][]models.AnalyticsPoint, len(counters))
+	for key, adCounters := range counters {
+		points := newSeries()
+		for i, c := range adCounters {
+			points[i].TotalClicks = c.clicks
+			points[i].ConsentedClicks = c.consented
+			if c.playbackCount > 0 {
+				points[i].AvgPlaybackTime = c.playbackSum / float64(c.playbackCount)
+			}
+		}
+		series[key] = points
+	}
+
+	return series, newSeries(), nil
+}
+
+// Build the query behind a series, returning the buckets it covers. Rows
+// hold the ad, the group_by dimension values, the start of a rollup bucket
+// and its counters; rollup buckets are folded into the series buckets by
+// the caller. Series that can only be built from minute rollups fail with
+// models.ErrSeriesOutOfRange once they reach back past their retention,
+// rather than coming back as zeros.
+func (s *AnalyticsService) seriesQuery(granularity string, location *time.Location, from, to time.Time, sel dimensionSelection) ([]time.Time, string, []interface{}, error) {
+	buckets, err := timeseries.Buckets(granularity, from.In(location), to.In(location), timeseries.MaxBuckets)
+	if err != nil || len(buckets) == 0 {
+		return nil, "", nil, err
+	}
+	start := buckets[0]
+	end := timeseries.Next(granularity, buckets[len(buckets)-1])
+
+	// Rollups are bucketed in server local time, so read the finest table
+	// whose buckets still fall entirely inside the requested ones
+	source := seriesSource(granularity, location, append(buckets, end))
+	table := rollupDayTable
+	switch source {
+	case timeseries.Minute:
+		table = rollupMinuteTable
+		if s.rawRetention > 0 && start.Before(time.Now().Add(-s.rawRetention)) {
+			return nil, "", nil, models.ErrSeriesOutOfRange
+		}
+	case timeseries.Hour:
+		table = rollupHourTable
 	}
 
-	return clicks, nil
+	args := []interface{}{wallClock(start.In(time.Local)), wallClock(end.In(time.Local))}
+	query := fmt.Sprintf(`
+		SELECT ad_id%[3]s, date_trunc('%[1]s', bucket) as source_bucket,
+			SUM(clicks) as clicks, SUM(consented_clicks) as consented_clicks,
+			SUM(playback_sum) as playback_sum, SUM(playback_count) as playback_count
+		FROM (
+			SELECT ad_id, bucket, %[4]s, clicks, consented_clicks, playback_sum, playback_count
+			FROM %[2]s
+			UNION ALL
+			SELECT ad_id, bucket, %[4]s, clicks, consented_clicks, playback_sum, playback_count
+			FROM (`+unprocessedClicksQuery+`) pending
+		) counters
+		WHERE bucket >= $1 AND bucket < $2%[5]s
+		GROUP BY ad_id%[3]s, source_bucket
+	`, source, table, sel.columns(""), dimensionColumns, sel.filter("", &args))
+
+	return buckets, query, args, nil
 }
 
-// Mark click event as processed
-func (s *AnalyticsService) markClickProcessed(clickID int) error {
-	query := "UPDATE click_events SET processed = true, updated_at = NOW() WHERE id = $1 AND processed = false"
-	_, err := s.db.Exec(query, clickID)
-	return err
+// Identify the series of an ad and its group_by dimension values
+func seriesKey(adID int, dimensionValues []string) string {
+	return strconv.Itoa(adID) + "|" + strings.Join(dimensionValues, "|")
 }
 
-// Calculate click-through rate for an ad
-func (s *AnalyticsService) calculateCTR(adID int, timeWindow time.Time) float64 {
-	// Basic CTR calculation
-	query := `
-		SELECT COUNT(*)::bigint
-		FROM click_events 
-		WHERE ad_id = $1 AND timestamp >= $2::timestamp
-	`
+// Pick the granularity of rollup to build a series from, given the
+// boundaries of its buckets. Server local days only serve buckets whose
+// boundaries fall where the zone has the same offset, and server local
+// hours only those where it is offset by whole hours. Rollup buckets tile
+// the time between two such boundaries, so offsets changing in between
+// do not matter.
+func seriesSource(granularity string, location *time.Location, boundaries []time.Time) string {
+	sameOffsets, wholeHours := true, true
+	for _, t := range boundaries {
+		_, offset := t.In(location).Zone()
+		_, localOffset := t.In(time.Local).Zone()
+		sameOffsets = sameOffsets && offset == localOffset
+		wholeHours = wholeHours && (offset-localOffset)%3600 == 0
+	}
 
-	var clicks int
-	err := s.db.QueryRow(query, adID, timeWindow).Scan(&clicks)
-	if err != nil {
-		s.logger.Errorf("Failed to count clicks for ad %d: %v", adID, err)
-		return 0
+	switch {
+	case granularity == timeseries.Minute || !wholeHours:
+		return timeseries.Minute
+	case granularity == timeseries.Hour || !sameOffsets:
+		return timeseries.Hour
+	default:
+		return timeseries.Day
 	}
+}
 
+// Click-through rate of a number of clicks
+func clickThroughRate(clicks int) float64 {
 	// Assume 1000 impressions per ad for demo
 	impressions := 1000.0
 	if impressions > 0 {
@@ -224,28 +500,10 @@ func (s *AnalyticsService) calculateCTR(adID int, timeWindow time.Time) float64
 	return 0
 }
 
-// Get time window based on time frame
-func (s *AnalyticsService) getTimeWindow(timeFrame string) time.Time {
-	now := time.Now()
-
-	switch timeFrame {
-	case "15m":
-		return now.Add(-15 * time.Minute)
-	case "30m":
-		return now.Add(-30 * time.Minute)
-	case "1h":
-		return now.Add(-1 * time.Hour)
-	case "6h":
-		return now.Add(-6 * time.Hour)
-	case "12h":
-		return now.Add(-12 * time.Hour)
-	case "24h":
-		return now.Add(-24 * time.Hour)
-	case "7d":
-		return now.Add(-7 * 24 * time.Hour)
-	case "30d":
-		return now.Add(-30 * 24 * time.Hour)
-	default:
-		return now.Add(-24 * time.Hour) // Default 24 hours
+// Average clicks per session, counting only clicks that have a session
+func clicksPerSession(sessionClicks, sessions int) float64 {
+	if sessions == 0 {
+		return 0
 	}
+	return float64(sessionClicks) / float64(sessions)
 }
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/timeseries"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run the test with the server in the given zone
+func serverZone(t *testing.T, location *time.Location) {
+	t.Helper()
+	local := time.Local
+	time.Local = location
+	t.Cleanup(func() { time.Local = local })
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	require.NoError(t, err)
+	return location
+}
+
+func TestSeriesSource(t *testing.T) {
+	serverZone(t, time.UTC)
+	london := loadLocation(t, "Europe/London")
+	kolkata := loadLocation(t, "Asia/Kolkata")
+
+	tests := []struct {
+		name        string
+		granularity string
+		location    *time.Location
+		from, to    time.Time
+		want        string
+	}{
+		{"same zone", timeseries.Day, time.UTC, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), timeseries.Day},
+		{"same offsets throughout", timeseries.Day, london, time.Date(2024, 1, 1, 0, 0, 0, 0, london), time.Date(2024, 2, 1, 0, 0, 0, 0, london), timeseries.Day},
+		// Both ends fall in winter time, the days in between do not
+		{"offset differs between the ends", timeseries.Day, london, time.Date(2024, 3, 1, 0, 0, 0, 0, london), time.Date(2024, 12, 1, 0, 0, 0, 0, london), timeseries.Hour},
+		{"offset differs at a month boundary", timeseries.Month, london, time.Date(2024, 1, 1, 0, 0, 0, 0, london), time.Date(2025, 1, 1, 0, 0, 0, 0, london), timeseries.Hour},
+		{"hour granularity", timeseries.Hour, time.UTC, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), timeseries.Hour},
+		{"half hour offset", timeseries.Day, kolkata, time.Date(2024, 1, 1, 0, 0, 0, 0, kolkata), time.Date(2024, 1, 8, 0, 0, 0, 0, kolkata), timeseries.Minute},
+		{"minute granularity", timeseries.Minute, time.UTC, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC), timeseries.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets, err := timeseries.Buckets(tt.granularity, tt.from.In(tt.location), tt.to.In(tt.location), timeseries.MaxBuckets)
+			require.NoError(t, err)
+			require.NotEmpty(t, buckets)
+			boundaries := append(buckets, timeseries.Next(tt.granularity, buckets[len(buckets)-1]))
+
+			assert.Equal(t, tt.want, seriesSource(tt.granularity, tt.location, boundaries))
+		})
+	}
+}
+
+func TestSeriesQueryPastMinuteRetention(t *testing.T) {
+	serverZone(t, time.UTC)
+	kolkata := loadLocation(t, "Asia/Kolkata")
+	s := NewAnalyticsService(nil, testLogger(), 90*24*time.Hour)
+	sel := newDimensionSelection(nil, nil)
+	old := time.Now().Add(-100 * 24 * time.Hour).Truncate(time.Hour)
+	recent := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+
+	tests := []struct {
+		name        string
+		granularity string
+		location    *time.Location
+		from        time.Time
+		wantErr     error
+	}{
+		{"minute series past retention", timeseries.Minute, time.UTC, old, models.ErrSeriesOutOfRange},
+		{"minute series within retention", timeseries.Minute, time.UTC, recent, nil},
+		{"half hour zone past retention", timeseries.Hour, kolkata, old, models.ErrSeriesOutOfRange},
+		{"half hour zone within retention", timeseries.Hour, kolkata, recent, nil},
+		{"hour series past minute retention", timeseries.Hour, time.UTC, old, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets, _, _, err := s.seriesQuery(tt.granularity, tt.location, tt.from, tt.from.Add(6*time.Hour), sel)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.NotEmpty(t, buckets)
+		})
+	}
+}
+
+func TestPartialMetricsPastRawRetention(t *testing.T) {
+	s := NewAnalyticsService(nil, testLogger(), 90*24*time.Hour)
+	assert.Nil(t, s.partialMetrics(time.Now().Add(-30*24*time.Hour)))
+	assert.Equal(t, rawMetrics, s.partialMetrics(time.Now().Add(-100*24*time.Hour)))
+
+	forever := NewAnalyticsService(nil, testLogger(), 0)
+	assert.Nil(t, forever.partialMetrics(time.Now().AddDate(-5, 0, 0)))
+
+	// Partial metrics are left out of comparisons rather than compared
+	// against what is left of the earlier window
+	current := models.Analytics{TotalClicks: 20, UniqueIPs: 15}
+	previous := models.Analytics{TotalClicks: 10}
+	comparison := compareAnalytics(models.ComparePreviousYear, current, previous, time.Time{}, time.Time{}, rawMetrics)
+	assert.Contains(t, comparison.Deltas, "total_clicks")
+	assert.Equal(t, 10.0, comparison.Deltas["total_clicks"].Absolute)
+	for _, metric := range rawMetrics {
+		assert.NotContains(t, comparison.Deltas, metric)
+		assert.NotContains(t, comparison.Previous, metric)
+	}
+}
+
+// An analytics request costs the same number of queries for one ad as for
+// thousands
+func TestAnalyticsQueryCountIndependentOfAds(t *testing.T) {
+	setup := testDB(t)
+	db := testCountingDB(t)
+	s := NewAnalyticsService(db, testLogger(), 90*24*time.Hour)
+	query := dayAnalyticsQuery()
+
+	counts := map[int]int64{}
+	for _, ads := range []int{1, 5000} {
+		addAdsWithClicks(t, setup, ads)
+		counts[ads] = countQueries(func() {
+			analytics, err := s.GetAnalytics(query)
+			require.NoError(t, err)
+			assert.Len(t, analytics, ads)
+
+			hourly, err := s.GetHourlyBreakdown(time.UTC, "")
+			require.NoError(t, err)
+			assert.Len(t, hourly, ads)
+		})
+	}
+	assert.Positive(t, counts[1])
+	assert.Equal(t, counts[1], counts[5000], "queries for 1 and 5000 ads")
+}
+
+// Grow the ads to the given number, each with a click in the last hour
+func addAdsWithClicks(tb testing.TB, db *sql.DB, total int) {
+	tb.Helper()
+	_, err := db.Exec(`
+		WITH new_ads AS (
+			INSERT INTO ads (image_url, target_url, title)
+			SELECT 'https://example.com/ad.jpg', 'https://example.com', 'Ad ' || g
+			FROM generate_series((SELECT COUNT(*) FROM ads) + 1, $1) g
+			RETURNING id
+		)
+		INSERT INTO click_events (ad_id, timestamp, video_playback_time, consent_status, viewer_id, processed)
+		SELECT id, $2::timestamp, 10, 'consented', 'viewer-' || id, false FROM new_ads
+	`, total, time.Now().Add(-30*time.Minute).In(time.Local))
+	require.NoError(tb, err)
+}
+
+// Analytics of the last day with an hourly series and a comparison
+func dayAnalyticsQuery() models.AnalyticsQuery {
+	now := time.Now()
+	return models.AnalyticsQuery{
+		TimeFrame:   "24h",
+		From:        now.Add(-24 * time.Hour),
+		To:          now,
+		Granularity: timeseries.Hour,
+		Location:    time.UTC,
+		Compare:     models.ComparePreviousPeriod,
+	}
+}
+
+// Report the statements per request next to the time, which stays the same
+// from one ad to thousands
+func BenchmarkGetAnalytics(b *testing.B) {
+	for _, ads := range []int{1, 1000, 5000} {
+		b.Run(fmt.Sprintf("ads=%d", ads), func(b *testing.B) {
+			addAdsWithClicks(b, testDB(b), ads)
+			s := NewAnalyticsService(testCountingDB(b), testLogger(), 90*24*time.Hour)
+			query := dayAnalyticsQuery()
+
+			b.ResetTimer()
+			queries := countQueries(func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := s.GetAnalytics(query); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+		})
+	}
+}
+
+func BenchmarkGetHourlyBreakdown(b *testing.B) {
+	for _, ads := range []int{1, 1000, 5000} {
+		b.Run(fmt.Sprintf("ads=%d", ads), func(b *testing.B) {
+			addAdsWithClicks(b, testDB(b), ads)
+			s := NewAnalyticsService(testCountingDB(b), testLogger(), 90*24*time.Hour)
+
+			b.ResetTimer()
+			queries := countQueries(func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := s.GetHourlyBreakdown(time.UTC, ""); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+		})
+	}
+}
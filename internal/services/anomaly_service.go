@@ -0,0 +1,400 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Tuning of the per ad baseline
+const (
+	anomalySeasonDays     = 7               // Days of the same hour averaged into the seasonal baseline
+	anomalyMinSeasonDays  = 3               // Fewer days with history fall back to the EWMA
+	anomalyMinHistory     = 24 * time.Hour  // Younger ads are not judged yet
+	anomalyEWMAAlpha      = 0.1             // Weight of the newest hour in the EWMA
+	anomalyAggregationLag = 5 * time.Minute // Grace for clicks still on their way into the rollups
+	anomalyMaxBacklog     = 48 * time.Hour  // Unjudged hours further back than this are skipped
+	anomalyHistoryHours   = anomalySeasonDays * 24
+)
+
+var anomaliesDetectedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "anomalies_detected_total",
+		Help: "Total number of click volume anomalies recorded",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(anomaliesDetectedTotal)
+}
+
+// AnomalyNotifier is told about every newly recorded anomaly
+type AnomalyNotifier interface {
+	Notify(anomaly models.Anomaly) error
+}
+
+// LogNotifier reports anomalies as warnings in the service log
+type LogNotifier struct {
+	logger *logrus.Logger
+}
+
+// Create new log notifier
+func NewLogNotifier(logger *logrus.Logger) *LogNotifier {
+	return &LogNotifier{logger: logger}
+}
+
+func (n *LogNotifier) Notify(anomaly models.Anomaly) error {
+	n.logger.WithFields(logrus.Fields{
+		"ad_id":    anomaly.AdID,
+		"bucket":   anomaly.Bucket,
+		"observed": anomaly.Observed,
+		"expected": anomaly.Expected,
+		"score":    anomaly.Score,
+	}).Warnf("Click %s detected", anomaly.Kind)
+	return nil
+}
+
+// WebhookNotifier delivers anomalies to webhook subscribers
+type WebhookNotifier struct {
+	publisher EventPublisher
+}
+
+// Create new webhook notifier
+func NewWebhookNotifier(publisher EventPublisher) *WebhookNotifier {
+	return &WebhookNotifier{publisher: publisher}
+}
+
+func (n *WebhookNotifier) Notify(anomaly models.Anomaly) error {
+	n.publisher.Publish(models.EventAnomalyDetected, anomaly)
+	return nil
+}
+
+// AnomalyOptions configures the anomaly detector
+type AnomalyOptions struct {
+	Interval  time.Duration
+	Threshold float64 // Standard deviations from the baseline that count as an anomaly
+	MinClicks float64 // Volume below which spikes and drops are ignored
+}
+
+// AnomalyService watches the hourly rollups for sudden spikes and drops in
+// the clicks of each ad
+type AnomalyService struct {
+	db        *sql.DB
+	logger    *logrus.Logger
+	opts      AnomalyOptions
+	notifiers []AnomalyNotifier
+}
+
+// Create new anomaly service
+func NewAnomalyService(db *sql.DB, logger *logrus.Logger, opts AnomalyOptions, notifiers ...AnomalyNotifier) *AnomalyService {
+	if opts.Interval <= 0 {
+		opts.Interval = 5 * time.Minute
+	}
+	if opts.Threshold <= 0 {
+		opts.Threshold = 3
+	}
+	return &AnomalyService{
+		db:        db,
+		logger:    logger,
+		opts:      opts,
+		notifiers: notifiers,
+	}
+}
+
+// Run detection on a fixed interval until the context is cancelled
+func (s *AnomalyService) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.Detect(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Errorf("Anomaly detection failed: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Judge every complete hour since the last run, oldest first, for every
+// ad against its baseline, returning the anomalies recorded by this run.
+// Hours before anomalyMaxBacklog are skipped, and the first run only
+// judges the last complete hour. Hours from that of the oldest click the
+// aggregation worker has yet to fold in wait for a later run, so they are
+// not judged on partial rollups. An hour already judged by another run or
+// instance is not recorded or notified again.
+func (s *AnomalyService) Detect(ctx context.Context) ([]models.Anomaly, error) {
+	// Rollup buckets are wall-clock values, so the arithmetic stays in that domain
+	end := wallClock(time.Now().Add(-anomalyAggregationLag)).Truncate(time.Hour)
+	pending, err := s.oldestPendingClick(ctx, end)
+	if err != nil {
+		return nil, err
+	}
+	if !pending.IsZero() && pending.Before(end) {
+		s.logger.Debugf("Anomaly detection waits for clicks pending aggregation since %s", pending.Format(time.DateTime))
+		end = pending.Truncate(time.Hour)
+	}
+	from, err := s.judgedUntil(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if from.IsZero() {
+		from = end.Add(-time.Hour)
+	}
+	if oldest := end.Add(-anomalyMaxBacklog); from.Before(oldest) {
+		s.logger.Warnf("Skipping anomaly detection for the hours from %s to %s", from.Format(time.DateTime), oldest.Format(time.DateTime))
+		from = oldest
+	}
+	if !from.Before(end) {
+		return nil, nil
+	}
+	start := from.Add(-anomalyHistoryHours * time.Hour)
+
+	series, err := s.hourlyClicks(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded []models.Anomaly
+	for bucket := from; bucket.Before(end); bucket = bucket.Add(time.Hour) {
+		// Each hour is judged on the history window ending with it
+		last := int(bucket.Sub(start) / time.Hour)
+		for adID, counts := range series {
+			anomaly, ok := s.judge(counts[last-anomalyHistoryHours : last+1])
+			if !ok {
+				continue
+			}
+			anomaly.AdID = adID
+			anomaly.Bucket = bucket
+
+			inserted, err := s.record(ctx, &anomaly)
+			if err != nil {
+				return recorded, err
+			}
+			if !inserted {
+				continue
+			}
+
+			anomaliesDetectedTotal.WithLabelValues(anomaly.Kind).Inc()
+			for _, notifier := range s.notifiers {
+				if err := notifier.Notify(anomaly); err != nil {
+					s.logger.Warnf("Failed to notify anomaly %d: %v", anomaly.ID, err)
+				}
+			}
+			recorded = append(recorded, anomaly)
+		}
+	}
+
+	return recorded, s.setJudgedUntil(ctx, end)
+}
+
+// Read the time of the oldest click before end not yet folded into the
+// rollups, or the zero time when there is none
+func (s *AnomalyService) oldestPendingClick(ctx context.Context, end time.Time) (time.Time, error) {
+	var oldest sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT MIN(timestamp) FROM click_events WHERE processed = false AND timestamp < $1::timestamp
+	`, end).Scan(&oldest)
+	return oldest.Time, err
+}
+
+// Read the end of the hours judged so far, or the zero time before the
+// first run
+func (s *AnomalyService) judgedUntil(ctx context.Context) (time.Time, error) {
+	var until time.Time
+	err := s.db.QueryRowContext(ctx, "SELECT judged_until FROM anomaly_checks").Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return until, err
+}
+
+// Record that the hours up to until have been judged. Instances racing
+// over the same hours never move it back.
+func (s *AnomalyService) setJudgedUntil(ctx context.Context, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO anomaly_checks (id, judged_until) VALUES (TRUE, $1::timestamp)
+		ON CONFLICT (id) DO UPDATE
+		SET judged_until = GREATEST(anomaly_checks.judged_until, EXCLUDED.judged_until)
+	`, until)
+	return err
+}
+
+// Read the clicks of every ad per hour from start up to end, summed over
+// all dimensions. Hours without a rollup row count as zero clicks, and the
+// last entry is the hour being judged.
+func (s *AnomalyService) hourlyClicks(ctx context.Context, start, end time.Time) (map[int][]float64, error) {
+	query := `
+		SELECT ad_id, bucket, SUM(clicks)
+		FROM ` + rollupHourTable + `
+		WHERE bucket >= $1::timestamp AND bucket < $2::timestamp
+		GROUP BY ad_id, bucket
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := int(end.Sub(start) / time.Hour)
+	series := map[int][]float64{}
+	for rows.Next() {
+		var adID int
+		var bucket time.Time
+		var clicks float64
+		if err := rows.Scan(&adID, &bucket, &clicks); err != nil {
+			return nil, err
+		}
+
+		i := int(bucket.Sub(start) / time.Hour)
+		if i < 0 || i >= hours {
+			continue
+		}
+		if series[adID] == nil {
+			series[adID] = make([]float64, hours)
+		}
+		series[adID][i] += clicks
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
+
+// Compare the last hour of a series with its baseline. The baseline is the
+// same hour on earlier days when there are enough of them, as traffic
+// follows the time of day; otherwise an EWMA of the preceding hours.
+func (s *AnomalyService) judge(counts []float64) (models.Anomaly, bool) {
+	last := len(counts) - 1
+	observed := counts[last]
+
+	// History starts at the first hour with clicks
+	first := 0
+	for first < last && counts[first] == 0 {
+		first++
+	}
+	if time.Duration(last-first)*time.Hour < anomalyMinHistory {
+		return models.Anomaly{}, false
+	}
+
+	var expected, variance float64
+	var season []float64
+	for day := 1; day <= anomalySeasonDays; day++ {
+		if i := last - day*24; i >= first {
+			season = append(season, counts[i])
+		}
+	}
+	if len(season) >= anomalyMinSeasonDays {
+		for _, v := range season {
+			expected += v
+		}
+		expected /= float64(len(season))
+		for _, v := range season {
+			variance += (v - expected) * (v - expected)
+		}
+		variance /= float64(len(season) - 1)
+	} else {
+		expected = counts[first]
+		for _, v := range counts[first+1 : last] {
+			diff := v - expected
+			expected += anomalyEWMAAlpha * diff
+			variance = (1 - anomalyEWMAAlpha) * (variance + anomalyEWMAAlpha*diff*diff)
+		}
+	}
+
+	// Clicks are counts, so the spread is at least their Poisson noise
+	sd := math.Max(math.Sqrt(variance), math.Max(math.Sqrt(expected), 1))
+	score := (observed - expected) / sd
+
+	anomaly := models.Anomaly{Observed: observed, Expected: expected, Score: score}
+	switch {
+	case score >= s.opts.Threshold && observed >= s.opts.MinClicks:
+		anomaly.Kind = models.AnomalySpike
+	case score <= -s.opts.Threshold && expected >= s.opts.MinClicks:
+		anomaly.Kind = models.AnomalyDrop
+	default:
+		return models.Anomaly{}, false
+	}
+	return anomaly, true
+}
+
+// Store an anomaly unless its hour was already recorded for the ad,
+// reporting whether it was inserted
+func (s *AnomalyService) record(ctx context.Context, anomaly *models.Anomaly) (bool, error) {
+	query := `
+		INSERT INTO anomalies (ad_id, bucket, kind, observed, expected, score)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (ad_id, bucket) DO NOTHING
+		RETURNING id, detected_at
+	`
+
+	var detectedAt time.Time
+	err := s.db.QueryRowContext(ctx, query, anomaly.AdID, anomaly.Bucket, anomaly.Kind,
+		anomaly.Observed, anomaly.Expected, anomaly.Score).Scan(&anomaly.ID, &detectedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	anomaly.Bucket = localTime(anomaly.Bucket)
+	anomaly.DetectedAt = localTime(detectedAt)
+	return true, nil
+}
+
+// List recorded anomalies, newest hour first
+func (s *AnomalyService) ListAnomalies(query models.AnomalyQuery) ([]models.Anomaly, error) {
+	args := []interface{}{wallClock(query.Since.In(time.Local)), query.Limit}
+	sqlQuery := `
+		SELECT id, ad_id, bucket, kind, observed, expected, score, detected_at
+		FROM anomalies
+		WHERE bucket >= $1::timestamp`
+	if query.AdID != 0 {
+		args = append(args, query.AdID)
+		sqlQuery += ` AND ad_id = $3`
+	}
+	sqlQuery += `
+		ORDER BY bucket DESC, ad_id ASC
+		LIMIT $2
+	`
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		s.logger.Errorf("Failed to query anomalies: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	anomalies := []models.Anomaly{}
+	for rows.Next() {
+		var a models.Anomaly
+		err := rows.Scan(&a.ID, &a.AdID, &a.Bucket, &a.Kind, &a.Observed, &a.Expected, &a.Score, &a.DetectedAt)
+		if err != nil {
+			s.logger.Errorf("Failed to scan anomaly: %v", err)
+			return nil, err
+		}
+		a.Bucket = localTime(a.Bucket)
+		a.DetectedAt = localTime(a.DetectedAt)
+		anomalies = append(anomalies, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return anomalies, nil
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// History window ending with the hour being judged, with hours hours of
+// history before it produced by clicks and older hours empty
+func anomalyHistory(hours int, clicks func(hour int) float64, observed float64) []float64 {
+	counts := make([]float64, anomalyHistoryHours+1)
+	last := len(counts) - 1
+	for i := last - hours; i < last; i++ {
+		counts[i] = clicks(i)
+	}
+	counts[last] = observed
+	return counts
+}
+
+func TestAnomalyJudge(t *testing.T) {
+	s := NewAnomalyService(nil, testLogger(), AnomalyOptions{Threshold: 3, MinClicks: 10})
+	last := anomalyHistoryHours
+	steady := func(clicks float64) func(int) float64 {
+		return func(int) float64 { return clicks }
+	}
+	// A daily peak at the hour being judged, quiet otherwise
+	dailyPeak := func(hour int) float64 {
+		if (last-hour)%24 == 0 {
+			return 50
+		}
+		return 5
+	}
+
+	tests := []struct {
+		name     string
+		counts   []float64
+		kind     string // Empty for no anomaly
+		expected float64
+	}{
+		{"seasonal peak is expected", anomalyHistory(anomalyHistoryHours, dailyPeak, 50), "", 0},
+		{"seasonal spike", anomalyHistory(anomalyHistoryHours, dailyPeak, 200), models.AnomalySpike, 50},
+		{"seasonal drop", anomalyHistory(anomalyHistoryHours, steady(40), 0), models.AnomalyDrop, 40},
+		// Two days of history hold too few earlier days for a seasonal baseline
+		{"ewma steady", anomalyHistory(48, steady(10), 10), "", 0},
+		{"ewma spike", anomalyHistory(48, steady(10), 60), models.AnomalySpike, 10},
+		{"ewma drop", anomalyHistory(48, steady(40), 0), models.AnomalyDrop, 40},
+		// On the EWMA the daily peak itself stands out
+		{"ewma does not know the time of day", anomalyHistory(48, dailyPeak, 50), models.AnomalySpike, 0},
+		{"too little history", anomalyHistory(12, steady(10), 100), "", 0},
+		{"spike below min clicks", anomalyHistory(anomalyHistoryHours, steady(1), 8), "", 0},
+		{"drop below min clicks", anomalyHistory(anomalyHistoryHours, steady(4), 0), "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anomaly, ok := s.judge(tt.counts)
+			if tt.kind == "" {
+				assert.False(t, ok, "judged %+v", anomaly)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, tt.kind, anomaly.Kind)
+			assert.Equal(t, tt.counts[last], anomaly.Observed)
+			if tt.expected != 0 {
+				assert.InDelta(t, tt.expected, anomaly.Expected, 0.5)
+			}
+			if tt.kind == models.AnomalySpike {
+				assert.GreaterOrEqual(t, anomaly.Score, 3.0)
+			} else {
+				assert.LessOrEqual(t, anomaly.Score, -3.0)
+			}
+		})
+	}
+}
+
+// Hours missed since the last run are judged on the next one, each once
+func TestAnomalyDetectCatchesUp(t *testing.T) {
+	db := testDB(t)
+	adID := testAd(t, db)
+	s := NewAnomalyService(db, testLogger(), AnomalyOptions{Threshold: 3, MinClicks: 10})
+
+	end := wallClock(time.Now().Add(-anomalyAggregationLag)).Truncate(time.Hour)
+	spikes := []time.Time{end.Add(-3 * time.Hour), end.Add(-2 * time.Hour)}
+	_, err := db.Exec(`
+		INSERT INTO click_rollups_hour (bucket, ad_id, clicks)
+		SELECT h, $1, CASE WHEN h = ANY(ARRAY[$3::timestamp, $4::timestamp]) THEN 300 ELSE 20 END
+		FROM generate_series($2::timestamp - INTERVAL '8 days', $2::timestamp - INTERVAL '1 hour', INTERVAL '1 hour') h
+	`, adID, end, spikes[0], spikes[1])
+	require.NoError(t, err)
+
+	// The last run judged the hours before the first spike
+	_, err = db.Exec("INSERT INTO anomaly_checks (judged_until) VALUES ($1::timestamp)", spikes[0])
+	require.NoError(t, err)
+
+	anomalies, err := s.Detect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, anomalies, 2)
+	for i, anomaly := range anomalies {
+		assert.Equal(t, adID, anomaly.AdID)
+		assert.Equal(t, models.AnomalySpike, anomaly.Kind)
+		assert.True(t, localTime(spikes[i]).Equal(anomaly.Bucket), "bucket %s", anomaly.Bucket)
+	}
+
+	var judgedUntil time.Time
+	require.NoError(t, db.QueryRow("SELECT judged_until FROM anomaly_checks").Scan(&judgedUntil))
+	assert.True(t, end.Equal(judgedUntil))
+
+	anomalies, err = s.Detect(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, anomalies)
+}
+
+// Hours the aggregation worker has not caught up with wait for a later run
+func TestAnomalyDetectWaitsForAggregation(t *testing.T) {
+	db := testDB(t)
+	adID := testAd(t, db)
+	s := NewAnomalyService(db, testLogger(), AnomalyOptions{Threshold: 3, MinClicks: 10})
+
+	end := wallClock(time.Now().Add(-anomalyAggregationLag)).Truncate(time.Hour)
+	spike := end.Add(-time.Hour)
+	_, err := db.Exec(`
+		INSERT INTO click_rollups_hour (bucket, ad_id, clicks)
+		SELECT h, $1, CASE WHEN h = $3::timestamp THEN 300 ELSE 20 END
+		FROM generate_series($2::timestamp - INTERVAL '8 days', $2::timestamp - INTERVAL '1 hour', INTERVAL '1 hour') h
+	`, adID, end, spike)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO anomaly_checks (judged_until) VALUES ($1::timestamp)", end.Add(-3*time.Hour))
+	require.NoError(t, err)
+
+	// A click two hours back is still waiting to be folded in
+	_, err = db.Exec(`
+		INSERT INTO click_events (ad_id, timestamp, video_playback_time, consent_status, processed)
+		VALUES ($1, $2::timestamp, 0, 'consented', false)
+	`, adID, end.Add(-2*time.Hour+10*time.Minute))
+	require.NoError(t, err)
+
+	anomalies, err := s.Detect(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, anomalies)
+	var judgedUntil time.Time
+	require.NoError(t, db.QueryRow("SELECT judged_until FROM anomaly_checks").Scan(&judgedUntil))
+	assert.True(t, end.Add(-2*time.Hour).Equal(judgedUntil), "judged until %s", judgedUntil)
+
+	// Once it is folded in, the spike is judged
+	_, err = db.Exec("UPDATE click_events SET processed = true")
+	require.NoError(t, err)
+	anomalies, err = s.Detect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, anomalies, 1)
+	assert.True(t, localTime(spike).Equal(anomalies[0].Bucket), "bucket %s", anomalies[0].Bucket)
+}
@@ -3,60 +3,110 @@ package services
 import (
 	"database/sql"
 	"time"
+	"video-ad-tracker/internal/consent"
+	"video-ad-tracker/internal/geoip"
 	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/privacy"
+	"video-ad-tracker/internal/useragent"
 
 	"github.com/sirupsen/logrus"
 )
 
 type ClickService struct {
-	db     *sql.DB
-	logger *logrus.Logger
+	db         *sql.DB
+	logger     *logrus.Logger
+	adCache    *AdCache
+	anonymizer *privacy.Anonymizer
+	sessions   *SessionTracker
+	publisher  EventPublisher
+	observer   ClickObserver
+	geo        *geoip.DB
+
+	// Whether GDPR applies to requests that do not say
+	gdprAppliesByDefault bool
 }
 
 // Create new click service
-func NewClickService(db *sql.DB, logger *logrus.Logger) *ClickService {
+func NewClickService(db *sql.DB, logger *logrus.Logger, adCache *AdCache, anonymizer *privacy.Anonymizer, sessions *SessionTracker, publisher EventPublisher, observer ClickObserver, geo *geoip.DB, gdprAppliesByDefault bool) *ClickService {
 	return &ClickService{
-		db:     db,
-		logger: logger,
+		db:                   db,
+		logger:               logger,
+		adCache:              adCache,
+		anonymizer:           anonymizer,
+		sessions:             sessions,
+		publisher:            publisher,
+		observer:             observer,
+		geo:                  geo,
+		gdprAppliesByDefault: gdprAppliesByDefault,
 	}
 }
 
 // Record click event asynchronously
-func (s *ClickService) RecordClick(req models.ClickRequest, clientIP string) error {
+func (s *ClickService) RecordClick(req models.ClickRequest, meta models.ClickMetadata) (*models.ClickResult, error) {
+	// Reject unknown or inactive ads before accepting the click
+	if err := s.adCache.Validate(req.AdID); err != nil {
+		return nil, err
+	}
+
+	// Viewers are only identified when consent allows it
+	decision := consent.Evaluate(s.consentSignals(req, meta))
+	result := &models.ClickResult{ClickID: NewIdentifier()}
+	if decision.StoreIdentifiers {
+		result.ViewerID = viewerID(req, meta)
+	}
+
 	// Process click in background
-	go s.processClickAsync(req, clientIP)
+	go s.processClickAsync(req, meta, decision, *result)
 
 	// Return immediately
-	return nil
+	return result, nil
 }
 
 // Process click event asynchronously
-func (s *ClickService) processClickAsync(req models.ClickRequest, clientIP string) {
-	// Check if ad exists
-	ad, err := s.validateAd(req.AdID)
-	if err != nil {
-		s.logger.Errorf("Failed to validate ad %d: %v", req.AdID, err)
-		return
+func (s *ClickService) processClickAsync(req models.ClickRequest, meta models.ClickMetadata, decision consent.Decision, result models.ClickResult) {
+	timestamp := time.Now()
+
+	// Only keep identifiers the consent signals allow, anonymized
+	var clientIP, connectionIP, userAgent string
+	if decision.StoreIdentifiers {
+		clientIP, connectionIP, userAgent = s.anonymize(req, meta, timestamp)
 	}
-	if ad == nil {
-		s.logger.Errorf("Ad %d not found", req.AdID)
-		return
+
+	// Coarse dimensions are derived before the raw values are dropped
+	dims := s.dimensions(req, meta)
+
+	var sessionID string
+	if result.ViewerID != "" {
+		var err error
+		if sessionID, err = s.sessions.Resolve(result.ViewerID, timestamp); err != nil {
+			s.logger.Errorf("Failed to resolve session for click on ad %d: %v", req.AdID, err)
+		}
 	}
 
 	// Save click event
 	query := `
-		INSERT INTO click_events (ad_id, timestamp, ip_address, video_playback_time, user_agent, processed, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+		INSERT INTO click_events (click_uid, ad_id, timestamp, ip_address, connection_ip, video_playback_time, user_agent, consent_status, viewer_id, session_id,
+			device_type, os, browser, country, processed, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, ''), $11, $12, $13, $14, $15, NOW(), NOW())
 		RETURNING id
 	`
 
 	var clickID int
-	err = s.db.QueryRow(query,
+	err := s.db.QueryRow(query,
+		result.ClickID,
 		req.AdID,
-		time.Now(),
+		timestamp,
 		clientIP,
+		connectionIP,
 		req.VideoPlaybackTime,
-		req.UserAgent,
+		userAgent,
+		decision.Status,
+		result.ViewerID,
+		sessionID,
+		dims.deviceType,
+		dims.os,
+		dims.browser,
+		dims.country,
 		false, // Processed by analytics service
 	).Scan(&clickID)
 
@@ -66,20 +116,61 @@ func (s *ClickService) processClickAsync(req models.ClickRequest, clientIP strin
 	}
 
 	s.logger.Infof("Click event recorded for ad %d", req.AdID)
+
+	s.observer.ObserveClick(req.AdID, timestamp, req.VideoPlaybackTime)
+
+	s.publisher.Publish(models.EventClickRecorded, struct {
+		ClickID           string    `json:"click_id"`
+		AdID              int       `json:"ad_id"`
+		Timestamp         time.Time `json:"timestamp"`
+		VideoPlaybackTime float64   `json:"video_playback_time"`
+		ViewerID          string    `json:"viewer_id,omitempty"`
+		SessionID         string    `json:"session_id,omitempty"`
+	}{result.ClickID, req.AdID, timestamp, req.VideoPlaybackTime, result.ViewerID, sessionID})
 }
 
-// Validate ad exists
-func (s *ClickService) validateAd(adID int) (*models.Ad, error) {
-	query := "SELECT id FROM ads WHERE id = $1"
-	var id int
-	err := s.db.QueryRow(query, adID).Scan(&id)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
+// Pick the viewer ID of a click, issuing a new one for unknown viewers
+func viewerID(req models.ClickRequest, meta models.ClickMetadata) string {
+	if req.DeviceID != "" {
+		return req.DeviceID
 	}
-	return &models.Ad{ID: id}, nil
+	if meta.ViewerCookie != "" {
+		return meta.ViewerCookie
+	}
+	return NewIdentifier()
+}
+
+// Collect the consent signals of a click
+func (s *ClickService) consentSignals(req models.ClickRequest, meta models.ClickMetadata) consent.Signals {
+	gdprApplies := s.gdprAppliesByDefault || req.ConsentString != ""
+	if req.GDPR != nil {
+		gdprApplies = *req.GDPR == 1
+	}
+
+	return consent.Signals{
+		GDPRApplies:          gdprApplies,
+		ConsentString:        req.ConsentString,
+		GlobalPrivacyControl: meta.GPC,
+		DoNotTrack:           meta.DoNotTrack,
+	}
+}
+
+// Anonymize personal fields, dropping any value that cannot be anonymized
+func (s *ClickService) anonymize(req models.ClickRequest, meta models.ClickMetadata, at time.Time) (clientIP, connectionIP, userAgent string) {
+	var err error
+	if clientIP, err = s.anonymizer.IP(meta.ClientIP, at); err != nil {
+		s.logger.Errorf("Failed to anonymize client IP, dropping it: %v", err)
+		clientIP = ""
+	}
+	if connectionIP, err = s.anonymizer.IP(meta.ConnectionIP, at); err != nil {
+		s.logger.Errorf("Failed to anonymize connection IP, dropping it: %v", err)
+		connectionIP = ""
+	}
+	if userAgent, err = s.anonymizer.UserAgent(req.UserAgent, at); err != nil {
+		s.logger.Errorf("Failed to anonymize user agent, dropping it: %v", err)
+		userAgent = ""
+	}
+	return clientIP, connectionIP, userAgent
 }
 
 // Get unprocessed click events
@@ -124,3 +215,20 @@ func (s *ClickService) MarkClickProcessed(clickID int) error {
 	_, err := s.db.Exec(query, clickID)
 	return err
 }
+
+// Get the device, OS, browser and country of a click. The user agent in the
+// body wins over the request's own header.
+func (s *ClickService) dimensions(req models.ClickRequest, meta models.ClickMetadata) clickDimensions {
+	ua := req.UserAgent
+	if ua == "" {
+		ua = meta.UserAgent
+	}
+	info := useragent.Parse(ua)
+
+	return clickDimensions{
+		deviceType: info.DeviceType,
+		os:         info.OS,
+		browser:    info.Browser,
+		country:    s.geo.Country(meta.ClientIP),
+	}
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"database/sql"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+type ConversionService struct {
+	db        *sql.DB
+	logger    *logrus.Logger
+	publisher EventPublisher
+	lookback  time.Duration
+}
+
+// Create new conversion service
+func NewConversionService(db *sql.DB, logger *logrus.Logger, publisher EventPublisher, lookback time.Duration) *ConversionService {
+	return &ConversionService{
+		db:        db,
+		logger:    logger,
+		publisher: publisher,
+		lookback:  lookback,
+	}
+}
+
+// Record a conversion, attributing it to the originating click when one is
+// found within the lookback window
+func (s *ConversionService) RecordConversion(req models.ConversionRequest) (*models.Conversion, error) {
+	// Repeated postbacks return the conversion recorded the first time
+	if req.ConversionID != "" {
+		existing, err := s.getByConversionID(req.ConversionID)
+		if err != nil || existing != nil {
+			return existing, err
+		}
+	}
+
+	conversion := models.Conversion{
+		ConversionID: req.ConversionID,
+		ViewerID:     req.ViewerID,
+		Value:        req.Value,
+		ConvertedAt:  time.Now(),
+	}
+
+	clickEventID, err := s.attribute(req, &conversion)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO conversions (conversion_id, click_event_id, ad_id, viewer_id, value, attributed, converted_at)
+		VALUES (NULLIF($1, ''), $2, $3, NULLIF($4, ''), $5, $6, $7)
+		ON CONFLICT (conversion_id) DO NOTHING
+		RETURNING id
+	`
+
+	err = s.db.QueryRow(query,
+		conversion.ConversionID,
+		clickEventID,
+		nullableInt(conversion.AdID),
+		conversion.ViewerID,
+		conversion.Value,
+		conversion.Attributed,
+		conversion.ConvertedAt,
+	).Scan(&conversion.ID)
+
+	// A concurrent postback with the same ID won the insert
+	if err == sql.ErrNoRows {
+		return s.getByConversionID(req.ConversionID)
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to insert conversion: %v", err)
+		return nil, err
+	}
+
+	s.publisher.Publish(models.EventConversionRecorded, conversion)
+
+	return &conversion, nil
+}
+
+// Find the click a conversion belongs to. A click ID is matched exactly,
+// a viewer ID is attributed to the viewer's last click.
+func (s *ConversionService) attribute(req models.ConversionRequest, conversion *models.Conversion) (sql.NullInt64, error) {
+	since := conversion.ConvertedAt.Add(-s.lookback)
+
+	var query string
+	var key string
+	if req.ClickID != "" {
+		query = `
+			SELECT id, COALESCE(click_uid, ''), ad_id, COALESCE(viewer_id, '')
+			FROM click_events
+			WHERE click_uid = $1 AND timestamp >= $2::timestamp
+		`
+		key = req.ClickID
+	} else {
+		query = `
+			SELECT id, COALESCE(click_uid, ''), ad_id, COALESCE(viewer_id, '')
+			FROM click_events
+			WHERE viewer_id = $1 AND timestamp >= $2::timestamp
+			ORDER BY timestamp DESC, id DESC
+			LIMIT 1
+		`
+		key = req.ViewerID
+	}
+
+	var clickEventID sql.NullInt64
+	var viewerID string
+	err := s.db.QueryRow(query, key, since).Scan(&clickEventID, &conversion.ClickID, &conversion.AdID, &viewerID)
+	if err == sql.ErrNoRows {
+		return sql.NullInt64{}, nil
+	}
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+
+	conversion.Attributed = true
+	if conversion.ViewerID == "" {
+		conversion.ViewerID = viewerID
+	}
+	return clickEventID, nil
+}
+
+// Get a conversion by the advertiser's conversion ID
+func (s *ConversionService) getByConversionID(conversionID string) (*models.Conversion, error) {
+	query := `
+		SELECT c.id, COALESCE(c.conversion_id, ''), COALESCE(ce.click_uid, ''), COALESCE(c.ad_id, 0),
+			COALESCE(c.viewer_id, ''), c.value, c.attributed, c.converted_at
+		FROM conversions c
+		LEFT JOIN click_events ce ON ce.id = c.click_event_id
+		WHERE c.conversion_id = $1
+	`
+
+	var conversion models.Conversion
+	err := s.db.QueryRow(query, conversionID).Scan(
+		&conversion.ID,
+		&conversion.ConversionID,
+		&conversion.ClickID,
+		&conversion.AdID,
+		&conversion.ViewerID,
+		&conversion.Value,
+		&conversion.Attributed,
+		&conversion.ConvertedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &conversion, nil
+}
+
+func nullableInt(value int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(value), Valid: value != 0}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"fmt"
+	"video-ad-tracker/internal/models"
+
+	"github.com/lib/pq"
+)
+
+// Dimension columns stored with click events and rollups, in key order
+const dimensionColumns = "device_type, os, browser, country"
+
+// Dimensions a click is broken down by
+type clickDimensions struct {
+	deviceType string
+	os         string
+	browser    string
+	country    string
+}
+
+func (d clickDimensions) less(other clickDimensions) bool {
+	if d.deviceType != other.deviceType {
+		return d.deviceType < other.deviceType
+	}
+	if d.os != other.os {
+		return d.os < other.os
+	}
+	if d.browser != other.browser {
+		return d.browser < other.browser
+	}
+	return d.country < other.country
+}
+
+// Dimensions to group analytics by and values to filter them on. Only
+// names from models.AnalyticsDimensions are kept, since they end up in SQL.
+type dimensionSelection struct {
+	groupBy []string
+	filters map[string][]string
+}
+
+func newDimensionSelection(groupBy []string, filters map[string][]string) dimensionSelection {
+	known := map[string]bool{}
+	for _, dimension := range models.AnalyticsDimensions {
+		known[dimension] = true
+	}
+
+	sel := dimensionSelection{filters: map[string][]string{}}
+	for _, dimension := range groupBy {
+		if known[dimension] {
+			sel.groupBy = append(sel.groupBy, dimension)
+		}
+	}
+	for dimension, values := range filters {
+		if known[dimension] && len(values) > 0 {
+			sel.filters[dimension] = values
+		}
+	}
+	return sel
+}
+
+// Whether rows are broken down by any dimension
+func (d dimensionSelection) grouped() bool {
+	return len(d.groupBy) > 0
+}
+
+// List the grouped columns, each prefixed with a comma and the table alias
+func (d dimensionSelection) columns(alias string) string {
+	var columns string
+	for _, dimension := range d.groupBy {
+		columns += ", " + qualify(alias, dimension)
+	}
+	return columns
+}
+
+// Build AND conditions for the filters, appending their arguments to args
+func (d dimensionSelection) filter(alias string, args *[]interface{}) string {
+	var conditions string
+	for _, dimension := range models.AnalyticsDimensions {
+		values, ok := d.filters[dimension]
+		if !ok {
+			continue
+		}
+		*args = append(*args, pq.Array(values))
+		conditions += fmt.Sprintf(" AND %s = ANY($%d::text[])", qualify(alias, dimension), len(*args))
+	}
+	return conditions
+}
+
+// Build AND conditions joining the grouped columns of two aliases
+func (d dimensionSelection) join(left, right string) string {
+	var conditions string
+	for _, dimension := range d.groupBy {
+		conditions += fmt.Sprintf(" AND %s = %s", qualify(left, dimension), qualify(right, dimension))
+	}
+	return conditions
+}
+
+func qualify(alias, column string) string {
+	if alias == "" {
+		return column
+	}
+	return alias + "." + column
+}
@@ -0,0 +1,328 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"video-ad-tracker/internal/export"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/timeseries"
+)
+
+// Rows fetched from the export cursor per round trip
+const exportFetchSize = 1000
+
+// Write an analytics query as CSV, NDJSON or XLSX. Without a granularity
+// there is a row per ad, or per ad and group_by values, with the same
+// metrics as GetAnalytics; with one there is a row per series point,
+// streamed from the database. NDJSON and XLSX carry the metadata in the
+// file, CSV only has the header and rows.
+func (s *AnalyticsService) Export(ctx context.Context, out io.Writer, format string, query models.AnalyticsQuery, metadata []export.Field) error {
+	columns := []string{"ad_id"}
+	columns = append(columns, query.GroupBy...)
+
+	if query.Granularity != "" {
+		columns = append(columns, "bucket", "total_clicks", "consented_clicks", "avg_playback_time")
+		w, err := export.New(format, out, columns, metadata)
+		if err != nil {
+			return err
+		}
+		err = s.streamSeries(ctx, query, func(row models.AnalyticsSeriesRow) error {
+			record := []interface{}{row.AdID}
+			for _, dimension := range query.GroupBy {
+				record = append(record, row.Dimensions[dimension])
+			}
+			record = append(record, row.Point.Bucket, row.Point.TotalClicks, row.Point.ConsentedClicks, row.Point.AvgPlaybackTime)
+			return w.Write(record)
+		})
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	// One row per ad or group, however long the window, so this is small
+	// enough to read in one go
+	analytics, err := s.GetAnalytics(query)
+	if err != nil {
+		return err
+	}
+
+	columns = append(columns, "total_clicks", "unique_ips", "consented_clicks", "non_consented_clicks",
+		"not_applicable_clicks", "unique_viewers", "unique_clickers", "clicks_per_session", "conversions", "conversion_rate",
+		"revenue", "ctr", "avg_playback_time")
+	w, err := export.New(format, out, columns, metadata)
+	if err != nil {
+		return err
+	}
+	for _, a := range analytics {
+		record := []interface{}{a.AdID}
+		for _, dimension := range query.GroupBy {
+			record = append(record, a.Dimensions[dimension])
+		}
+		record = append(record, a.TotalClicks, a.UniqueIPs, a.ConsentedClicks, a.NonConsentedClicks,
+			a.NotApplicableClicks, a.UniqueViewers, a.UniqueClickers, a.ClicksPerSession, a.Conversions, a.ConversionRate,
+			a.Revenue, a.CTR, a.AvgPlaybackTime)
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Describe the export of a query: the report type, window, time zone,
+// granularity, group_by, filter, the summary metrics only covering part of
+// the window and when it was generated
+func (s *AnalyticsService) ExportMetadata(query models.AnalyticsQuery, generatedAt time.Time) []export.Field {
+	location := query.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	report := "summary"
+	partial := s.partialMetrics(query.From)
+	if query.Granularity != "" {
+		report = "series"
+		partial = nil
+	}
+	return []export.Field{
+		{Key: "report", Value: report},
+		{Key: "time_frame", Value: query.TimeFrame},
+		{Key: "from", Value: query.From.In(location).Format(time.RFC3339)},
+		{Key: "to", Value: query.To.In(location).Format(time.RFC3339)},
+		{Key: "time_zone", Value: location.String()},
+		{Key: "granularity", Value: query.Granularity},
+		{Key: "group_by", Value: strings.Join(query.GroupBy, ",")},
+		{Key: "filter", Value: exportFilters(query.Filters)},
+		{Key: "partial_metrics", Value: strings.Join(partial, ",")},
+		{Key: "generated_at", Value: generatedAt.In(location).Format(time.RFC3339)},
+	}
+}
+
+// Write filters the way the filter parameter takes them, in dimension order
+func exportFilters(filters map[string][]string) string {
+	var pairs []string
+	for _, dimension := range models.AnalyticsDimensions {
+		for _, value := range filters[dimension] {
+			pairs = append(pairs, dimension+":"+value)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Stream the series of an analytics query point by point, ordered by ad,
+// group_by dimension values and bucket. Rows are read through a cursor and
+// folded into series buckets as they arrive, so however long the window is
+// only one bucket is held in memory. Without group_by every ad gets a
+// series, with it every combination that has clicks.
+func (s *AnalyticsService) streamSeries(ctx context.Context, query models.AnalyticsQuery, emit func(models.AnalyticsSeriesRow) error) error {
+	location := query.Location
+	if location == nil {
+		location = time.UTC
+	}
+	sel := newDimensionSelection(query.GroupBy, query.Filters)
+
+	buckets, seriesSQL, args, err := s.seriesQuery(query.Granularity, location, query.From.In(time.Local), query.To.In(time.Local), sel)
+	if err != nil || len(buckets) == 0 {
+		return err
+	}
+
+	var cursorQuery string
+	if sel.grouped() {
+		cursorQuery = `SELECT * FROM (` + seriesSQL + `) s
+			ORDER BY s.ad_id` + sel.columns("s") + `, s.source_bucket`
+	} else {
+		// Ads without clicks come back once with a NULL bucket
+		cursorQuery = `SELECT a.id, s.source_bucket, s.clicks, s.consented_clicks, s.playback_sum, s.playback_count
+			FROM ads a
+			LEFT JOIN (` + seriesSQL + `) s ON s.ad_id = a.id
+			ORDER BY a.id, s.source_bucket`
+	}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DECLARE analytics_export NO SCROLL CURSOR FOR `+cursorQuery, args...); err != nil {
+		s.logger.Errorf("Failed to open analytics export cursor: %v", err)
+		return err
+	}
+
+	index := make(map[int64]int, len(buckets))
+	for i, bucket := range buckets {
+		index[bucket.Unix()] = i
+	}
+	folder := &seriesFolder{buckets: buckets, groupBy: sel.groupBy, emit: emit, current: -1}
+
+	fetch := fmt.Sprintf(`FETCH %d FROM analytics_export`, exportFetchSize)
+	for {
+		fetched, err := s.fetchSeries(ctx, tx, fetch, len(sel.groupBy), func(adID int, dimensionValues []string, bucket sql.NullTime, c seriesCounters) error {
+			if err := folder.start(adID, dimensionValues); err != nil {
+				return err
+			}
+			if !bucket.Valid {
+				return nil
+			}
+			seriesBucket := timeseries.Truncate(query.Granularity, localTime(bucket.Time).In(location))
+			i, ok := index[seriesBucket.Unix()]
+			if !ok {
+				return nil
+			}
+			return folder.add(i, c)
+		})
+		if err != nil {
+			return err
+		}
+		if fetched < exportFetchSize {
+			break
+		}
+	}
+
+	return folder.finish()
+}
+
+// Counters of a rollup bucket, or of a series bucket while being folded
+type seriesCounters struct {
+	clicks, consented, playbackCount int
+	playbackSum                      float64
+}
+
+// Read one batch from the cursor, returning how many rows it held
+func (s *AnalyticsService) fetchSeries(ctx context.Context, tx *sql.Tx, fetch string, dimensionCount int, row func(int, []string, sql.NullTime, seriesCounters) error) (int, error) {
+	rows, err := tx.QueryContext(ctx, fetch)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	fetched := 0
+	for rows.Next() {
+		var adID int
+		var bucket sql.NullTime
+		var clicks, consented, playbackCount sql.NullInt64
+		var playbackSum sql.NullFloat64
+		dimensionValues := make([]string, dimensionCount)
+		targets := []interface{}{&adID}
+		for i := range dimensionValues {
+			targets = append(targets, &dimensionValues[i])
+		}
+		targets = append(targets, &bucket, &clicks, &consented, &playbackSum, &playbackCount)
+		if err := rows.Scan(targets...); err != nil {
+			return fetched, err
+		}
+		fetched++
+
+		c := seriesCounters{
+			clicks:        int(clicks.Int64),
+			consented:     int(consented.Int64),
+			playbackCount: int(playbackCount.Int64),
+			playbackSum:   playbackSum.Float64,
+		}
+		if err := row(adID, dimensionValues, bucket, c); err != nil {
+			return fetched, err
+		}
+	}
+	return fetched, rows.Err()
+}
+
+// seriesFolder turns rollup rows ordered by series and bucket into series
+// points, filling the buckets without clicks with zero points
+type seriesFolder struct {
+	buckets []time.Time
+	groupBy []string
+	emit    func(models.AnalyticsSeriesRow) error
+
+	started         bool
+	adID            int
+	dimensionValues []string
+	current         int // Index of the bucket being folded, -1 before the first
+	counters        seriesCounters
+}
+
+// Move on to the series of an ad and dimension values, finishing the
+// previous one when it differs
+func (f *seriesFolder) start(adID int, dimensionValues []string) error {
+	if f.started && adID == f.adID && equalStrings(dimensionValues, f.dimensionValues) {
+		return nil
+	}
+	if err := f.finish(); err != nil {
+		return err
+	}
+	f.started = true
+	f.adID = adID
+	f.dimensionValues = dimensionValues
+	f.current = -1
+	f.counters = seriesCounters{}
+	return nil
+}
+
+// Add a rollup bucket to series bucket i. Rows arrive in bucket order, so
+// moving past a bucket means it is complete.
+func (f *seriesFolder) add(i int, c seriesCounters) error {
+	if i > f.current {
+		if err := f.emitThrough(i - 1); err != nil {
+			return err
+		}
+		f.current = i
+	}
+	f.counters.clicks += c.clicks
+	f.counters.consented += c.consented
+	f.counters.playbackCount += c.playbackCount
+	f.counters.playbackSum += c.playbackSum
+	return nil
+}
+
+// Emit the rest of the current series
+func (f *seriesFolder) finish() error {
+	if !f.started {
+		return nil
+	}
+	return f.emitThrough(len(f.buckets) - 1)
+}
+
+// Emit the bucket being folded, then zero points up to bucket last
+func (f *seriesFolder) emitThrough(last int) error {
+	for f.current <= last {
+		if f.current >= 0 {
+			point := models.AnalyticsPoint{
+				Bucket:          f.buckets[f.current],
+				TotalClicks:     f.counters.clicks,
+				ConsentedClicks: f.counters.consented,
+			}
+			if f.counters.playbackCount > 0 {
+				point.AvgPlaybackTime = f.counters.playbackSum / float64(f.counters.playbackCount)
+			}
+
+			row := models.AnalyticsSeriesRow{AdID: f.adID, Point: point}
+			if len(f.groupBy) > 0 {
+				row.Dimensions = make(map[string]string, len(f.groupBy))
+				for i, dimension := range f.groupBy {
+					row.Dimensions[dimension] = f.dimensionValues[i]
+				}
+			}
+			if err := f.emit(row); err != nil {
+				return err
+			}
+		}
+		f.current++
+		f.counters = seriesCounters{}
+	}
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
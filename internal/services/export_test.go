@@ -0,0 +1,140 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Folded series as ad, dimensions and one point per bucket
+type foldedSeries struct {
+	adID       int
+	dimensions map[string]string
+	points     []models.AnalyticsPoint
+}
+
+func collectSeries(rows []models.AnalyticsSeriesRow) []foldedSeries {
+	var series []foldedSeries
+	for _, row := range rows {
+		if n := len(series); n == 0 || series[n-1].adID != row.AdID || !equalDimensions(series[n-1].dimensions, row.Dimensions) {
+			series = append(series, foldedSeries{adID: row.AdID, dimensions: row.Dimensions})
+		}
+		series[len(series)-1].points = append(series[len(series)-1].points, row.Point)
+	}
+	return series
+}
+
+func equalDimensions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSeriesFolderFillsGaps(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	buckets := []time.Time{day, day.AddDate(0, 0, 1), day.AddDate(0, 0, 2), day.AddDate(0, 0, 3)}
+
+	var rows []models.AnalyticsSeriesRow
+	f := &seriesFolder{buckets: buckets, current: -1, emit: func(row models.AnalyticsSeriesRow) error {
+		rows = append(rows, row)
+		return nil
+	}}
+
+	// Ad 1 has clicks on the second and last day, two rollup rows fold
+	// into the second
+	require.NoError(t, f.start(1, nil))
+	require.NoError(t, f.add(1, seriesCounters{clicks: 3, consented: 1, playbackSum: 30, playbackCount: 3}))
+	require.NoError(t, f.add(1, seriesCounters{clicks: 1, consented: 1, playbackSum: 10, playbackCount: 1}))
+	require.NoError(t, f.add(3, seriesCounters{clicks: 2, playbackCount: 0}))
+	// Ad 2 has no clicks at all
+	require.NoError(t, f.start(2, nil))
+	// Ad 3 only on the first day
+	require.NoError(t, f.start(3, nil))
+	require.NoError(t, f.add(0, seriesCounters{clicks: 5, consented: 5, playbackSum: 5, playbackCount: 5}))
+	require.NoError(t, f.finish())
+
+	series := collectSeries(rows)
+	require.Len(t, series, 3)
+	for _, s := range series {
+		require.Len(t, s.points, len(buckets), "ad %d", s.adID)
+		for i, p := range s.points {
+			assert.Equal(t, buckets[i], p.Bucket)
+		}
+	}
+
+	assert.Equal(t, 1, series[0].adID)
+	assert.Equal(t, []int{0, 4, 0, 2}, clicksOf(series[0].points))
+	assert.Equal(t, 2, series[0].points[1].ConsentedClicks)
+	assert.Equal(t, 10.0, series[0].points[1].AvgPlaybackTime)
+	assert.Zero(t, series[0].points[3].AvgPlaybackTime)
+
+	assert.Equal(t, 2, series[1].adID)
+	assert.Equal(t, []int{0, 0, 0, 0}, clicksOf(series[1].points))
+
+	assert.Equal(t, 3, series[2].adID)
+	assert.Equal(t, []int{5, 0, 0, 0}, clicksOf(series[2].points))
+}
+
+func TestSeriesFolderGroupsByDimensions(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	buckets := []time.Time{day, day.AddDate(0, 0, 1)}
+
+	var rows []models.AnalyticsSeriesRow
+	f := &seriesFolder{buckets: buckets, groupBy: []string{"country", "os"}, current: -1, emit: func(row models.AnalyticsSeriesRow) error {
+		rows = append(rows, row)
+		return nil
+	}}
+
+	require.NoError(t, f.start(1, []string{"DE", "ios"}))
+	require.NoError(t, f.add(1, seriesCounters{clicks: 2}))
+	// Same ad, other values: a new series
+	require.NoError(t, f.start(1, []string{"FR", "ios"}))
+	require.NoError(t, f.add(0, seriesCounters{clicks: 7}))
+	require.NoError(t, f.finish())
+
+	series := collectSeries(rows)
+	require.Len(t, series, 2)
+	assert.Equal(t, map[string]string{"country": "DE", "os": "ios"}, series[0].dimensions)
+	assert.Equal(t, []int{0, 2}, clicksOf(series[0].points))
+	assert.Equal(t, map[string]string{"country": "FR", "os": "ios"}, series[1].dimensions)
+	assert.Equal(t, []int{7, 0}, clicksOf(series[1].points))
+}
+
+func TestSeriesFolderStopsOnEmitError(t *testing.T) {
+	failed := errors.New("client went away")
+	emitted := 0
+	f := &seriesFolder{buckets: make([]time.Time, 3), current: -1, emit: func(models.AnalyticsSeriesRow) error {
+		emitted++
+		return failed
+	}}
+
+	require.NoError(t, f.start(1, nil))
+	assert.ErrorIs(t, f.finish(), failed)
+	assert.Equal(t, 1, emitted)
+}
+
+func TestSeriesFolderWithoutSeries(t *testing.T) {
+	f := &seriesFolder{buckets: make([]time.Time, 3), current: -1, emit: func(models.AnalyticsSeriesRow) error {
+		t.Fatal("nothing to emit")
+		return nil
+	}}
+	assert.NoError(t, f.finish())
+}
+
+func clicksOf(points []models.AnalyticsPoint) []int {
+	clicks := make([]int, len(points))
+	for i, p := range points {
+		clicks[i] = p.TotalClicks
+	}
+	return clicks
+}
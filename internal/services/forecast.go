@@ -0,0 +1,99 @@
+package services
+
+import (
+	"database/sql"
+	"time"
+	"video-ad-tracker/internal/forecast"
+	"video-ad-tracker/internal/models"
+
+	"github.com/lib/pq"
+)
+
+// Traffic repeats weekly, so the season spans seven daily buckets
+const forecastSeason = 7
+
+// Project the daily clicks of the queried ads from today on, fitted to the
+// complete days of the daily rollups. An ad's history starts at its first
+// day with clicks, so new ads fall back to simpler methods until they have
+// two weeks.
+func (s *AnalyticsService) GetForecast(query models.ForecastQuery) ([]models.Forecast, error) {
+	// Day buckets are wall-clock values, so the arithmetic stays in that domain
+	today := rollupBucket(rollupDayTable, wallClock(time.Now()))
+	start := today.AddDate(0, 0, -query.History)
+
+	sqlQuery := `
+		SELECT a.id, r.bucket, r.clicks
+		FROM ads a
+		LEFT JOIN (
+			SELECT ad_id, bucket, SUM(clicks) as clicks
+			FROM ` + rollupDayTable + `
+			WHERE bucket >= $1::timestamp AND bucket < $2::timestamp
+			GROUP BY ad_id, bucket
+		) r ON r.ad_id = a.id
+		WHERE a.id = ANY($3::int[])
+		ORDER BY a.id ASC
+	`
+
+	rows, err := s.db.Query(sqlQuery, start, today, pq.Array(query.AdIDs))
+	if err != nil {
+		s.logger.Errorf("Failed to query forecast history: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var adIDs []int
+	series := map[int][]float64{}
+	for rows.Next() {
+		var adID int
+		var bucket sql.NullTime
+		var clicks sql.NullFloat64
+		if err := rows.Scan(&adID, &bucket, &clicks); err != nil {
+			s.logger.Errorf("Failed to scan forecast history: %v", err)
+			return nil, err
+		}
+
+		if _, ok := series[adID]; !ok {
+			adIDs = append(adIDs, adID)
+			series[adID] = make([]float64, query.History)
+		}
+		if !bucket.Valid {
+			continue
+		}
+		// Daylight saving time cannot shift wall-clock days, so every day is 24 hours
+		if i := int(bucket.Time.Sub(start) / (24 * time.Hour)); i >= 0 && i < query.History {
+			series[adID][i] += clicks.Float64
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	z := forecast.Quantiles[query.Interval]
+	forecasts := []models.Forecast{}
+	for _, adID := range adIDs {
+		history := series[adID]
+		for len(history) > 0 && history[0] == 0 {
+			history = history[1:]
+		}
+
+		result := forecast.Forecast(history, forecastSeason, query.Days, z)
+		f := models.Forecast{
+			AdID:        adID,
+			Method:      result.Method,
+			HistoryDays: len(history),
+			Interval:    query.Interval,
+			Points:      make([]models.ForecastPoint, len(result.Points)),
+		}
+		for i, p := range result.Points {
+			f.Points[i] = models.ForecastPoint{
+				Date:   localTime(today.AddDate(0, 0, i)),
+				Clicks: p.Value,
+				Lower:  p.Lower,
+				Upper:  p.Upper,
+			}
+		}
+		forecasts = append(forecasts, f)
+	}
+
+	return forecasts, nil
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"fmt"
+	"time"
+	"video-ad-tracker/internal/models"
+)
+
+// Earlier windows averaged into an ad's baseline when ranking trends
+const trendingBaselineWindows = 7
+
+// Rank ads over a window. Both modes read only the rollup rows of the
+// window, so ads without clicks in it cost nothing.
+func (s *AnalyticsService) GetLeaderboard(query models.LeaderboardQuery) (*models.Leaderboard, error) {
+	from := query.From.In(time.Local)
+	to := query.To.In(time.Local)
+
+	var args []interface{}
+	currentQuery := rollupTotalsQuery(from, to, dimensionSelection{}, &args)
+
+	var sqlQuery string
+	if query.Mode == models.LeaderboardTrending {
+		// The baseline ends where the current window's first minute starts
+		window := to.Sub(from)
+		baselineQuery := rollupTotalsQuery(from.Add(-window*trendingBaselineWindows), from.Add(-time.Minute), dimensionSelection{}, &args)
+		args = append(args, query.Limit)
+
+		// Rank by how far clicks are above the baseline, in units of the
+		// Poisson noise expected at that baseline
+		sqlQuery = fmt.Sprintf(`
+			SELECT c.ad_id, a.title, c.clicks,
+				COALESCE(c.playback_sum / NULLIF(c.playback_count, 0), 0.0) as avg_playback_time,
+				COALESCE(b.clicks, 0) / %[1]d.0 as baseline_clicks
+			FROM (`+currentQuery+`
+			) c
+			JOIN ads a ON a.id = c.ad_id
+			LEFT JOIN (`+baselineQuery+`
+			) b ON b.ad_id = c.ad_id
+			WHERE c.clicks > COALESCE(b.clicks, 0) / %[1]d.0
+			ORDER BY (c.clicks - COALESCE(b.clicks, 0) / %[1]d.0) / SQRT(COALESCE(b.clicks, 0) / %[1]d.0 + 1) DESC, c.ad_id ASC
+			LIMIT $%[2]d
+		`, trendingBaselineWindows, len(args))
+	} else {
+		// CTR assumes the same impressions for every ad, so it ranks like clicks
+		order := "t.clicks DESC"
+		if query.Metric == models.MetricPlayback {
+			order = "avg_playback_time DESC, t.clicks DESC"
+		}
+		args = append(args, query.Limit)
+
+		sqlQuery = fmt.Sprintf(`
+			SELECT t.ad_id, a.title, t.clicks,
+				COALESCE(t.playback_sum / NULLIF(t.playback_count, 0), 0.0) as avg_playback_time,
+				0.0 as baseline_clicks
+			FROM (`+currentQuery+`
+			) t
+			JOIN ads a ON a.id = t.ad_id
+			WHERE t.clicks > 0
+			ORDER BY %s, t.ad_id ASC
+			LIMIT $%d
+		`, order, len(args))
+	}
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		s.logger.Errorf("Failed to query leaderboard: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	leaderboard := &models.Leaderboard{
+		Mode:   query.Mode,
+		Metric: query.Metric,
+		Window: query.Window,
+		From:   query.From,
+		To:     query.To,
+		Ads:    []models.TopAd{},
+	}
+	for rows.Next() {
+		var ad models.TopAd
+		if err := rows.Scan(&ad.AdID, &ad.Title, &ad.TotalClicks, &ad.AvgPlaybackTime, &ad.BaselineClicks); err != nil {
+			s.logger.Errorf("Failed to scan leaderboard: %v", err)
+			return nil, err
+		}
+
+		ad.Rank = len(leaderboard.Ads) + 1
+		ad.CTR = clickThroughRate(ad.TotalClicks)
+		switch query.Metric {
+		case models.MetricCTR:
+			ad.Value = ad.CTR
+		case models.MetricPlayback:
+			ad.Value = ad.AvgPlaybackTime
+		default:
+			ad.Value = float64(ad.TotalClicks)
+		}
+		if ad.BaselineClicks > 0 {
+			ad.Growth = (float64(ad.TotalClicks) - ad.BaselineClicks) / ad.BaselineClicks * 100
+		}
+
+		leaderboard.Ads = append(leaderboard.Ads, ad)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return leaderboard, nil
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"video-ad-tracker/internal/models"
+)
+
+// ClickObserver is told about every click as it is stored
+type ClickObserver interface {
+	ObserveClick(adID int, at time.Time, playbackTime float64)
+}
+
+// Clicks of one ad in one second of the rolling window
+type liveSlot struct {
+	second      int64
+	clicks      int
+	playbackSum float64
+}
+
+// Counters of one ad since startup, plus a ring of per-second slots
+type liveCounters struct {
+	total int
+	slots []liveSlot
+}
+
+// LiveAggregator keeps per ad click counters in memory for live dashboards.
+// It only sees clicks stored by this instance.
+type LiveAggregator struct {
+	mu      sync.Mutex
+	window  time.Duration
+	started time.Time
+	ads     map[int]*liveCounters
+}
+
+// Create new live aggregator over a rolling window
+func NewLiveAggregator(window time.Duration) *LiveAggregator {
+	if window < time.Second {
+		window = 5 * time.Minute
+	}
+	return &LiveAggregator{
+		window:  window,
+		started: time.Now(),
+		ads:     map[int]*liveCounters{},
+	}
+}
+
+// Count a stored click
+func (a *LiveAggregator) ObserveClick(adID int, at time.Time, playbackTime float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	counters, ok := a.ads[adID]
+	if !ok {
+		counters = &liveCounters{slots: make([]liveSlot, int(a.window/time.Second))}
+		a.ads[adID] = counters
+	}
+	counters.total++
+
+	second := at.Unix()
+	slot := &counters.slots[second%int64(len(counters.slots))]
+	if slot.second != second {
+		*slot = liveSlot{second: second}
+	}
+	slot.clicks++
+	slot.playbackSum += playbackTime
+}
+
+// Get the counters of the given ads, or of every ad seen when none are given
+func (a *LiveAggregator) Snapshot(adIDs []int) models.LiveAnalytics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if len(adIDs) == 0 {
+		for adID := range a.ads {
+			adIDs = append(adIDs, adID)
+		}
+		sort.Ints(adIDs)
+	}
+
+	snapshot := models.LiveAnalytics{
+		Timestamp:     now,
+		WindowSeconds: int(a.window / time.Second),
+		Since:         a.started,
+		Ads:           make([]models.LiveAdStats, 0, len(adIDs)),
+	}
+	oldest := now.Add(-a.window).Unix()
+	for _, adID := range adIDs {
+		stats := models.LiveAdStats{AdID: adID}
+		if counters, ok := a.ads[adID]; ok {
+			stats.TotalClicks = counters.total
+			var playbackSum float64
+			for _, slot := range counters.slots {
+				if slot.second > oldest && slot.second <= now.Unix() {
+					stats.WindowClicks += slot.clicks
+					playbackSum += slot.playbackSum
+				}
+			}
+			if stats.WindowClicks > 0 {
+				stats.AvgPlaybackTime = playbackSum / float64(stats.WindowClicks)
+			}
+		}
+		stats.ClicksPerMinute = float64(stats.WindowClicks) / a.window.Minutes()
+		stats.CTR = clickThroughRate(stats.WindowClicks)
+		snapshot.Ads = append(snapshot.Ads, stats)
+	}
+	return snapshot
+}
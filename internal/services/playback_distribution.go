@@ -0,0 +1,131 @@
+package services
+
+import (
+	"fmt"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/lib/pq"
+)
+
+// Lower bounds, in seconds, of the playback time histogram buckets
+var playbackHistogramBounds = []float64{0, 5, 10, 15, 30, 60, 120, 300, 600}
+
+// Get the spread of video playback times per ad over the query window.
+// Percentiles need the individual values, so this reads the raw events and
+// only reaches back as far as they are retained.
+func (s *AnalyticsService) GetPlaybackDistribution(query models.AnalyticsQuery) ([]models.PlaybackDistribution, error) {
+	from := query.From.In(time.Local)
+	to := query.To.In(time.Local)
+	location := query.Location
+	if location == nil {
+		location = time.UTC
+	}
+	sel := newDimensionSelection(nil, query.Filters)
+
+	args := []interface{}{from, to}
+	filter := sel.filter("", &args)
+
+	statsQuery := `
+		SELECT
+			a.id as ad_id,
+			COALESCE(p.clicks, 0),
+			COALESCE(p.min, 0),
+			COALESCE(p.max, 0),
+			COALESCE(p.mean, 0),
+			COALESCE(p.median, 0),
+			COALESCE(p.p90, 0),
+			COALESCE(p.p99, 0)
+		FROM ads a
+		LEFT JOIN (
+			SELECT ad_id,
+				COUNT(*) as clicks,
+				MIN(video_playback_time) as min,
+				MAX(video_playback_time) as max,
+				AVG(video_playback_time) as mean,
+				percentile_cont(0.5) WITHIN GROUP (ORDER BY video_playback_time) as median,
+				percentile_cont(0.9) WITHIN GROUP (ORDER BY video_playback_time) as p90,
+				percentile_cont(0.99) WITHIN GROUP (ORDER BY video_playback_time) as p99
+			FROM click_events
+			WHERE timestamp >= $1::timestamp AND timestamp < $2::timestamp` + filter + `
+			GROUP BY ad_id
+		) p ON p.ad_id = a.id
+		ORDER BY a.id ASC
+	`
+
+	rows, err := s.db.Query(statsQuery, args...)
+	if err != nil {
+		s.logger.Errorf("Failed to query playback distribution: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var distributions []models.PlaybackDistribution
+	index := map[int]int{}
+	for rows.Next() {
+		var d models.PlaybackDistribution
+		err := rows.Scan(&d.AdID, &d.Clicks, &d.Min, &d.Max, &d.Mean, &d.Median, &d.P90, &d.P99)
+		if err != nil {
+			s.logger.Errorf("Failed to scan playback distribution: %v", err)
+			return nil, err
+		}
+		d.Histogram = newPlaybackHistogram()
+		d.TimeFrame = query.TimeFrame
+		d.From = query.From.In(location)
+		d.To = query.To.In(location)
+
+		index[d.AdID] = len(distributions)
+		distributions = append(distributions, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// width_bucket returns the 1-based index of the last bound not above the value
+	args = append(args, pq.Array(playbackHistogramBounds))
+	histogramQuery := fmt.Sprintf(`
+		SELECT ad_id, width_bucket(video_playback_time::float8, $%d::float8[]) as bucket, COUNT(*)
+		FROM click_events
+		WHERE timestamp >= $1::timestamp AND timestamp < $2::timestamp`+filter+`
+		GROUP BY ad_id, bucket
+	`, len(args))
+
+	rows, err = s.db.Query(histogramQuery, args...)
+	if err != nil {
+		s.logger.Errorf("Failed to query playback histogram: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var adID, bucket, count int
+		if err := rows.Scan(&adID, &bucket, &count); err != nil {
+			s.logger.Errorf("Failed to scan playback histogram: %v", err)
+			return nil, err
+		}
+		i, ok := index[adID]
+		if !ok || bucket < 1 || bucket > len(playbackHistogramBounds) {
+			continue
+		}
+		distributions[i].Histogram[bucket-1].Count += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return distributions, nil
+}
+
+// Build an empty histogram over playbackHistogramBounds
+func newPlaybackHistogram() []models.HistogramBucket {
+	histogram := make([]models.HistogramBucket, len(playbackHistogramBounds))
+	for i, bound := range playbackHistogramBounds {
+		histogram[i].From = bound
+		if i+1 < len(playbackHistogramBounds) {
+			upper := playbackHistogramBounds[i+1]
+			histogram[i].To = &upper
+		}
+	}
+	return histogram
+}
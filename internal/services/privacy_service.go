@@ -0,0 +1,482 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/privacy"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Privacy request types recorded in the audit log
+const (
+	PrivacyRequestExport  = "export"
+	PrivacyRequestErasure = "erasure"
+)
+
+// Executes statements on a database or inside a transaction
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type PrivacyService struct {
+	db         *sql.DB
+	logger     *logrus.Logger
+	anonymizer *privacy.Anonymizer
+	// Key of the subject digest on receipts, receipts carry none without it
+	receiptKey []byte
+}
+
+// Create new privacy service
+func NewPrivacyService(db *sql.DB, logger *logrus.Logger, anonymizer *privacy.Anonymizer, receiptKey []byte) *PrivacyService {
+	return &PrivacyService{
+		db:         db,
+		logger:     logger,
+		anonymizer: anonymizer,
+		receiptKey: receiptKey,
+	}
+}
+
+// Export all events tied to a data subject
+func (s *PrivacyService) Export(req models.SubjectRequest) (*models.SubjectExport, error) {
+	condition, args, err := s.subjectCondition(req)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, ad_id, timestamp, COALESCE(ip_address, ''), COALESCE(connection_ip, ''),
+			video_playback_time, COALESCE(user_agent, ''), consent_status,
+			COALESCE(viewer_id, ''), COALESCE(session_id, ''), COALESCE(click_uid, ''), processed
+		FROM click_events
+		WHERE ` + condition + `
+		ORDER BY timestamp ASC, id ASC
+	`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.ClickEvent{}
+	for rows.Next() {
+		var event models.ClickEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.AdID,
+			&event.Timestamp,
+			&event.IPAddress,
+			&event.ConnectionIP,
+			&event.VideoPlaybackTime,
+			&event.UserAgent,
+			&event.ConsentStatus,
+			&event.ViewerID,
+			&event.SessionID,
+			&event.ClickID,
+			&event.Processed,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	links := newSubjectLinks(req)
+	for _, event := range events {
+		links.add(event.ID, event.ClickID, event.ViewerID)
+	}
+	conversions, err := s.subjectConversions(links)
+	if err != nil {
+		return nil, err
+	}
+	webhooks, err := s.subjectWebhooks(links)
+	if err != nil {
+		return nil, err
+	}
+
+	count := len(events) + len(conversions) + len(webhooks)
+	receipt := s.newReceipt(PrivacyRequestExport, req)
+	receipt.EventsMatched = count
+	if err := s.recordReceipt(s.db, receipt); err != nil {
+		return nil, err
+	}
+
+	return &models.SubjectExport{
+		RequestID:   receipt.ReceiptID,
+		SubjectType: req.SubjectType,
+		GeneratedAt: receipt.CompletedAt,
+		EventCount:  count,
+		ClickEvents: events,
+		Conversions: conversions,
+		Webhooks:    webhooks,
+	}, nil
+}
+
+// Delete all events tied to a data subject and record a receipt
+func (s *PrivacyService) Erase(req models.SubjectRequest) (*models.PrivacyReceipt, error) {
+	condition, args, err := s.subjectCondition(req)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	links, err := s.lockSubjectEvents(tx, condition, args, newSubjectLinks(req))
+	if err != nil {
+		return nil, err
+	}
+
+	// Conversions go first, deleting their click would only unlink them.
+	// Conversions and sessions of the viewers behind the events go with the
+	// events, whatever the subject type.
+	result, err := tx.Exec(`DELETE FROM conversions c WHERE `+conversionSubjectCondition,
+		pq.Array(links.eventIDs), pq.Array(links.viewerIDs))
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM viewer_sessions WHERE viewer_id = ANY($1)", pq.Array(links.viewerIDs)); err != nil {
+		return nil, err
+	}
+
+	events, err := s.eraseClickEvents(tx, links.eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	deleted += events
+
+	// Queued and sent webhook events copy the click and viewer IDs
+	result, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE `+webhookSubjectCondition,
+		pq.Array(links.clickIDs), pq.Array(links.viewerIDs))
+	if err != nil {
+		return nil, err
+	}
+	webhooks, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	deleted += webhooks
+
+	receipt := s.newReceipt(PrivacyRequestErasure, req)
+	receipt.EventsMatched = int(deleted)
+	receipt.EventsDeleted = int(deleted)
+	if err := s.recordReceipt(tx, receipt); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.logger.Infof("Erasure %s deleted %d click events", receipt.ReceiptID, events)
+	return receipt, nil
+}
+
+// What a subject's events tie them to: conversions attributed to the
+// events, and the viewers behind them with their sessions, conversions and
+// webhook deliveries
+type subjectLinks struct {
+	eventIDs  []int
+	clickIDs  []string
+	viewerIDs []string
+	viewers   map[string]bool
+}
+
+// Start the links of a subject, a viewer subject is linked to itself even
+// without events on record
+func newSubjectLinks(req models.SubjectRequest) *subjectLinks {
+	links := &subjectLinks{eventIDs: []int{}, clickIDs: []string{}, viewerIDs: []string{}, viewers: map[string]bool{}}
+	if req.SubjectType == "viewer" {
+		links.add(0, "", req.Subject)
+	}
+	return links
+}
+
+func (l *subjectLinks) add(eventID int, clickID, viewerID string) {
+	if eventID != 0 {
+		l.eventIDs = append(l.eventIDs, eventID)
+	}
+	if clickID != "" {
+		l.clickIDs = append(l.clickIDs, clickID)
+	}
+	if viewerID != "" && !l.viewers[viewerID] {
+		l.viewers[viewerID] = true
+		l.viewerIDs = append(l.viewerIDs, viewerID)
+	}
+}
+
+// Lock the click events matching a subject and collect their links
+func (s *PrivacyService) lockSubjectEvents(tx *sql.Tx, condition string, args []interface{}, links *subjectLinks) (*subjectLinks, error) {
+	rows, err := tx.Query(`
+		SELECT id, COALESCE(click_uid, ''), COALESCE(viewer_id, '')
+		FROM click_events
+		WHERE `+condition+`
+		FOR UPDATE
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var eventID int
+		var clickID, viewerID string
+		if err := rows.Scan(&eventID, &clickID, &viewerID); err != nil {
+			return nil, err
+		}
+		links.add(eventID, clickID, viewerID)
+	}
+	return links, rows.Err()
+}
+
+// Delete click events by ID, taking the ones already folded into the
+// rollups back out of them
+func (s *PrivacyService) eraseClickEvents(tx *sql.Tx, eventIDs []int) (int64, error) {
+	rows, err := tx.Query(`
+		DELETE FROM click_events WHERE id = ANY($1)
+		RETURNING ad_id, timestamp, `+dimensionColumns+`, video_playback_time, consent_status, processed
+	`, pq.Array(eventIDs))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var deleted int64
+	deltas := rollupDeltas{}
+	for rows.Next() {
+		var adID int
+		var timestamp time.Time
+		var dims clickDimensions
+		var playbackTime float64
+		var consentStatus string
+		var processed bool
+		err := rows.Scan(&adID, &timestamp, &dims.deviceType, &dims.os, &dims.browser, &dims.country, &playbackTime, &consentStatus, &processed)
+		if err != nil {
+			return 0, err
+		}
+		deleted++
+		if processed {
+			deltas.add(adID, timestamp, dims, playbackTime, consentStatus, -1)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	if err := deltas.apply(tx); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// Matches conversions attributed to one of the click events in $1 or made
+// by one of the viewers in $2, with conversions aliased as c
+const conversionSubjectCondition = `c.click_event_id = ANY($1) OR c.viewer_id = ANY($2)`
+
+// Matches webhook deliveries whose payload names one of the clicks in $1 or
+// the viewers in $2. Click and conversion events both carry click_id.
+const webhookSubjectCondition = `payload->>'click_id' = ANY($1) OR payload->>'viewer_id' = ANY($2)`
+
+// Get the webhook deliveries carrying a subject's clicks or viewer IDs
+func (s *PrivacyService) subjectWebhooks(links *subjectLinks) ([]models.WebhookDelivery, error) {
+	query := `
+		SELECT id, subscription_id, event_type, payload, status, attempts, COALESCE(last_status_code, 0),
+			COALESCE(last_error, ''), next_attempt_at, created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE ` + webhookSubjectCondition + `
+		ORDER BY created_at ASC, id ASC
+	`
+
+	rows, err := s.db.Query(query, pq.Array(links.clickIDs), pq.Array(links.viewerIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var delivery models.WebhookDelivery
+		var deliveredAt sql.NullTime
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.SubscriptionID,
+			&delivery.EventType,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.LastStatusCode,
+			&delivery.LastError,
+			&delivery.NextAttemptAt,
+			&delivery.CreatedAt,
+			&deliveredAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if deliveredAt.Valid {
+			delivery.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Get a previously issued receipt
+func (s *PrivacyService) GetReceipt(receiptID string) (*models.PrivacyReceipt, error) {
+	query := `
+		SELECT receipt_id, request_type, subject_type, subject_hash, COALESCE(requested_by, ''),
+			COALESCE(reference, ''), events_matched, events_deleted, created_at
+		FROM privacy_requests
+		WHERE receipt_id = $1
+	`
+
+	var receipt models.PrivacyReceipt
+	err := s.db.QueryRow(query, receiptID).Scan(
+		&receipt.ReceiptID,
+		&receipt.RequestType,
+		&receipt.SubjectType,
+		&receipt.SubjectHash,
+		&receipt.RequestedBy,
+		&receipt.Reference,
+		&receipt.EventsMatched,
+		&receipt.EventsDeleted,
+		&receipt.CompletedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &receipt, nil
+}
+
+// Get the conversions attributed to a subject's clicks or made by their
+// viewers
+func (s *PrivacyService) subjectConversions(links *subjectLinks) ([]models.Conversion, error) {
+	query := `
+		SELECT c.id, COALESCE(c.conversion_id, ''), COALESCE(ce.click_uid, ''), COALESCE(c.ad_id, 0),
+			COALESCE(c.viewer_id, ''), c.value, c.attributed, c.converted_at
+		FROM conversions c
+		LEFT JOIN click_events ce ON ce.id = c.click_event_id
+		WHERE ` + conversionSubjectCondition + `
+		ORDER BY c.converted_at ASC, c.id ASC
+	`
+
+	rows, err := s.db.Query(query, pq.Array(links.eventIDs), pq.Array(links.viewerIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversions := []models.Conversion{}
+	for rows.Next() {
+		var conversion models.Conversion
+		err := rows.Scan(
+			&conversion.ID,
+			&conversion.ConversionID,
+			&conversion.ClickID,
+			&conversion.AdID,
+			&conversion.ViewerID,
+			&conversion.Value,
+			&conversion.Attributed,
+			&conversion.ConvertedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		conversions = append(conversions, conversion)
+	}
+
+	return conversions, rows.Err()
+}
+
+// Build the WHERE condition matching a subject's events as they were stored
+func (s *PrivacyService) subjectCondition(req models.SubjectRequest) (string, []interface{}, error) {
+	switch req.SubjectType {
+	case "ip":
+		ip := net.ParseIP(req.Subject)
+		if ip == nil {
+			return "", nil, fmt.Errorf("%w: %q is not an IP address", models.ErrInvalidSubject, req.Subject)
+		}
+		candidates, err := s.anonymizer.IPCandidates(ip.String())
+		if errors.Is(err, privacy.ErrSharedAddress) {
+			return "", nil, fmt.Errorf("%w: IPs are stored truncated, so an IP matches other hosts in its prefix; use a viewer subject", models.ErrInvalidSubject)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return "(ip_address = ANY($1) OR connection_ip = ANY($1))", []interface{}{pq.Array(candidates)}, nil
+	case "viewer":
+		if req.Subject == "" {
+			return "", nil, fmt.Errorf("%w: viewer ID is empty", models.ErrInvalidSubject)
+		}
+		return "viewer_id = $1", []interface{}{req.Subject}, nil
+	default:
+		return "", nil, fmt.Errorf("%w: unsupported subject type %q", models.ErrInvalidSubject, req.SubjectType)
+	}
+}
+
+func (s *PrivacyService) newReceipt(requestType string, req models.SubjectRequest) *models.PrivacyReceipt {
+	return &models.PrivacyReceipt{
+		ReceiptID:   NewIdentifier(),
+		RequestType: requestType,
+		SubjectType: req.SubjectType,
+		SubjectHash: s.subjectDigest(req),
+		RequestedBy: req.RequestedBy,
+		Reference:   req.Reference,
+		CompletedAt: time.Now().UTC(),
+	}
+}
+
+// Digest a subject for its receipt. Keyed, as an unkeyed hash of an IPv4
+// address is reversed by hashing all of them; empty when no key is set.
+func (s *PrivacyService) subjectDigest(req models.SubjectRequest) string {
+	if len(s.receiptKey) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.receiptKey)
+	mac.Write([]byte(req.SubjectType + ":" + req.Subject))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Write a receipt to the privacy_requests audit log
+func (s *PrivacyService) recordReceipt(exec sqlExecer, receipt *models.PrivacyReceipt) error {
+	_, err := exec.Exec(`
+		INSERT INTO privacy_requests (receipt_id, request_type, subject_type, subject_hash, requested_by, reference, events_matched, events_deleted, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`,
+		receipt.ReceiptID,
+		receipt.RequestType,
+		receipt.SubjectType,
+		receipt.SubjectHash,
+		receipt.RequestedBy,
+		receipt.Reference,
+		receipt.EventsMatched,
+		receipt.EventsDeleted,
+		receipt.CompletedAt,
+	)
+	return err
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/privacy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubjectDigest(t *testing.T) {
+	req := models.SubjectRequest{SubjectType: "ip", Subject: "203.0.113.7"}
+
+	keyed := NewPrivacyService(nil, testLogger(), nil, []byte("receipt-key"))
+	digest := keyed.subjectDigest(req)
+	assert.Len(t, digest, 64)
+	assert.Equal(t, digest, keyed.subjectDigest(req), "same subject, same digest")
+	assert.NotEqual(t, digest, keyed.subjectDigest(models.SubjectRequest{SubjectType: "viewer", Subject: "203.0.113.7"}))
+
+	// Not the plain SHA-256 anyone can recompute, nor the digest under another key
+	plain := sha256.Sum256([]byte("ip:203.0.113.7"))
+	assert.NotEqual(t, hex.EncodeToString(plain[:]), digest)
+	other := NewPrivacyService(nil, testLogger(), nil, []byte("other-key"))
+	assert.NotEqual(t, digest, other.subjectDigest(req))
+
+	unkeyed := NewPrivacyService(nil, testLogger(), nil, nil)
+	assert.Empty(t, unkeyed.subjectDigest(req))
+}
+
+// An IP subject takes along the conversions attributed to their clicks and
+// the conversions and sessions of the viewers behind those clicks
+func TestPrivacyIPSubjectReachesConversionsAndViewers(t *testing.T) {
+	db := testDB(t)
+	adID := testAd(t, db)
+	anonymizer, err := privacy.NewAnonymizer(privacy.Options{IPMode: privacy.ModeFull, UserAgentMode: privacy.ModeFull}, privacy.NewSaltStore(db))
+	require.NoError(t, err)
+	s := NewPrivacyService(db, testLogger(), anonymizer, []byte("receipt-key"))
+
+	_, err = db.Exec(`
+		INSERT INTO click_events (ad_id, timestamp, ip_address, video_playback_time, consent_status, processed, viewer_id, click_uid)
+		VALUES ($1, TIMESTAMP '2024-05-01 10:00:00', '203.0.113.7', 10, 'consented', false, 'viewer-a', 'click-a'),
+			($1, TIMESTAMP '2024-05-01 11:00:00', '198.51.100.9', 10, 'consented', false, 'viewer-b', 'click-b')
+	`, adID)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		INSERT INTO conversions (conversion_id, click_event_id, ad_id, viewer_id, value, attributed, converted_at)
+		VALUES ('by-click', 1, $1, NULL, 10, true, TIMESTAMP '2024-05-01 12:00:00'),
+			('by-viewer', NULL, $1, 'viewer-a', 20, false, TIMESTAMP '2024-05-02 12:00:00'),
+			('other', 2, $1, 'viewer-b', 30, true, TIMESTAMP '2024-05-01 12:00:00')
+	`, adID)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		INSERT INTO viewer_sessions (session_id, viewer_id, started_at, last_seen_at)
+		VALUES ('session-a', 'viewer-a', TIMESTAMP '2024-05-01 10:00:00', TIMESTAMP '2024-05-01 10:00:00'),
+			('session-b', 'viewer-b', TIMESTAMP '2024-05-01 11:00:00', TIMESTAMP '2024-05-01 11:00:00')
+	`)
+	require.NoError(t, err)
+
+	req := models.SubjectRequest{SubjectType: "ip", Subject: "203.0.113.7"}
+	exported, err := s.Export(req)
+	require.NoError(t, err)
+	require.Len(t, exported.ClickEvents, 1)
+	var conversionIDs []string
+	for _, conversion := range exported.Conversions {
+		conversionIDs = append(conversionIDs, conversion.ConversionID)
+	}
+	assert.ElementsMatch(t, []string{"by-click", "by-viewer"}, conversionIDs)
+
+	receipt, err := s.Erase(req)
+	require.NoError(t, err)
+	assert.Equal(t, 3, receipt.EventsDeleted)
+
+	var conversions, sessions []string
+	rows, err := db.Query("SELECT conversion_id FROM conversions")
+	require.NoError(t, err)
+	for rows.Next() {
+		var id string
+		require.NoError(t, rows.Scan(&id))
+		conversions = append(conversions, id)
+	}
+	require.NoError(t, rows.Err())
+	rows, err = db.Query("SELECT session_id FROM viewer_sessions")
+	require.NoError(t, err)
+	for rows.Next() {
+		var id string
+		require.NoError(t, rows.Scan(&id))
+		sessions = append(sessions, id)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"other"}, conversions)
+	assert.Equal(t, []string{"session-b"}, sessions)
+}
@@ -0,0 +1,530 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"video-ad-tracker/internal/cron"
+	"video-ad-tracker/internal/export"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/validation"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Time allowed for one conversation with the SMTP server
+const smtpTimeout = time.Minute
+
+// SMTPOptions configures email delivery of reports. An empty host turns it off.
+type SMTPOptions struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// ReportOptions configures the report scheduler
+type ReportOptions struct {
+	PollInterval time.Duration
+	Directory    string // Where directory delivery writes reports, empty to turn it off
+	SMTP         SMTPOptions
+	BatchSize    int
+}
+
+// ReportService stores report definitions and runs them on their schedules
+type ReportService struct {
+	db        *sql.DB
+	logger    *logrus.Logger
+	analytics *AnalyticsService
+	opts      ReportOptions
+}
+
+// Create new report service
+func NewReportService(db *sql.DB, logger *logrus.Logger, analytics *AnalyticsService, opts ReportOptions) *ReportService {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 30 * time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 10
+	}
+	return &ReportService{
+		db:        db,
+		logger:    logger,
+		analytics: analytics,
+		opts:      opts,
+	}
+}
+
+// Save a report definition and schedule its first run
+func (s *ReportService) CreateReport(req models.ReportRequest) (*models.Report, error) {
+	if !s.canDeliver(req.Delivery) {
+		return nil, models.ErrDeliveryUnavailable
+	}
+
+	format := req.Format
+	if format == "" {
+		format = export.CSV
+	}
+	recipients := req.Recipients
+	if recipients == nil {
+		recipients = []string{}
+	}
+
+	nextRunAt, err := nextRun(req.Schedule, req.Query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO reports (name, query, format, delivery, recipients, schedule, next_run_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, active, created_at
+	`
+
+	report := models.Report{
+		Name:       req.Name,
+		Query:      req.Query,
+		Format:     format,
+		Delivery:   req.Delivery,
+		Recipients: recipients,
+		Schedule:   req.Schedule,
+		NextRunAt:  nextRunAt,
+	}
+	err = s.db.QueryRow(query, report.Name, report.Query, report.Format, report.Delivery,
+		pq.Array(report.Recipients), report.Schedule, nextRunAt.In(time.Local)).Scan(
+		&report.ID,
+		&report.Active,
+		&report.CreatedAt,
+	)
+	if err != nil {
+		s.logger.Errorf("Failed to create report: %v", err)
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// Get all report definitions
+func (s *ReportService) ListReports() ([]models.Report, error) {
+	rows, err := s.db.Query(`SELECT ` + reportColumns + ` FROM reports ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []models.Report{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+
+	return reports, rows.Err()
+}
+
+// Delete a report definition. Reports whether it existed.
+func (s *ReportService) DeleteReport(id int) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM reports WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// Run a report straight away, outside its schedule. Returns nil when the
+// report does not exist; the outcome of the run is in its last_error.
+func (s *ReportService) RunReport(ctx context.Context, id int) (*models.Report, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+reportColumns+` FROM reports WHERE id = $1`, id)
+	report, err := scanReport(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.run(ctx, report)
+	return report, nil
+}
+
+// Run due reports until the context is cancelled
+func (s *ReportService) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.opts.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.runDue(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Errorf("Report scheduling failed: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Claim the reports that are due by moving them to their next run, then
+// run them. The claim commits first, so a report is run once per slot even
+// with several instances, and a slow or failing run is not retried before
+// its next slot. Slots missed while the service was down are run once.
+func (s *ReportService) runDue(ctx context.Context) error {
+	now := time.Now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+reportColumns+`
+		FROM reports
+		WHERE active AND next_run_at <= $1
+		ORDER BY next_run_at ASC
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, now.In(time.Local), s.opts.BatchSize)
+	if err != nil {
+		return err
+	}
+	var due []*models.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, report)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, report := range due {
+		nextRunAt, err := nextRun(report.Schedule, report.Query, now)
+		if err != nil {
+			// The definition was valid when saved, so this only happens if it
+			// was edited by hand; park it rather than retrying every poll
+			s.logger.Errorf("Failed to schedule report %d: %v", report.ID, err)
+			report.Active = false
+			_, err = tx.ExecContext(ctx, `UPDATE reports SET active = false, last_error = $2 WHERE id = $1`, report.ID, err.Error())
+		} else {
+			report.NextRunAt = nextRunAt
+			_, err = tx.ExecContext(ctx, `UPDATE reports SET next_run_at = $2 WHERE id = $1`, report.ID, nextRunAt.In(time.Local))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, report := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		if report.Active {
+			s.run(ctx, report)
+		}
+	}
+	return nil
+}
+
+// Generate and deliver a report, recording the outcome on it
+func (s *ReportService) run(ctx context.Context, report *models.Report) {
+	start := time.Now()
+	err := s.deliver(ctx, report, start)
+	if err != nil {
+		s.logger.Errorf("Failed to run report %d: %v", report.ID, err)
+		report.LastError = err.Error()
+	} else {
+		s.logger.Infof("Delivered report %d by %s in %v", report.ID, report.Delivery, time.Since(start))
+		report.LastError = ""
+	}
+	report.LastRunAt = &start
+
+	_, updateErr := s.db.Exec(`UPDATE reports SET last_run_at = $2, last_error = NULLIF($3, '') WHERE id = $1`,
+		report.ID, start.In(time.Local), report.LastError)
+	if updateErr != nil {
+		s.logger.Errorf("Failed to record run of report %d: %v", report.ID, updateErr)
+	}
+}
+
+func (s *ReportService) deliver(ctx context.Context, report *models.Report, now time.Time) error {
+	if !s.canDeliver(report.Delivery) {
+		return models.ErrDeliveryUnavailable
+	}
+
+	values, err := url.ParseQuery(report.Query)
+	if err != nil {
+		return err
+	}
+	query, fieldErrors := validation.AnalyticsQuery(values, now)
+	if len(fieldErrors) > 0 {
+		return fmt.Errorf("invalid query: %s %s", fieldErrors[0].Field, fieldErrors[0].Message)
+	}
+
+	location := query.Location
+	if location == nil {
+		location = time.UTC
+	}
+	filename := fmt.Sprintf("report-%d-%s.%s", report.ID, now.In(location).Format("20060102T1504"), report.Format)
+
+	if report.Delivery == models.ReportDeliveryDirectory {
+		return s.writeToDirectory(ctx, filename, report.Format, query, s.analytics.ExportMetadata(query, now))
+	}
+
+	var attachment bytes.Buffer
+	if err := s.analytics.Export(ctx, &attachment, report.Format, query, s.analytics.ExportMetadata(query, now)); err != nil {
+		return err
+	}
+	return s.sendEmail(report, filename, attachment.Bytes(), query, location)
+}
+
+func (s *ReportService) canDeliver(delivery string) bool {
+	switch delivery {
+	case models.ReportDeliveryEmail:
+		return s.opts.SMTP.Host != ""
+	case models.ReportDeliveryDirectory:
+		return s.opts.Directory != ""
+	}
+	return false
+}
+
+// Stream a report into the report directory. It is written under a
+// temporary name and renamed when complete, so anything picking files up
+// from the directory never sees a partial one.
+func (s *ReportService) writeToDirectory(ctx context.Context, filename, format string, query models.AnalyticsQuery, metadata []export.Field) error {
+	file, err := os.CreateTemp(s.opts.Directory, "."+filename+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := s.analytics.Export(ctx, file, format, query, metadata); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(s.opts.Directory, filename))
+}
+
+// Email a report as an attachment. STARTTLS is used when the server offers
+// it, and credentials are only sent when a username is configured.
+func (s *ReportService) sendEmail(report *models.Report, filename string, attachment []byte, query models.AnalyticsQuery, location *time.Location) error {
+	message, err := reportMessage(s.opts.SMTP.From, report, filename, attachment, query, location)
+	if err != nil {
+		return err
+	}
+
+	host := s.opts.SMTP.Host
+	addr := net.JoinHostPort(host, strconv.Itoa(s.opts.SMTP.Port))
+	conn, err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.opts.SMTP.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.opts.SMTP.Username, s.opts.SMTP.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(s.opts.SMTP.From); err != nil {
+		return err
+	}
+	for _, recipient := range report.Recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Build a MIME message with a short summary and the report attached
+func reportMessage(from string, report *models.Report, filename string, attachment []byte, query models.AnalyticsQuery, location *time.Location) ([]byte, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(report.Recipients, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Report: "+report.Name))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", w.Boundary())
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	text := quotedprintable.NewWriter(part)
+	fmt.Fprintf(text, "%s\r\n\r\nAnalytics from %s to %s (%s), exported as %s.\r\nQuery: %s\r\nSchedule: %s\r\n",
+		report.Name,
+		query.From.In(location).Format(time.RFC3339),
+		query.To.In(location).Format(time.RFC3339),
+		location,
+		report.Format,
+		report.Query,
+		report.Schedule,
+	)
+	if err := text.Close(); err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(export.ContentType(report.Format))
+	if err != nil {
+		return nil, err
+	}
+	params["name"] = filename
+	file, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(mediaType, params)},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBase64Lines(file, attachment); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// Write base64 in lines of 76 characters, the most MIME allows
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := 76
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+		if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+// Get the next time a schedule fires, in the time zone of the report query
+func nextRun(schedule, rawQuery string, after time.Time) (time.Time, error) {
+	parsed, err := cron.Parse(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return time.Time{}, err
+	}
+	location, fieldErrors := validation.TimeZone(values.Get("tz"))
+	if len(fieldErrors) > 0 {
+		return time.Time{}, fmt.Errorf("invalid tz %q", values.Get("tz"))
+	}
+
+	next := parsed.Next(after.In(location))
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("schedule %q never fires", schedule)
+	}
+	return next, nil
+}
+
+// Columns read by scanReport
+const reportColumns = `id, name, query, format, delivery, recipients, schedule, active,
+	next_run_at, last_run_at, COALESCE(last_error, ''), created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReport(row rowScanner) (*models.Report, error) {
+	var report models.Report
+	var lastRunAt sql.NullTime
+	err := row.Scan(
+		&report.ID,
+		&report.Name,
+		&report.Query,
+		&report.Format,
+		&report.Delivery,
+		pq.Array(&report.Recipients),
+		&report.Schedule,
+		&report.Active,
+		&report.NextRunAt,
+		&lastRunAt,
+		&report.LastError,
+		&report.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run times are written as server local wall-clock values
+	report.NextRunAt = localTime(report.NextRunAt)
+	if lastRunAt.Valid {
+		lastRun := localTime(lastRunAt.Time)
+		report.LastRunAt = &lastRun
+	}
+	return &report, nil
+}
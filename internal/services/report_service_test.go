@@ -0,0 +1,257 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// What a stub SMTP server was told in one conversation
+type smtpSession struct {
+	auth       string
+	from       string
+	recipients []string
+	data       []byte
+}
+
+// Start an SMTP server on localhost that takes a single conversation,
+// advertising AUTH PLAIN and refusing the recipients in reject. The
+// session is sent on the returned channel once the client hangs up.
+func stubSMTP(t *testing.T, reject map[string]bool) (string, int, <-chan smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		var session smtpSession
+		defer func() { sessions <- session }()
+		r := textproto.NewReader(bufio.NewReader(conn))
+		reply := func(lines ...string) {
+			io.WriteString(conn, strings.Join(lines, "\r\n")+"\r\n")
+		}
+
+		reply("220 stub ESMTP")
+		for {
+			line, err := r.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				reply("250-stub", "250 AUTH PLAIN")
+			case "AUTH":
+				session.auth = arg
+				reply("235 2.7.0 Authentication successful")
+			case "MAIL":
+				session.from = strings.TrimSuffix(strings.TrimPrefix(arg, "FROM:<"), ">")
+				reply("250 2.1.0 OK")
+			case "RCPT":
+				recipient := strings.TrimSuffix(strings.TrimPrefix(arg, "TO:<"), ">")
+				if reject[recipient] {
+					reply("550 5.1.1 No such user")
+					continue
+				}
+				session.recipients = append(session.recipients, recipient)
+				reply("250 2.1.5 OK")
+			case "DATA":
+				reply("354 Go ahead")
+				if session.data, err = r.ReadDotBytes(); err != nil {
+					return
+				}
+				reply("250 2.0.0 Queued")
+			case "QUIT":
+				reply("221 2.0.0 Bye")
+				return
+			default:
+				reply("502 5.5.2 Not implemented")
+			}
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, sessions
+}
+
+func testReport() *models.Report {
+	return &models.Report{
+		ID:         4,
+		Name:       "Weekly clicks – Europe",
+		Query:      "timeframe=7d&granularity=day&tz=Europe/Berlin",
+		Format:     "csv",
+		Recipients: []string{"ops@example.com", "finance@example.com"},
+		Schedule:   "0 6 * * mon",
+	}
+}
+
+func testReportQuery(t *testing.T) (models.AnalyticsQuery, *time.Location) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	return models.AnalyticsQuery{
+		From:     time.Date(2024, 5, 6, 0, 0, 0, 0, berlin),
+		To:       time.Date(2024, 5, 13, 0, 0, 0, 0, berlin),
+		Location: berlin,
+	}, berlin
+}
+
+func TestSendEmailDeliversReport(t *testing.T) {
+	host, port, sessions := stubSMTP(t, nil)
+	s := NewReportService(nil, testLogger(), nil, ReportOptions{SMTP: SMTPOptions{
+		Host:     host,
+		Port:     port,
+		Username: "reports",
+		Password: "s3cret",
+		From:     "reports@example.com",
+	}})
+
+	report := testReport()
+	query, location := testReportQuery(t)
+	attachment := []byte("ad_id,bucket,total_clicks\n1,2024-05-06T00:00:00+02:00,12\n.\n")
+	require.NoError(t, s.sendEmail(report, "report-4.csv", attachment, query, location))
+
+	session := <-sessions
+	auth, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(session.auth, "PLAIN "))
+	require.NoError(t, err)
+	assert.Equal(t, "\x00reports\x00s3cret", string(auth))
+	assert.Equal(t, "reports@example.com", session.from)
+	assert.Equal(t, report.Recipients, session.recipients)
+
+	// The attachment arrives intact
+	parsed := parseReportMessage(t, session.data)
+	assert.Equal(t, attachment, parsed.attachment)
+}
+
+func TestSendEmailWithoutCredentials(t *testing.T) {
+	host, port, sessions := stubSMTP(t, nil)
+	s := NewReportService(nil, testLogger(), nil, ReportOptions{SMTP: SMTPOptions{Host: host, Port: port, From: "reports@example.com"}})
+
+	query, location := testReportQuery(t)
+	require.NoError(t, s.sendEmail(testReport(), "report-4.csv", []byte("ad_id\n"), query, location))
+
+	session := <-sessions
+	assert.Empty(t, session.auth)
+	assert.NotEmpty(t, session.data)
+}
+
+func TestSendEmailFailsOnRejectedRecipient(t *testing.T) {
+	host, port, sessions := stubSMTP(t, map[string]bool{"finance@example.com": true})
+	s := NewReportService(nil, testLogger(), nil, ReportOptions{SMTP: SMTPOptions{Host: host, Port: port, From: "reports@example.com"}})
+
+	query, location := testReportQuery(t)
+	err := s.sendEmail(testReport(), "report-4.csv", []byte("ad_id\n"), query, location)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "No such user")
+
+	session := <-sessions
+	assert.Nil(t, session.data, "nothing sent after the refusal")
+}
+
+// Parts of a report message
+type parsedReportMessage struct {
+	header      mail.Header
+	text        string
+	contentType string
+	disposition string
+	attachment  []byte
+}
+
+func parseReportMessage(t *testing.T, data []byte) parsedReportMessage {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	parsed := parsedReportMessage{header: msg.Header}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+
+	// Read parts raw, as multipart would undo quoted-printable on its own
+	text, err := mr.NextRawPart()
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", text.Header.Get("Content-Type"))
+	assert.Equal(t, "quoted-printable", text.Header.Get("Content-Transfer-Encoding"))
+	decoded, err := io.ReadAll(quotedprintable.NewReader(text))
+	require.NoError(t, err)
+	parsed.text = string(decoded)
+
+	file, err := mr.NextRawPart()
+	require.NoError(t, err)
+	assert.Equal(t, "base64", file.Header.Get("Content-Transfer-Encoding"))
+	parsed.contentType = file.Header.Get("Content-Type")
+	parsed.disposition = file.Header.Get("Content-Disposition")
+	raw, err := io.ReadAll(file)
+	require.NoError(t, err)
+	// Line ends come back as LF only from the SMTP data reader
+	for _, line := range strings.Split(strings.TrimRight(string(raw), "\r\n"), "\n") {
+		assert.LessOrEqual(t, len(strings.TrimSuffix(line, "\r")), 76, "base64 line length")
+	}
+	parsed.attachment, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw)))
+	require.NoError(t, err)
+
+	_, err = mr.NextRawPart()
+	assert.Equal(t, io.EOF, err)
+	return parsed
+}
+
+func TestReportMessage(t *testing.T) {
+	report := testReport()
+	report.Format = "xlsx"
+	query, location := testReportQuery(t)
+	attachment := bytes.Repeat([]byte{0, 1, 2, 0xfe, 0xff}, 100)
+
+	data, err := reportMessage("reports@example.com", report, "report-4.xlsx", attachment, query, location)
+	require.NoError(t, err)
+	for _, line := range strings.Split(string(data), "\r\n") {
+		assert.LessOrEqual(t, len(line), 998, "line length")
+	}
+
+	parsed := parseReportMessage(t, data)
+	assert.Equal(t, "reports@example.com", parsed.header.Get("From"))
+	assert.Equal(t, "ops@example.com, finance@example.com", parsed.header.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Report: Weekly clicks – Europe", subject)
+	_, err = parsed.header.Date()
+	assert.NoError(t, err)
+
+	assert.Contains(t, parsed.text, "Weekly clicks – Europe")
+	assert.Contains(t, parsed.text, "Analytics from 2024-05-06T00:00:00+02:00 to 2024-05-13T00:00:00+02:00 (Europe/Berlin), exported as xlsx.")
+	assert.Contains(t, parsed.text, "Query: "+report.Query)
+	assert.Contains(t, parsed.text, "Schedule: 0 6 * * mon")
+
+	mediaType, params, err := mime.ParseMediaType(parsed.contentType)
+	require.NoError(t, err)
+	assert.Equal(t, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", mediaType)
+	assert.Equal(t, "report-4.xlsx", params["name"])
+	disposition, params, err := mime.ParseMediaType(parsed.disposition)
+	require.NoError(t, err)
+	assert.Equal(t, "attachment", disposition)
+	assert.Equal(t, "report-4.xlsx", params["filename"])
+
+	assert.Equal(t, attachment, parsed.attachment)
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetentionPolicy deletes rows of a table once Column is older than MaxAge.
+// When Condition is set, only rows matching it are deleted.
+type RetentionPolicy struct {
+	Name      string
+	Table     string
+	Column    string
+	MaxAge    time.Duration
+	Condition string
+}
+
+// PurgeResult reports what a purge removed, or would remove in a dry run
+type PurgeResult struct {
+	Policy string     `json:"policy"`
+	Table  string     `json:"table"`
+	Cutoff time.Time  `json:"cutoff"`
+	Rows   int64      `json:"rows"`
+	Oldest *time.Time `json:"oldest,omitempty"`
+	DryRun bool       `json:"dry_run"`
+}
+
+type RetentionService struct {
+	db         *sql.DB
+	logger     *logrus.Logger
+	policies   []RetentionPolicy
+	batchSize  int
+	batchPause time.Duration
+}
+
+// Create new retention service
+func NewRetentionService(db *sql.DB, logger *logrus.Logger, policies []RetentionPolicy, batchSize int, batchPause time.Duration) *RetentionService {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	return &RetentionService{
+		db:         db,
+		logger:     logger,
+		policies:   policies,
+		batchSize:  batchSize,
+		batchPause: batchPause,
+	}
+}
+
+// Run purges on a fixed interval until the context is cancelled
+func (s *RetentionService) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.Purge(ctx, false); err != nil && ctx.Err() == nil {
+				s.logger.Errorf("Retention purge failed: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Purge expired rows for every policy. In a dry run nothing is deleted and
+// the rows that would be removed are counted instead.
+func (s *RetentionService) Purge(ctx context.Context, dryRun bool) ([]PurgeResult, error) {
+	var results []PurgeResult
+	for _, policy := range s.policies {
+		if policy.MaxAge <= 0 {
+			continue
+		}
+
+		result := PurgeResult{
+			Policy: policy.Name,
+			Table:  policy.Table,
+			Cutoff: time.Now().Add(-policy.MaxAge),
+			DryRun: dryRun,
+		}
+
+		var err error
+		if dryRun {
+			err = s.countExpired(ctx, policy, &result)
+		} else {
+			err = s.deleteExpired(ctx, policy, &result)
+		}
+		if err != nil {
+			return results, fmt.Errorf("policy %s: %w", policy.Name, err)
+		}
+
+		if !dryRun && result.Rows > 0 {
+			s.logger.Infof("Retention purged %d rows from %s older than %s", result.Rows, policy.Table, result.Cutoff.Format(time.RFC3339))
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Count rows past the cutoff
+func (s *RetentionService) countExpired(ctx context.Context, policy RetentionPolicy, result *PurgeResult) error {
+	query := fmt.Sprintf(
+		"SELECT COUNT(*), MIN(%[2]s)::timestamp FROM %[1]s WHERE %[2]s < $1::timestamp%[3]s",
+		policy.Table, policy.Column, policy.condition(),
+	)
+
+	var oldest sql.NullTime
+	if err := s.db.QueryRowContext(ctx, query, result.Cutoff).Scan(&result.Rows, &oldest); err != nil {
+		return err
+	}
+	if oldest.Valid {
+		result.Oldest = &oldest.Time
+	}
+	return nil
+}
+
+// Delete rows past the cutoff in small batches so long running deletes do
+// not hold locks against concurrent inserts
+func (s *RetentionService) deleteExpired(ctx context.Context, policy RetentionPolicy, result *PurgeResult) error {
+	query := fmt.Sprintf(`
+		DELETE FROM %[1]s
+		WHERE ctid = ANY(ARRAY(
+			SELECT ctid FROM %[1]s
+			WHERE %[2]s < $1::timestamp%[3]s
+			LIMIT $2
+		))
+	`, policy.Table, policy.Column, policy.condition())
+
+	for {
+		res, err := s.db.ExecContext(ctx, query, result.Cutoff, s.batchSize)
+		if err != nil {
+			return err
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		result.Rows += deleted
+
+		if deleted < int64(s.batchSize) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.batchPause):
+		}
+	}
+}
+
+// Get the extra filter of a policy as an AND clause
+func (p RetentionPolicy) condition() string {
+	if p.Condition == "" {
+		return ""
+	}
+	return " AND (" + p.Condition + ")"
+}
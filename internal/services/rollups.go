@@ -0,0 +1,238 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"video-ad-tracker/internal/consent"
+)
+
+// Rollup tables, one per bucket width
+const (
+	rollupMinuteTable = "click_rollups_minute"
+	rollupHourTable   = "click_rollups_hour"
+	rollupDayTable    = "click_rollups_day"
+)
+
+// Counters kept per ad and bucket
+type rollupCounters struct {
+	clicks              int64
+	consentedClicks     int64
+	notApplicableClicks int64
+	playbackSum         float64
+	playbackCount       int64
+}
+
+type rollupKey struct {
+	table  string
+	bucket time.Time
+	adID   int
+	dims   clickDimensions
+}
+
+// Accumulates counter changes for every rollup table
+type rollupDeltas map[rollupKey]*rollupCounters
+
+// Add one click to the minute, hour and day buckets it falls in. A negative
+// sign removes it again.
+func (d rollupDeltas) add(adID int, timestamp time.Time, dims clickDimensions, playbackTime float64, consentStatus string, sign int64) {
+	// Clicks without any consent signal are counted apart from consented ones
+	consented, notApplicable := int64(0), int64(0)
+	switch consentStatus {
+	case consent.StatusConsented:
+		consented = 1
+	case consent.StatusNotApplicable:
+		notApplicable = 1
+	}
+
+	for _, table := range []string{rollupMinuteTable, rollupHourTable, rollupDayTable} {
+		key := rollupKey{table: table, bucket: rollupBucket(table, timestamp), adID: adID, dims: dims}
+		counters, ok := d[key]
+		if !ok {
+			counters = &rollupCounters{}
+			d[key] = counters
+		}
+		counters.clicks += sign
+		counters.consentedClicks += sign * consented
+		counters.notApplicableClicks += sign * notApplicable
+		counters.playbackSum += float64(sign) * playbackTime
+		counters.playbackCount += sign
+	}
+}
+
+// Write the accumulated changes, in key order so concurrent writers lock
+// rows in the same order
+func (d rollupDeltas) apply(exec sqlExecer) error {
+	keys := make([]rollupKey, 0, len(d))
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].table != keys[j].table {
+			return keys[i].table < keys[j].table
+		}
+		if !keys[i].bucket.Equal(keys[j].bucket) {
+			return keys[i].bucket.Before(keys[j].bucket)
+		}
+		if keys[i].adID != keys[j].adID {
+			return keys[i].adID < keys[j].adID
+		}
+		return keys[i].dims.less(keys[j].dims)
+	})
+
+	for _, key := range keys {
+		counters := d[key]
+		query := fmt.Sprintf(`
+			INSERT INTO %s (bucket, ad_id, device_type, os, browser, country, clicks, consented_clicks, not_applicable_clicks, playback_sum, playback_count)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			ON CONFLICT (bucket, ad_id, device_type, os, browser, country) DO UPDATE SET
+				clicks = %[1]s.clicks + EXCLUDED.clicks,
+				consented_clicks = %[1]s.consented_clicks + EXCLUDED.consented_clicks,
+				not_applicable_clicks = %[1]s.not_applicable_clicks + EXCLUDED.not_applicable_clicks,
+				playback_sum = %[1]s.playback_sum + EXCLUDED.playback_sum,
+				playback_count = %[1]s.playback_count + EXCLUDED.playback_count
+		`, key.table)
+
+		_, err := exec.Exec(query,
+			key.bucket, key.adID,
+			key.dims.deviceType, key.dims.os, key.dims.browser, key.dims.country,
+			counters.clicks, counters.consentedClicks, counters.notApplicableClicks, counters.playbackSum, counters.playbackCount,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get the start of the bucket of a rollup table containing t
+func rollupBucket(table string, t time.Time) time.Time {
+	switch table {
+	case rollupDayTable:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case rollupHourTable:
+		return t.Truncate(time.Hour)
+	default:
+		return t.Truncate(time.Minute)
+	}
+}
+
+// A range of whole buckets [from, to) read from one rollup table
+type rollupSpan struct {
+	table    string
+	from, to time.Time
+}
+
+// Split [from, to] into the fewest rollup reads: minutes up to the first
+// whole hour, hours up to the first whole day, days, and back down again.
+// The minute containing from and the minute containing to are included.
+func rollupSpans(from, to time.Time) []rollupSpan {
+	start := wallClock(from).Truncate(time.Minute)
+	end := wallClock(to).Truncate(time.Minute).Add(time.Minute)
+
+	hourStart := ceilBucket(rollupHourTable, start)
+	hourEnd := rollupBucket(rollupHourTable, end)
+	dayStart := ceilBucket(rollupDayTable, start)
+	dayEnd := rollupBucket(rollupDayTable, end)
+
+	var spans []rollupSpan
+	switch {
+	case dayStart.Before(dayEnd):
+		spans = []rollupSpan{
+			{rollupMinuteTable, start, hourStart},
+			{rollupHourTable, hourStart, dayStart},
+			{rollupDayTable, dayStart, dayEnd},
+			{rollupHourTable, dayEnd, hourEnd},
+			{rollupMinuteTable, hourEnd, end},
+		}
+	case hourStart.Before(hourEnd):
+		spans = []rollupSpan{
+			{rollupMinuteTable, start, hourStart},
+			{rollupHourTable, hourStart, hourEnd},
+			{rollupMinuteTable, hourEnd, end},
+		}
+	default:
+		spans = []rollupSpan{{rollupMinuteTable, start, end}}
+	}
+
+	nonEmpty := spans[:0]
+	for _, span := range spans {
+		if span.from.Before(span.to) {
+			nonEmpty = append(nonEmpty, span)
+		}
+	}
+	return nonEmpty
+}
+
+// Click timestamps are stored as wall-clock TIMESTAMP values, which the
+// driver reads back labelled UTC. Relabel t the same way so buckets line up.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// Turn a wall-clock value read from the database back into an instant
+func localTime(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
+
+// Get the start of the first bucket at or after t
+func ceilBucket(table string, t time.Time) time.Time {
+	bucket := rollupBucket(table, t)
+	if bucket.Equal(t) {
+		return bucket
+	}
+	if table == rollupDayTable {
+		return bucket.AddDate(0, 0, 1)
+	}
+	return bucket.Add(time.Hour)
+}
+
+// Clicks not yet folded into the rollups, shaped like a rollup row
+const unprocessedClicksQuery = `
+	SELECT ad_id, timestamp as bucket, ` + dimensionColumns + `, 1 as clicks,
+		CASE WHEN consent_status = 'consented' THEN 1 ELSE 0 END as consented_clicks,
+		CASE WHEN consent_status = 'not_applicable' THEN 1 ELSE 0 END as not_applicable_clicks,
+		video_playback_time as playback_sum, 1 as playback_count
+	FROM click_events
+	WHERE processed = false`
+
+// Build a query returning counters for [from, to] from the rollups, plus
+// events not yet folded into them, per ad and selected dimension. Arguments
+// are appended to args.
+func rollupTotalsQuery(from, to time.Time, sel dimensionSelection, args *[]interface{}) string {
+	param := func(value interface{}) string {
+		*args = append(*args, value)
+		return fmt.Sprintf("$%d::timestamp", len(*args))
+	}
+
+	var parts []string
+	for _, span := range rollupSpans(from, to) {
+		parts = append(parts, fmt.Sprintf(`
+			SELECT ad_id, %s, clicks, consented_clicks, not_applicable_clicks, playback_sum, playback_count
+			FROM %s
+			WHERE bucket >= %s AND bucket < %s`,
+			dimensionColumns, span.table, param(span.from), param(span.to),
+		))
+	}
+
+	parts = append(parts, fmt.Sprintf(`
+			SELECT ad_id, %s, clicks, consented_clicks, not_applicable_clicks, playback_sum, playback_count
+			FROM (`+unprocessedClicksQuery+`) pending
+			WHERE bucket >= %s AND bucket < %s`,
+		dimensionColumns, param(wallClock(from).Truncate(time.Minute)), param(wallClock(to).Truncate(time.Minute).Add(time.Minute)),
+	))
+
+	return `
+		SELECT ad_id` + sel.columns("") + `,
+			SUM(clicks) as clicks,
+			SUM(consented_clicks) as consented_clicks,
+			SUM(not_applicable_clicks) as not_applicable_clicks,
+			SUM(playback_sum) as playback_sum,
+			SUM(playback_count) as playback_count
+		FROM (` + strings.Join(parts, "\n\t\t\tUNION ALL") + `
+		) totals
+		WHERE TRUE` + sel.filter("", args) + `
+		GROUP BY ad_id` + sel.columns("")
+}
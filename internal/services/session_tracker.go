@@ -0,0 +1,78 @@
+package services
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SessionTracker groups a viewer's events into sessions that end after a
+// period of inactivity
+type SessionTracker struct {
+	db      *sql.DB
+	logger  *logrus.Logger
+	timeout time.Duration
+}
+
+// Create new session tracker
+func NewSessionTracker(db *sql.DB, logger *logrus.Logger, timeout time.Duration) *SessionTracker {
+	return &SessionTracker{
+		db:      db,
+		logger:  logger,
+		timeout: timeout,
+	}
+}
+
+// Get the session a viewer's event at the given time belongs to, extending
+// the open session or starting a new one
+func (t *SessionTracker) Resolve(viewerID string, at time.Time) (string, error) {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Serialize concurrent events of the same viewer so they share a session
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", viewerID); err != nil {
+		return "", err
+	}
+
+	var sessionID string
+	err = tx.QueryRow(`
+		UPDATE viewer_sessions
+		SET last_seen_at = GREATEST(last_seen_at, $2::timestamp)
+		WHERE session_id = (
+			SELECT session_id FROM viewer_sessions
+			WHERE viewer_id = $1 AND last_seen_at >= $3::timestamp
+			ORDER BY last_seen_at DESC
+			LIMIT 1
+		)
+		RETURNING session_id
+	`, viewerID, at, at.Add(-t.timeout)).Scan(&sessionID)
+
+	if err == sql.ErrNoRows {
+		sessionID = NewIdentifier()
+		_, err = tx.Exec(
+			"INSERT INTO viewer_sessions (session_id, viewer_id, started_at, last_seen_at) VALUES ($1, $2, $3, $3)",
+			sessionID, viewerID, at,
+		)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// Generate a random 128-bit identifier
+func NewIdentifier() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
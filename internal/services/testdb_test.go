@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"video-ad-tracker/internal/database"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// Open the database named by TEST_DATABASE_URL with the schema migrated and
+// the data of every table removed. Tests needing it are skipped when it is
+// not set.
+func testDB(t testing.TB) *sql.DB {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := database.NewConnection(url)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		TRUNCATE ads, click_events, viewer_sessions, conversions, privacy_requests,
+			webhook_subscriptions, webhook_deliveries, click_rollups_minute, click_rollups_hour,
+			click_rollups_day, anomalies, anomaly_checks, reports
+		RESTART IDENTITY CASCADE
+	`)
+	require.NoError(t, err)
+	return db
+}
+
+// Statements run through connections opened by countingDriver
+var queryCount int64
+
+func init() {
+	sql.Register("postgres-counting", countingDriver{})
+}
+
+// Postgres driver counting every statement sent to the server
+type countingDriver struct{}
+
+func (countingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := pq.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn.(pqConn)}, nil
+}
+
+// The parts of the lib/pq connection database/sql uses
+type pqConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.QueryerContext
+	driver.ExecerContext
+}
+
+type countingConn struct {
+	pqConn
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.pqConn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return countingStmt{stmt}, nil
+}
+
+func (c countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddInt64(&queryCount, 1)
+	return c.pqConn.QueryContext(ctx, query, args)
+}
+
+func (c countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	atomic.AddInt64(&queryCount, 1)
+	return c.pqConn.ExecContext(ctx, query, args)
+}
+
+type countingStmt struct {
+	driver.Stmt
+}
+
+func (s countingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	atomic.AddInt64(&queryCount, 1)
+	return s.Stmt.Exec(args)
+}
+
+func (s countingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	atomic.AddInt64(&queryCount, 1)
+	return s.Stmt.Query(args)
+}
+
+// Open the test database through countingDriver, after testDB has migrated
+// and emptied it
+func testCountingDB(t testing.TB) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("postgres-counting", os.Getenv("TEST_DATABASE_URL"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Number of statements f runs through countingDriver
+func countQueries(f func()) int64 {
+	before := atomic.LoadInt64(&queryCount)
+	f()
+	return atomic.LoadInt64(&queryCount) - before
+}
+
+// Insert an ad and return its ID
+func testAd(t testing.TB, db *sql.DB) int {
+	t.Helper()
+
+	var id int
+	err := db.QueryRow(
+		"INSERT INTO ads (image_url, target_url, title) VALUES ($1, $2, $3) RETURNING id",
+		"https://example.com/ad.jpg", "https://example.com", "Test ad",
+	).Scan(&id)
+	require.NoError(t, err)
+	return id
+}
+
+// Logger that discards everything
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
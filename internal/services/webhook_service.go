@@ -0,0 +1,403 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// EventPublisher queues events for webhook subscribers
+type EventPublisher interface {
+	Publish(eventType string, data interface{})
+}
+
+// WebhookOptions configures delivery of webhook events
+type WebhookOptions struct {
+	MaxAttempts  int
+	BackoffBase  time.Duration
+	BackoffMax   time.Duration
+	PollInterval time.Duration
+	Timeout      time.Duration
+	BatchSize    int
+}
+
+type WebhookService struct {
+	db     *sql.DB
+	logger *logrus.Logger
+	opts   WebhookOptions
+	client *http.Client
+}
+
+// Create new webhook service
+func NewWebhookService(db *sql.DB, logger *logrus.Logger, opts WebhookOptions) *WebhookService {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 50
+	}
+	return &WebhookService{
+		db:     db,
+		logger: logger,
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+	}
+}
+
+// Create a subscription, generating a signing secret when none is given
+func (s *WebhookService) CreateSubscription(req models.WebhookSubscriptionRequest) (*models.WebhookSubscription, error) {
+	secret := req.Secret
+	if secret == "" {
+		secret = NewIdentifier() + NewIdentifier()
+	}
+
+	query := `
+		INSERT INTO webhook_subscriptions (url, event_types, secret)
+		VALUES ($1, $2, $3)
+		RETURNING id, active, created_at
+	`
+
+	subscription := models.WebhookSubscription{
+		URL:        req.URL,
+		EventTypes: req.EventTypes,
+		Secret:     secret,
+	}
+	err := s.db.QueryRow(query, req.URL, pq.Array(req.EventTypes), secret).Scan(
+		&subscription.ID,
+		&subscription.Active,
+		&subscription.CreatedAt,
+	)
+	if err != nil {
+		s.logger.Errorf("Failed to create webhook subscription: %v", err)
+		return nil, err
+	}
+
+	return &subscription, nil
+}
+
+// Get all subscriptions, without their secrets
+func (s *WebhookService) ListSubscriptions() ([]models.WebhookSubscription, error) {
+	query := `
+		SELECT id, url, event_types, active, created_at
+		FROM webhook_subscriptions
+		ORDER BY id ASC
+	`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []models.WebhookSubscription{}
+	for rows.Next() {
+		var subscription models.WebhookSubscription
+		err := rows.Scan(
+			&subscription.ID,
+			&subscription.URL,
+			pq.Array(&subscription.EventTypes),
+			&subscription.Active,
+			&subscription.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// Delete a subscription and its delivery log. Reports whether it existed.
+func (s *WebhookService) DeleteSubscription(id int) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM webhook_subscriptions WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// Get the most recent deliveries of a subscription, optionally by status
+func (s *WebhookService) ListDeliveries(subscriptionID int, status string, limit int) ([]models.WebhookDelivery, error) {
+	query := `
+		SELECT id, subscription_id, event_type, status, attempts, COALESCE(last_status_code, 0),
+			COALESCE(last_error, ''), next_attempt_at, created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE subscription_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3
+	`
+
+	rows, err := s.db.Query(query, subscriptionID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var delivery models.WebhookDelivery
+		var deliveredAt sql.NullTime
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.SubscriptionID,
+			&delivery.EventType,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.LastStatusCode,
+			&delivery.LastError,
+			&delivery.NextAttemptAt,
+			&delivery.CreatedAt,
+			&deliveredAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if deliveredAt.Valid {
+			delivery.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Move a dead delivery back to the queue. Reports whether it was dead.
+func (s *WebhookService) RetryDelivery(id int) (bool, error) {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status = $3
+	`
+	result, err := s.db.Exec(query, id, DeliveryPending, DeliveryDead)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+// Queue an event for every active subscription to its type
+func (s *WebhookService) Publish(eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		s.logger.Errorf("Failed to encode %s webhook payload: %v", eventType, err)
+		return
+	}
+
+	query := `
+		INSERT INTO webhook_deliveries (subscription_id, event_type, payload, status, next_attempt_at)
+		SELECT id, $1, $2, $3, NOW()
+		FROM webhook_subscriptions
+		WHERE active AND $1 = ANY(event_types)
+	`
+	if _, err := s.db.Exec(query, eventType, payload, DeliveryPending); err != nil {
+		s.logger.Errorf("Failed to queue %s webhook: %v", eventType, err)
+	}
+}
+
+// Deliver queued events until the context is cancelled
+func (s *WebhookService) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.opts.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			for {
+				delivered, err := s.deliverBatch(ctx)
+				if err != nil && ctx.Err() == nil {
+					s.logger.Errorf("Webhook delivery failed: %v", err)
+				}
+				// Keep draining while batches come back full
+				if err != nil || delivered < s.opts.BatchSize {
+					break
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+type queuedDelivery struct {
+	id        int
+	eventType string
+	payload   []byte
+	attempts  int
+	createdAt time.Time
+	url       string
+	secret    string
+}
+
+// Claim and deliver a batch of due events, returning how many were claimed
+func (s *WebhookService) deliverBatch(ctx context.Context) (int, error) {
+	// Claimed rows are leased by pushing their next attempt past the
+	// request timeout, so other instances skip them meanwhile
+	query := `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = NOW() + $3 * INTERVAL '1 millisecond'
+		FROM webhook_subscriptions ws
+		WHERE ws.id = d.subscription_id
+			AND d.id IN (
+				SELECT id FROM webhook_deliveries
+				WHERE status = $1 AND next_attempt_at <= NOW()
+				ORDER BY next_attempt_at ASC
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+		RETURNING d.id, d.event_type, d.payload, d.attempts, d.created_at, ws.url, ws.secret
+	`
+
+	lease := 2*s.opts.Timeout + time.Minute
+	rows, err := s.db.QueryContext(ctx, query, DeliveryPending, s.opts.BatchSize, lease.Milliseconds())
+	if err != nil {
+		return 0, err
+	}
+
+	var batch []queuedDelivery
+	for rows.Next() {
+		var d queuedDelivery
+		if err := rows.Scan(&d.id, &d.eventType, &d.payload, &d.attempts, &d.createdAt, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range batch {
+		if ctx.Err() != nil {
+			break
+		}
+		statusCode, deliverErr := s.send(ctx, d)
+		if err := s.recordAttempt(d, statusCode, deliverErr); err != nil {
+			s.logger.Errorf("Failed to record webhook delivery %d: %v", d.id, err)
+		}
+	}
+
+	return len(batch), nil
+}
+
+// POST a signed event to the subscriber
+func (s *WebhookService) send(ctx context.Context, d queuedDelivery) (int, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":         d.id,
+		"type":       d.eventType,
+		"created_at": d.createdAt.UTC(),
+		"data":       json.RawMessage(d.payload),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "video-ad-tracker-webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", d.eventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(d.id))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+SignWebhook(d.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("subscriber responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Store the outcome of an attempt, scheduling a retry or dead-lettering
+func (s *WebhookService) recordAttempt(d queuedDelivery, statusCode int, deliverErr error) error {
+	attempts := d.attempts + 1
+
+	if deliverErr == nil {
+		_, err := s.db.Exec(`
+			UPDATE webhook_deliveries
+			SET status = $2, attempts = $3, last_status_code = $4, last_error = NULL, delivered_at = NOW()
+			WHERE id = $1
+		`, d.id, DeliveryDelivered, attempts, statusCode)
+		return err
+	}
+
+	status := s.failedStatus(attempts)
+	if status == DeliveryDead {
+		s.logger.Warnf("Webhook delivery %d dead after %d attempts: %v", d.id, attempts, deliverErr)
+	}
+
+	_, err := s.db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, last_status_code = NULLIF($4, 0), last_error = $5,
+			next_attempt_at = NOW() + $6 * INTERVAL '1 millisecond'
+		WHERE id = $1
+	`, d.id, status, attempts, statusCode, deliverErr.Error(), s.backoff(attempts).Milliseconds())
+	return err
+}
+
+// Get the state of a delivery that failed its latest attempt
+func (s *WebhookService) failedStatus(attempts int) string {
+	if attempts >= s.opts.MaxAttempts {
+		return DeliveryDead
+	}
+	return DeliveryPending
+}
+
+// Exponential backoff with jitter after the given number of attempts
+func (s *WebhookService) backoff(attempts int) time.Duration {
+	delay := s.opts.BackoffBase
+	for i := 1; i < attempts && delay < s.opts.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > s.opts.BackoffMax {
+		delay = s.opts.BackoffMax
+	}
+	// Up to 10% jitter so retries from a burst spread out
+	if jitter := int64(delay / 10); jitter > 0 {
+		delay += time.Duration(rand.Int63n(jitter))
+	}
+	return delay
+}
+
+// Compute the hex HMAC-SHA256 signature of a webhook body. Subscribers
+// verify it against "<timestamp>.<body>" using their secret.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+	"video-ad-tracker/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Receiver that checks the signature of every request, hands it to inspect
+// when given and answers with status
+func signedReceiver(t *testing.T, secret string, status int, hits *int32, inspect func(r *http.Request, body []byte)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "."))
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Webhook-Signature"))
+
+		timestamp, err := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Now().Unix(), timestamp, 5)
+
+		if inspect != nil {
+			inspect(r, body)
+		}
+		w.WriteHeader(status)
+	}))
+}
+
+func TestWebhookSendSignsRequest(t *testing.T) {
+	var hits int32
+	var received map[string]interface{}
+	server := signedReceiver(t, "s3cret", http.StatusNoContent, &hits, func(r *http.Request, body []byte) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, models.EventClickRecorded, r.Header.Get("X-Webhook-Event"))
+		assert.Equal(t, "7", r.Header.Get("X-Webhook-Delivery"))
+		assert.NoError(t, json.Unmarshal(body, &received))
+	})
+	defer server.Close()
+
+	s := NewWebhookService(nil, testLogger(), WebhookOptions{Timeout: time.Second})
+	status, err := s.send(context.Background(), queuedDelivery{
+		id:        7,
+		eventType: models.EventClickRecorded,
+		payload:   []byte(`{"ad_id":1}`),
+		createdAt: time.Now(),
+		url:       server.URL,
+		secret:    "s3cret",
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, int32(1), hits)
+	assert.Equal(t, float64(7), received["id"])
+	assert.Equal(t, models.EventClickRecorded, received["type"])
+	assert.Equal(t, map[string]interface{}{"ad_id": float64(1)}, received["data"])
+}
+
+func TestWebhookSendFailsOnServerError(t *testing.T) {
+	var hits int32
+	server := signedReceiver(t, "s3cret", http.StatusServiceUnavailable, &hits, nil)
+	defer server.Close()
+
+	s := NewWebhookService(nil, testLogger(), WebhookOptions{Timeout: time.Second})
+	status, err := s.send(context.Background(), queuedDelivery{
+		id:        1,
+		eventType: models.EventClickRecorded,
+		payload:   []byte(`{}`),
+		url:       server.URL,
+		secret:    "s3cret",
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	s := NewWebhookService(nil, testLogger(), WebhookOptions{
+		BackoffBase: time.Second,
+		BackoffMax:  30 * time.Second,
+	})
+
+	tests := []struct {
+		attempts int
+		base     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second},
+		{20, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		delay := s.backoff(tt.attempts)
+		assert.GreaterOrEqual(t, delay, tt.base, "attempt %d", tt.attempts)
+		assert.Less(t, delay, tt.base+tt.base/10, "attempt %d", tt.attempts)
+	}
+}
+
+func TestWebhookFailedStatus(t *testing.T) {
+	s := NewWebhookService(nil, testLogger(), WebhookOptions{MaxAttempts: 3})
+
+	assert.Equal(t, DeliveryPending, s.failedStatus(1))
+	assert.Equal(t, DeliveryPending, s.failedStatus(2))
+	assert.Equal(t, DeliveryDead, s.failedStatus(3))
+}
+
+// Deliver every due event until none are left pending, waiting out backoffs
+func drainWebhooks(t *testing.T, s *WebhookService, db *sql.DB) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err := s.deliverBatch(context.Background())
+		require.NoError(t, err)
+
+		var pending int
+		require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE status = $1", DeliveryPending).Scan(&pending))
+		if pending == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("webhook deliveries still pending")
+}
+
+func TestWebhookDeliveryRetriesUntilDead(t *testing.T) {
+	db := testDB(t)
+
+	var hits int32
+	server := signedReceiver(t, "s3cret", http.StatusInternalServerError, &hits, nil)
+	defer server.Close()
+
+	s := NewWebhookService(db, testLogger(), WebhookOptions{
+		MaxAttempts: 3,
+		BackoffBase: time.Millisecond,
+		BackoffMax:  10 * time.Millisecond,
+		Timeout:     time.Second,
+	})
+	_, err := s.CreateSubscription(models.WebhookSubscriptionRequest{
+		URL:        server.URL,
+		EventTypes: []string{models.EventClickRecorded},
+		Secret:     "s3cret",
+	})
+	require.NoError(t, err)
+
+	s.Publish(models.EventClickRecorded, map[string]int{"ad_id": 1})
+	drainWebhooks(t, s, db)
+
+	deliveries, err := s.ListDeliveries(1, "", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, DeliveryDead, deliveries[0].Status)
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].LastStatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	// A requeued delivery starts over
+	retried, err := s.RetryDelivery(deliveries[0].ID)
+	require.NoError(t, err)
+	assert.True(t, retried)
+}
+
+func TestWebhookDeliverySucceeds(t *testing.T) {
+	db := testDB(t)
+
+	var hits int32
+	server := signedReceiver(t, "s3cret", http.StatusOK, &hits, nil)
+	defer server.Close()
+
+	s := NewWebhookService(db, testLogger(), WebhookOptions{
+		MaxAttempts: 3,
+		BackoffBase: time.Millisecond,
+		BackoffMax:  10 * time.Millisecond,
+		Timeout:     time.Second,
+	})
+	_, err := s.CreateSubscription(models.WebhookSubscriptionRequest{
+		URL:        server.URL,
+		EventTypes: []string{models.EventClickRecorded},
+		Secret:     "s3cret",
+	})
+	require.NoError(t, err)
+
+	s.Publish(models.EventClickRecorded, map[string]int{"ad_id": 1})
+	s.Publish(models.EventConversionRecorded, map[string]int{"ad_id": 1}) // Not subscribed
+	drainWebhooks(t, s, db)
+
+	deliveries, err := s.ListDeliveries(1, "", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, DeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.NotNil(t, deliveries[0].DeliveredAt)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
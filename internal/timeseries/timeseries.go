@@ -0,0 +1,79 @@
+package timeseries
+
+import (
+	"errors"
+	"time"
+)
+
+// Bucket widths accepted for time series
+const (
+	Minute = "minute"
+	Hour   = "hour"
+	Day    = "day"
+	Week   = "week"
+	Month  = "month"
+)
+
+// Most buckets a single series may have
+const MaxBuckets = 1000
+
+var ErrTooManyBuckets = errors.New("time range has too many buckets")
+
+// Check whether a granularity is supported
+func Valid(granularity string) bool {
+	switch granularity {
+	case Minute, Hour, Day, Week, Month:
+		return true
+	}
+	return false
+}
+
+// Get the start of the bucket containing t, in t's location. Weeks start on
+// Monday, matching date_trunc in Postgres. Minutes and hours are cut off
+// the instant rather than rebuilt from the date, so the repeated hour at
+// the end of daylight saving time stays a bucket of its own.
+func Truncate(granularity string, t time.Time) time.Time {
+	sinceMinute := time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	switch granularity {
+	case Minute:
+		return t.Add(-sinceMinute)
+	case Hour:
+		return t.Add(-time.Duration(t.Minute())*time.Minute - sinceMinute)
+	case Week:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location())
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+}
+
+// Get the start of the bucket following the one starting at start
+func Next(granularity string, start time.Time) time.Time {
+	switch granularity {
+	case Minute:
+		return start.Add(time.Minute)
+	case Hour:
+		return start.Add(time.Hour)
+	case Week:
+		return start.AddDate(0, 0, 7)
+	case Month:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// List the starts of all buckets overlapping [from, to), failing once there
+// are more than max of them
+func Buckets(granularity string, from, to time.Time, max int) ([]time.Time, error) {
+	var buckets []time.Time
+	for bucket := Truncate(granularity, from); bucket.Before(to); bucket = Next(granularity, bucket) {
+		if len(buckets) == max {
+			return nil, ErrTooManyBuckets
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
@@ -0,0 +1,113 @@
+package useragent
+
+import "strings"
+
+// Value reported when a dimension cannot be determined
+const Unknown = "unknown"
+
+// Device types
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceTV      = "tv"
+	DeviceBot     = "bot"
+)
+
+// Info holds the coarse dimensions derived from a user agent
+type Info struct {
+	DeviceType string
+	OS         string
+	Browser    string
+}
+
+// Substrings marking automated clients
+var botMarkers = []string{"bot", "crawler", "spider", "slurp", "headless", "curl/", "wget/", "python-requests", "go-http-client"}
+
+// Substrings marking TV platforms
+var tvMarkers = []string{"smart-tv", "smarttv", "appletv", "googletv", "hbbtv", "roku", "crkey", "aftb", "aftt", "bravia"}
+
+// Parse a user agent string into device type, OS and browser. Only the
+// coarse family is kept, never versions.
+func Parse(userAgent string) Info {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+	if ua == "" {
+		return Info{DeviceType: Unknown, OS: Unknown, Browser: Unknown}
+	}
+
+	return Info{
+		DeviceType: deviceType(ua),
+		OS:         operatingSystem(ua),
+		Browser:    browser(ua),
+	}
+}
+
+func deviceType(ua string) string {
+	switch {
+	case containsAny(ua, botMarkers):
+		return DeviceBot
+	case containsAny(ua, tvMarkers):
+		return DeviceTV
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet"):
+		return DeviceTablet
+	// Android tablets leave out "mobile"
+	case strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") || strings.Contains(ua, "ipod") || strings.Contains(ua, "windows phone"):
+		return DeviceMobile
+	default:
+		return DeviceDesktop
+	}
+}
+
+func operatingSystem(ua string) string {
+	switch {
+	case strings.Contains(ua, "windows phone"):
+		return "windows_phone"
+	case strings.Contains(ua, "windows"):
+		return "windows"
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad") || strings.Contains(ua, "ipod"):
+		return "ios"
+	case strings.Contains(ua, "cros "):
+		return "chromeos"
+	case strings.Contains(ua, "android"):
+		return "android"
+	case strings.Contains(ua, "mac os x") || strings.Contains(ua, "macintosh"):
+		return "macos"
+	case strings.Contains(ua, "linux"):
+		return "linux"
+	default:
+		return "other"
+	}
+}
+
+// Checked in order, as most browsers also claim to be Chrome or Safari
+func browser(ua string) string {
+	switch {
+	case containsAny(ua, []string{"edg/", "edge/", "edga/", "edgios/"}):
+		return "edge"
+	case strings.Contains(ua, "opr/") || strings.Contains(ua, "opera"):
+		return "opera"
+	case strings.Contains(ua, "samsungbrowser"):
+		return "samsung"
+	case strings.Contains(ua, "firefox") || strings.Contains(ua, "fxios"):
+		return "firefox"
+	case strings.Contains(ua, "crios") || strings.Contains(ua, "chrome") || strings.Contains(ua, "chromium"):
+		return "chrome"
+	case strings.Contains(ua, "msie") || strings.Contains(ua, "trident/"):
+		return "ie"
+	case strings.Contains(ua, "safari"):
+		return "safari"
+	default:
+		return "other"
+	}
+}
+
+func containsAny(s string, substrings []string) bool {
+	for _, sub := range substrings {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
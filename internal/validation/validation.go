@@ -0,0 +1,673 @@
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"video-ad-tracker/internal/cron"
+	"video-ad-tracker/internal/export"
+	"video-ad-tracker/internal/forecast"
+	"video-ad-tracker/internal/models"
+	"video-ad-tracker/internal/timeseries"
+)
+
+// Limits applied to click requests
+const (
+	MaxRequestBytes       = 16 << 10
+	MaxPlaybackTime       = 6 * 60 * 60 // Seconds, longer than any ad we serve
+	MaxUserAgentLength    = 512
+	MaxConsentLength      = 4096
+	MaxIdentifierLength   = 128
+	MaxConversionValue    = 1e9
+	MaxWebhookURLLength   = 2000
+	MinWebhookSecret      = 16
+	consentStringAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_."
+	identifierAlphabet    = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.:"
+)
+
+// Limits applied to analytics queries
+const (
+	DefaultTimeFrame   = "24h"
+	MaxFilterValues    = 20
+	MaxStreamAds       = 100
+	DefaultTopLimit    = 10
+	MaxTopLimit        = 100
+	MaxDimensionLength = 16
+	CustomTimeFrame    = "custom"
+)
+
+// Limits applied to forecasts, in days except for the number of ads.
+// Every ad is fitted hundreds of times while the request waits, so
+// forecasts name their ads and only a few at a time.
+const (
+	MaxForecastAds          = 10
+	DefaultForecastDays     = 7
+	MaxForecastDays         = 90
+	DefaultForecastHistory  = 56
+	MaxForecastHistory      = 365
+	DefaultForecastInterval = 95
+)
+
+// Limits applied to scheduled reports
+const (
+	MaxReportNameLength  = 200
+	MaxReportQueryLength = 2000
+	MaxReportRecipients  = 20
+	MaxScheduleLength    = 100
+)
+
+// Limits applied to anomaly queries
+const (
+	DefaultAnomalyLookback = 7 * 24 * time.Hour
+	DefaultAnomalyLimit    = 100
+	MaxAnomalyLimit        = 1000
+)
+
+// Preset analytics windows, ending now
+var TimeFrames = map[string]time.Duration{
+	"15m": 15 * time.Minute,
+	"30m": 30 * time.Minute,
+	"1h":  time.Hour,
+	"6h":  6 * time.Hour,
+	"12h": 12 * time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// Error codes returned in field errors
+const (
+	CodeRequired     = "required"
+	CodeInvalidType  = "invalid_type"
+	CodeOutOfRange   = "out_of_range"
+	CodeTooLong      = "too_long"
+	CodeInvalid      = "invalid"
+	CodeUnknownField = "unknown_field"
+	CodeMalformed    = "malformed"
+)
+
+// Decode a JSON body into v, rejecting unknown fields, trailing data and
+// type mismatches with field-level errors
+func DecodeStrict(body io.Reader, v interface{}) []models.FieldError {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return []models.FieldError{decodeError(err)}
+	}
+	if decoder.More() {
+		return []models.FieldError{{Code: CodeMalformed, Message: "request body must contain a single JSON object"}}
+	}
+	return nil
+}
+
+// Map a decoding error to a field error
+func decodeError(err error) models.FieldError {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &typeErr):
+		return models.FieldError{
+			Field:   typeErr.Field,
+			Code:    CodeInvalidType,
+			Message: fmt.Sprintf("must be of type %s", typeErr.Type),
+		}
+	case errors.As(err, &syntaxErr):
+		return models.FieldError{Code: CodeMalformed, Message: fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)}
+	case errors.Is(err, io.EOF):
+		return models.FieldError{Code: CodeRequired, Message: "request body is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return models.FieldError{Code: CodeMalformed, Message: "request body is truncated"}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return models.FieldError{Field: field, Code: CodeUnknownField, Message: "unknown field"}
+	case errors.As(err, &maxBytesErr):
+		return models.FieldError{Code: CodeTooLong, Message: fmt.Sprintf("request body must be at most %d bytes", maxBytesErr.Limit)}
+	default:
+		return models.FieldError{Code: CodeMalformed, Message: err.Error()}
+	}
+}
+
+// Validate a click request against bounds and length rules
+func Click(req models.ClickRequest) []models.FieldError {
+	var errs []models.FieldError
+
+	if req.AdID == 0 {
+		errs = append(errs, models.FieldError{Field: "ad_id", Code: CodeRequired, Message: "is required"})
+	} else if req.AdID < 0 {
+		errs = append(errs, models.FieldError{Field: "ad_id", Code: CodeOutOfRange, Message: "must be a positive integer"})
+	}
+
+	if math.IsNaN(req.VideoPlaybackTime) || req.VideoPlaybackTime < 0 || req.VideoPlaybackTime > MaxPlaybackTime {
+		errs = append(errs, models.FieldError{
+			Field:   "video_playback_time",
+			Code:    CodeOutOfRange,
+			Message: fmt.Sprintf("must be between 0 and %d seconds", MaxPlaybackTime),
+		})
+	}
+
+	if req.IPAddress != "" && net.ParseIP(req.IPAddress) == nil {
+		errs = append(errs, models.FieldError{Field: "ip_address", Code: CodeInvalid, Message: "must be an IPv4 or IPv6 address"})
+	}
+
+	if len(req.UserAgent) > MaxUserAgentLength {
+		errs = append(errs, models.FieldError{
+			Field:   "user_agent",
+			Code:    CodeTooLong,
+			Message: fmt.Sprintf("must be at most %d bytes", MaxUserAgentLength),
+		})
+	}
+
+	if req.GDPR != nil && *req.GDPR != 0 && *req.GDPR != 1 {
+		errs = append(errs, models.FieldError{Field: "gdpr", Code: CodeOutOfRange, Message: "must be 0 or 1"})
+	}
+
+	if len(req.ConsentString) > MaxConsentLength {
+		errs = append(errs, models.FieldError{
+			Field:   "gdpr_consent",
+			Code:    CodeTooLong,
+			Message: fmt.Sprintf("must be at most %d bytes", MaxConsentLength),
+		})
+	} else if strings.Trim(req.ConsentString, consentStringAlphabet) != "" {
+		errs = append(errs, models.FieldError{Field: "gdpr_consent", Code: CodeInvalid, Message: "must be a base64url encoded consent string"})
+	}
+
+	if req.DeviceID != "" && !IsIdentifier(req.DeviceID) {
+		errs = append(errs, models.FieldError{
+			Field:   "device_id",
+			Code:    CodeInvalid,
+			Message: fmt.Sprintf("must be at most %d letters, digits or -_.: characters", MaxIdentifierLength),
+		})
+	}
+
+	return errs
+}
+
+// Validate a conversion postback
+func Conversion(req models.ConversionRequest) []models.FieldError {
+	var errs []models.FieldError
+
+	switch {
+	case req.ClickID == "" && req.ViewerID == "":
+		errs = append(errs, models.FieldError{Field: "click_id", Code: CodeRequired, Message: "click_id or viewer_id is required"})
+	case req.ClickID != "" && req.ViewerID != "":
+		errs = append(errs, models.FieldError{Field: "viewer_id", Code: CodeInvalid, Message: "only one of click_id and viewer_id may be given"})
+	}
+
+	identifiers := []struct{ field, value string }{
+		{"conversion_id", req.ConversionID},
+		{"click_id", req.ClickID},
+		{"viewer_id", req.ViewerID},
+	}
+	for _, id := range identifiers {
+		if id.value != "" && !IsIdentifier(id.value) {
+			errs = append(errs, models.FieldError{
+				Field:   id.field,
+				Code:    CodeInvalid,
+				Message: fmt.Sprintf("must be at most %d letters, digits or -_.: characters", MaxIdentifierLength),
+			})
+		}
+	}
+
+	if math.IsNaN(req.Value) || req.Value < 0 || req.Value > MaxConversionValue {
+		errs = append(errs, models.FieldError{
+			Field:   "value",
+			Code:    CodeOutOfRange,
+			Message: fmt.Sprintf("must be between 0 and %.0f", float64(MaxConversionValue)),
+		})
+	}
+
+	return errs
+}
+
+// Validate a webhook subscription
+func WebhookSubscription(req models.WebhookSubscriptionRequest) []models.FieldError {
+	var errs []models.FieldError
+
+	if req.URL == "" {
+		errs = append(errs, models.FieldError{Field: "url", Code: CodeRequired, Message: "is required"})
+	} else if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, models.FieldError{Field: "url", Code: CodeInvalid, Message: "must be an absolute http or https URL"})
+	} else if len(req.URL) > MaxWebhookURLLength {
+		errs = append(errs, models.FieldError{
+			Field:   "url",
+			Code:    CodeTooLong,
+			Message: fmt.Sprintf("must be at most %d bytes", MaxWebhookURLLength),
+		})
+	}
+
+	if len(req.EventTypes) == 0 {
+		errs = append(errs, models.FieldError{Field: "event_types", Code: CodeRequired, Message: "at least one event type is required"})
+	}
+	for _, eventType := range req.EventTypes {
+		if eventType != models.EventClickRecorded && eventType != models.EventConversionRecorded && eventType != models.EventAnomalyDetected {
+			errs = append(errs, models.FieldError{
+				Field:   "event_types",
+				Code:    CodeInvalid,
+				Message: fmt.Sprintf("unknown event type %q", eventType),
+			})
+		}
+	}
+
+	if req.Secret != "" && (len(req.Secret) < MinWebhookSecret || len(req.Secret) > MaxIdentifierLength) {
+		errs = append(errs, models.FieldError{
+			Field:   "secret",
+			Code:    CodeInvalid,
+			Message: fmt.Sprintf("must be between %d and %d bytes", MinWebhookSecret, MaxIdentifierLength),
+		})
+	}
+
+	return errs
+}
+
+// Validate a scheduled report. The query is checked like a request to
+// /ads/analytics/export, with its errors reported under query.<field>.
+func Report(req models.ReportRequest, now time.Time) []models.FieldError {
+	var errs []models.FieldError
+
+	if strings.TrimSpace(req.Name) == "" {
+		errs = append(errs, models.FieldError{Field: "name", Code: CodeRequired, Message: "is required"})
+	} else if len(req.Name) > MaxReportNameLength {
+		errs = append(errs, models.FieldError{Field: "name", Code: CodeTooLong, Message: fmt.Sprintf("must be at most %d bytes", MaxReportNameLength)})
+	}
+
+	if len(req.Query) > MaxReportQueryLength {
+		errs = append(errs, models.FieldError{Field: "query", Code: CodeTooLong, Message: fmt.Sprintf("must be at most %d bytes", MaxReportQueryLength)})
+	} else if values, err := url.ParseQuery(req.Query); err != nil {
+		errs = append(errs, models.FieldError{Field: "query", Code: CodeMalformed, Message: "must be a URL query string"})
+	} else {
+		query, queryErrors := AnalyticsQuery(values, now)
+		if query.Compare != "" {
+			queryErrors = append(queryErrors, models.FieldError{Field: "compare", Code: CodeInvalid, Message: "is not supported for exports"})
+		}
+		for _, e := range queryErrors {
+			e.Field = "query." + e.Field
+			errs = append(errs, e)
+		}
+	}
+
+	if _, formatErrors := ExportFormat(req.Format); formatErrors != nil {
+		errs = append(errs, formatErrors...)
+	}
+
+	switch req.Delivery {
+	case models.ReportDeliveryEmail:
+		if len(req.Recipients) == 0 {
+			errs = append(errs, models.FieldError{Field: "recipients", Code: CodeRequired, Message: "at least one recipient is required for email delivery"})
+		} else if len(req.Recipients) > MaxReportRecipients {
+			errs = append(errs, models.FieldError{Field: "recipients", Code: CodeTooLong, Message: fmt.Sprintf("must list at most %d recipients", MaxReportRecipients)})
+		}
+		for _, recipient := range req.Recipients {
+			if address, err := mail.ParseAddress(recipient); err != nil || address.Name != "" {
+				errs = append(errs, models.FieldError{Field: "recipients", Code: CodeInvalid, Message: fmt.Sprintf("%q is not an email address", recipient)})
+			}
+		}
+	case models.ReportDeliveryDirectory:
+		if len(req.Recipients) > 0 {
+			errs = append(errs, models.FieldError{Field: "recipients", Code: CodeInvalid, Message: "are only used for email delivery"})
+		}
+	case "":
+		errs = append(errs, models.FieldError{Field: "delivery", Code: CodeRequired, Message: "is required"})
+	default:
+		errs = append(errs, models.FieldError{Field: "delivery", Code: CodeInvalid, Message: "must be email or directory"})
+	}
+
+	if req.Schedule == "" {
+		errs = append(errs, models.FieldError{Field: "schedule", Code: CodeRequired, Message: "is required"})
+	} else if len(req.Schedule) > MaxScheduleLength {
+		errs = append(errs, models.FieldError{Field: "schedule", Code: CodeTooLong, Message: fmt.Sprintf("must be at most %d bytes", MaxScheduleLength)})
+	} else if schedule, err := cron.Parse(req.Schedule); err != nil {
+		errs = append(errs, models.FieldError{Field: "schedule", Code: CodeInvalid, Message: err.Error()})
+	} else if schedule.Next(now).IsZero() {
+		errs = append(errs, models.FieldError{Field: "schedule", Code: CodeInvalid, Message: "never fires"})
+	}
+
+	return errs
+}
+
+// Check that a viewer or device identifier is safe to store
+func IsIdentifier(value string) bool {
+	return value != "" && len(value) <= MaxIdentifierLength && strings.Trim(value, identifierAlphabet) == ""
+}
+
+// Validate the window and granularity of an analytics request. A preset
+// timeframe and explicit from/to bounds are mutually exclusive.
+func AnalyticsQuery(values url.Values, now time.Time) (models.AnalyticsQuery, []models.FieldError) {
+	var errs []models.FieldError
+	query := models.AnalyticsQuery{
+		TimeFrame:   values.Get("timeframe"),
+		Granularity: values.Get("granularity"),
+	}
+
+	custom := values.Get("from") != "" || values.Get("to") != ""
+	switch {
+	case custom && query.TimeFrame != "":
+		errs = append(errs, models.FieldError{Field: "timeframe", Code: CodeInvalid, Message: "cannot be combined with from or to"})
+	case custom:
+		query.TimeFrame = CustomTimeFrame
+		query.To = now
+		for _, bound := range []struct {
+			field string
+			value *time.Time
+		}{{"from", &query.From}, {"to", &query.To}} {
+			raw := values.Get(bound.field)
+			if raw == "" {
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				errs = append(errs, models.FieldError{Field: bound.field, Code: CodeMalformed, Message: "must be an RFC3339 timestamp"})
+				continue
+			}
+			*bound.value = parsed
+		}
+		if values.Get("from") == "" {
+			query.From = query.To.Add(-TimeFrames[DefaultTimeFrame])
+		}
+		if len(errs) == 0 && !query.From.Before(query.To) {
+			errs = append(errs, models.FieldError{Field: "from", Code: CodeOutOfRange, Message: "must be before to"})
+		}
+	default:
+		if query.TimeFrame == "" {
+			query.TimeFrame = DefaultTimeFrame
+		}
+		window, ok := TimeFrames[query.TimeFrame]
+		if !ok {
+			errs = append(errs, models.FieldError{Field: "timeframe", Code: CodeInvalid, Message: "must be one of 15m, 30m, 1h, 6h, 12h, 24h, 7d or 30d"})
+		}
+		query.From = now.Add(-window)
+		query.To = now
+	}
+
+	query.GroupBy, query.Filters = dimensions(values, &errs)
+
+	compare, compareErrs := Compare(values.Get("compare"))
+	errs = append(errs, compareErrs...)
+	query.Compare = compare
+
+	location, tzErrs := TimeZone(values.Get("tz"))
+	errs = append(errs, tzErrs...)
+	query.Location = location
+
+	if query.Granularity != "" {
+		if !timeseries.Valid(query.Granularity) {
+			errs = append(errs, models.FieldError{Field: "granularity", Code: CodeInvalid, Message: "must be one of minute, hour, day, week or month"})
+		} else if len(errs) == 0 {
+			_, err := timeseries.Buckets(query.Granularity, query.From.In(query.Location), query.To.In(query.Location), timeseries.MaxBuckets)
+			if err != nil {
+				errs = append(errs, models.FieldError{
+					Field:   "granularity",
+					Code:    CodeOutOfRange,
+					Message: fmt.Sprintf("range would have more than %d buckets, use a coarser granularity", timeseries.MaxBuckets),
+				})
+			}
+		}
+	}
+
+	return query, errs
+}
+
+// Resolve the IANA time zone buckets and labels are reported in, UTC when
+// none is given
+func TimeZone(name string) (*time.Location, []models.FieldError) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		return time.UTC, []models.FieldError{{Field: "tz", Code: CodeInvalid, Message: "must be an IANA time zone name such as Europe/Berlin"}}
+	}
+	return location, nil
+}
+
+// Parse group_by, a comma separated list of dimensions, and filter, comma
+// separated dimension:value pairs. Values of one dimension are alternatives.
+func dimensions(values url.Values, errs *[]models.FieldError) ([]string, map[string][]string) {
+	known := map[string]bool{}
+	for _, dimension := range models.AnalyticsDimensions {
+		known[dimension] = true
+	}
+	dimensionList := strings.Join(models.AnalyticsDimensions, ", ")
+
+	var groupBy []string
+	seen := map[string]bool{}
+	if raw := values.Get("group_by"); raw != "" {
+		for _, dimension := range strings.Split(raw, ",") {
+			dimension = strings.TrimSpace(dimension)
+			switch {
+			case !known[dimension]:
+				*errs = append(*errs, models.FieldError{Field: "group_by", Code: CodeInvalid, Message: fmt.Sprintf("unknown dimension %q, use %s", dimension, dimensionList)})
+			case seen[dimension]:
+				*errs = append(*errs, models.FieldError{Field: "group_by", Code: CodeInvalid, Message: fmt.Sprintf("dimension %q is listed twice", dimension)})
+			default:
+				seen[dimension] = true
+				groupBy = append(groupBy, dimension)
+			}
+		}
+	}
+
+	var filters map[string][]string
+	if raw := values.Get("filter"); raw != "" {
+		pairs := strings.Split(raw, ",")
+		if len(pairs) > MaxFilterValues {
+			*errs = append(*errs, models.FieldError{Field: "filter", Code: CodeTooLong, Message: fmt.Sprintf("must have at most %d values", MaxFilterValues)})
+			return groupBy, nil
+		}
+
+		filters = map[string][]string{}
+		for _, pair := range pairs {
+			dimension, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			switch {
+			case !ok || value == "":
+				*errs = append(*errs, models.FieldError{Field: "filter", Code: CodeMalformed, Message: "must be dimension:value pairs separated by commas"})
+			case !known[dimension]:
+				*errs = append(*errs, models.FieldError{Field: "filter", Code: CodeInvalid, Message: fmt.Sprintf("unknown dimension %q, use %s", dimension, dimensionList)})
+			case len(value) > MaxDimensionLength:
+				*errs = append(*errs, models.FieldError{Field: "filter", Code: CodeTooLong, Message: fmt.Sprintf("values must be at most %d bytes", MaxDimensionLength)})
+			default:
+				// Countries are stored as upper case codes, everything else lower case
+				value = strings.ToLower(value)
+				if dimension == "country" && value != "unknown" {
+					value = strings.ToUpper(value)
+				}
+				filters[dimension] = append(filters[dimension], value)
+			}
+		}
+	}
+
+	return groupBy, filters
+}
+
+// Check the earlier window analytics are compared against, if any
+func Compare(mode string) (string, []models.FieldError) {
+	switch mode {
+	case "", models.ComparePreviousPeriod, models.ComparePreviousYear:
+		return mode, nil
+	}
+	return "", []models.FieldError{{Field: "compare", Code: CodeInvalid, Message: "must be previous_period or previous_year"}}
+}
+
+// Check an export format, defaulting to CSV
+func ExportFormat(format string) (string, []models.FieldError) {
+	if format == "" {
+		return export.CSV, nil
+	}
+	if !export.Valid(format) {
+		return "", []models.FieldError{{Field: "format", Code: CodeInvalid, Message: "must be csv, ndjson or xlsx"}}
+	}
+	return format, nil
+}
+
+// Parse a comma separated list of ad IDs, empty meaning all ads
+func AdIDs(raw string) ([]int, []models.FieldError) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(raw, ",")
+	if len(parts) > MaxStreamAds {
+		return nil, []models.FieldError{{Field: "ad_id", Code: CodeTooLong, Message: fmt.Sprintf("must list at most %d ads", MaxStreamAds)}}
+	}
+
+	var adIDs []int
+	for _, part := range parts {
+		adID, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || adID <= 0 {
+			return nil, []models.FieldError{{Field: "ad_id", Code: CodeInvalid, Message: "must be a comma separated list of positive integers"}}
+		}
+		adIDs = append(adIDs, adID)
+	}
+	return adIDs, nil
+}
+
+// Validate a leaderboard request
+func LeaderboardQuery(values url.Values, now time.Time) (models.LeaderboardQuery, []models.FieldError) {
+	var errs []models.FieldError
+	query := models.LeaderboardQuery{
+		Mode:   values.Get("mode"),
+		Metric: values.Get("metric"),
+		Window: values.Get("window"),
+		Limit:  DefaultTopLimit,
+	}
+
+	if query.Mode == "" {
+		query.Mode = models.LeaderboardTop
+	}
+	switch query.Mode {
+	case models.LeaderboardTop:
+		if query.Metric == "" {
+			query.Metric = models.MetricClicks
+		}
+		if query.Metric != models.MetricClicks && query.Metric != models.MetricCTR && query.Metric != models.MetricPlayback {
+			errs = append(errs, models.FieldError{Field: "metric", Code: CodeInvalid, Message: "must be clicks, ctr or playback"})
+		}
+	case models.LeaderboardTrending:
+		// Trends are measured in clicks
+		if query.Metric != "" && query.Metric != models.MetricClicks {
+			errs = append(errs, models.FieldError{Field: "metric", Code: CodeInvalid, Message: "trending ranks by clicks only"})
+		}
+		query.Metric = models.MetricClicks
+	default:
+		errs = append(errs, models.FieldError{Field: "mode", Code: CodeInvalid, Message: "must be top or trending"})
+	}
+
+	if query.Window == "" {
+		query.Window = "1h"
+	}
+	window, ok := TimeFrames[query.Window]
+	if !ok {
+		errs = append(errs, models.FieldError{Field: "window", Code: CodeInvalid, Message: "must be one of 15m, 30m, 1h, 6h, 12h, 24h, 7d or 30d"})
+	}
+	query.From = now.Add(-window)
+	query.To = now
+
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MaxTopLimit {
+			errs = append(errs, models.FieldError{Field: "limit", Code: CodeOutOfRange, Message: fmt.Sprintf("must be between 1 and %d", MaxTopLimit)})
+		} else {
+			query.Limit = limit
+		}
+	}
+
+	return query, errs
+}
+
+// Validate a forecast request
+func ForecastQuery(values url.Values) (models.ForecastQuery, []models.FieldError) {
+	query := models.ForecastQuery{
+		Days:     DefaultForecastDays,
+		History:  DefaultForecastHistory,
+		Interval: DefaultForecastInterval,
+	}
+
+	adIDs, errs := AdIDs(values.Get("ad_id"))
+	switch {
+	case len(errs) > 0:
+	case len(adIDs) == 0:
+		errs = append(errs, models.FieldError{Field: "ad_id", Code: CodeRequired, Message: "must list the ads to forecast"})
+	case len(adIDs) > MaxForecastAds:
+		errs = append(errs, models.FieldError{Field: "ad_id", Code: CodeTooLong, Message: fmt.Sprintf("must list at most %d ads", MaxForecastAds)})
+	default:
+		query.AdIDs = adIDs
+	}
+
+	if raw := values.Get("days"); raw != "" {
+		days, err := strconv.Atoi(raw)
+		if err != nil || days < 1 || days > MaxForecastDays {
+			errs = append(errs, models.FieldError{Field: "days", Code: CodeOutOfRange, Message: fmt.Sprintf("must be between 1 and %d", MaxForecastDays)})
+		} else {
+			query.Days = days
+		}
+	}
+
+	if raw := values.Get("history"); raw != "" {
+		history, err := strconv.Atoi(raw)
+		if err != nil || history < 1 || history > MaxForecastHistory {
+			errs = append(errs, models.FieldError{Field: "history", Code: CodeOutOfRange, Message: fmt.Sprintf("must be between 1 and %d", MaxForecastHistory)})
+		} else {
+			query.History = history
+		}
+	}
+
+	if raw := values.Get("interval"); raw != "" {
+		interval, err := strconv.Atoi(raw)
+		if _, ok := forecast.Quantiles[interval]; err != nil || !ok {
+			errs = append(errs, models.FieldError{Field: "interval", Code: CodeInvalid, Message: "must be 80, 90, 95 or 99"})
+		} else {
+			query.Interval = interval
+		}
+	}
+
+	return query, errs
+}
+
+// Parse the filters of an anomaly listing. Without since, anomalies of the
+// last week are listed.
+func AnomalyQuery(values url.Values, now time.Time) (models.AnomalyQuery, []models.FieldError) {
+	var errs []models.FieldError
+	query := models.AnomalyQuery{
+		Since: now.Add(-DefaultAnomalyLookback),
+		Limit: DefaultAnomalyLimit,
+	}
+
+	if raw := values.Get("ad_id"); raw != "" {
+		adID, err := strconv.Atoi(raw)
+		if err != nil || adID < 1 {
+			errs = append(errs, models.FieldError{Field: "ad_id", Code: CodeInvalid, Message: "must be a positive integer"})
+		} else {
+			query.AdID = adID
+		}
+	}
+
+	if raw := values.Get("since"); raw != "" {
+		since, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			errs = append(errs, models.FieldError{Field: "since", Code: CodeMalformed, Message: "must be an RFC3339 timestamp"})
+		} else {
+			query.Since = since
+		}
+	}
+
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MaxAnomalyLimit {
+			errs = append(errs, models.FieldError{Field: "limit", Code: CodeOutOfRange, Message: fmt.Sprintf("must be between 1 and %d", MaxAnomalyLimit)})
+		} else {
+			query.Limit = limit
+		}
+	}
+
+	return query, errs
+}
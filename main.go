@@ -7,11 +7,15 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // Time zones for the tz parameter on images without them
 
+	"video-ad-tracker/internal/clientip"
 	"video-ad-tracker/internal/config"
 	"video-ad-tracker/internal/database"
+	"video-ad-tracker/internal/geoip"
 	"video-ad-tracker/internal/handlers"
 	"video-ad-tracker/internal/middleware"
+	"video-ad-tracker/internal/privacy"
 	"video-ad-tracker/internal/services"
 
 	"github.com/gin-gonic/gin"
@@ -34,19 +38,102 @@ func main() {
 	}
 	defer db.Close()
 
+	// Setup privacy handling of stored click data
+	anonymizer, err := privacy.NewAnonymizer(privacy.Options{
+		IPMode:        privacy.Mode(cfg.PrivacyIPMode),
+		UserAgentMode: privacy.Mode(cfg.PrivacyUserAgentMode),
+		IPv4Prefix:    cfg.PrivacyIPv4Prefix,
+		IPv6Prefix:    cfg.PrivacyIPv6Prefix,
+	}, privacy.NewSaltStore(db))
+	if err != nil {
+		logger.Fatalf("Invalid privacy configuration: %v", err)
+	}
+
+	// Load the country database, clicks report an unknown country without one
+	var geo *geoip.DB
+	if len(cfg.GeoIPFiles) > 0 {
+		if geo, err = geoip.Load(cfg.GeoIPFiles...); err != nil {
+			logger.Fatalf("Failed to load GeoIP file: %v", err)
+		}
+	}
+
+	// Setup data retention
+	retentionService := services.NewRetentionService(db, logger, retentionPolicies(cfg), cfg.RetentionBatchSize, cfg.RetentionBatchPause)
+
+	// Run one-off commands instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:], retentionService); err != nil {
+			logger.Fatalf("Command %s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	// Initialize services
+	webhookService := services.NewWebhookService(db, logger, services.WebhookOptions{
+		MaxAttempts:  cfg.WebhookMaxAttempts,
+		BackoffBase:  cfg.WebhookBackoffBase,
+		BackoffMax:   cfg.WebhookBackoffMax,
+		PollInterval: cfg.WebhookPollInterval,
+		Timeout:      cfg.WebhookTimeout,
+	})
 	adService := services.NewAdService(db, logger)
-	analyticsService := services.NewAnalyticsService(db, logger)
-	clickService := services.NewClickService(db, logger)
+	analyticsService := services.NewAnalyticsService(db, logger, cfg.RetentionRawEvents)
+	aggregationService := services.NewAggregationService(db, logger, services.AggregationOptions{
+		Interval:  cfg.AggregationInterval,
+		BatchSize: cfg.AggregationBatchSize,
+	})
+	adCache := services.NewAdCache(db, logger, cfg.AdCacheTTL)
+	sessionTracker := services.NewSessionTracker(db, logger, cfg.SessionTimeout)
+	anomalyService := services.NewAnomalyService(db, logger, services.AnomalyOptions{
+		Interval:  cfg.AnomalyInterval,
+		Threshold: cfg.AnomalyThreshold,
+		MinClicks: cfg.AnomalyMinClicks,
+	}, services.NewLogNotifier(logger), services.NewWebhookNotifier(webhookService))
+	reportService := services.NewReportService(db, logger, analyticsService, services.ReportOptions{
+		PollInterval: cfg.ReportPollInterval,
+		Directory:    cfg.ReportDir,
+		SMTP: services.SMTPOptions{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.SMTPFrom,
+		},
+	})
+	liveAggregator := services.NewLiveAggregator(cfg.LiveWindow)
+	clickService := services.NewClickService(db, logger, adCache, anonymizer, sessionTracker, webhookService, liveAggregator, geo, cfg.GDPRAppliesByDefault)
+	privacyService := services.NewPrivacyService(db, logger, anonymizer, []byte(cfg.PrivacyReceiptKey))
+	conversionService := services.NewConversionService(db, logger, webhookService, cfg.ConversionLookback)
+
+	// Setup client IP resolution
+	ipResolver, err := clientip.NewResolver(cfg.TrustedProxies, cfg.TrustedProxyHeader, cfg.TrustSuppliedIP)
+	if err != nil {
+		logger.Fatalf("Invalid trusted proxy configuration: %v", err)
+	}
 
 	// Setup router
 	router := gin.New()
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		logger.Fatalf("Invalid trusted proxy configuration: %v", err)
+	}
 	router.Use(gin.Recovery())
 	router.Use(middleware.Logger(logger))
 	router.Use(middleware.Metrics())
+	router.Use(middleware.APIKey(cfg.APIKeys))
 
 	// Setup handlers
-	handlers.Routes(router, adService, analyticsService, clickService)
+	handlers.Routes(router, ipResolver, handlers.Services{
+		Ads:         adService,
+		Analytics:   analyticsService,
+		Clicks:      clickService,
+		Privacy:     privacyService,
+		Conversions: conversionService,
+		Webhooks:    webhookService,
+		Aggregation: aggregationService,
+		Live:        liveAggregator,
+		Anomalies:   anomalyService,
+		Reports:     reportService,
+	})
 
 	// Create server
 	srv := &http.Server{
@@ -54,6 +141,15 @@ func main() {
 		Handler: router,
 	}
 
+	// Start background jobs
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	retentionService.Start(workerCtx, cfg.RetentionInterval)
+	webhookService.Start(workerCtx)
+	aggregationService.Start(workerCtx)
+	anomalyService.Start(workerCtx)
+	reportService.Start(workerCtx)
+
 	// Start server in goroutine
 	go func() {
 		logger.Infof("Starting server on port %s", cfg.Port)
@@ -67,6 +163,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	logger.Info("Shutting down server...")
+	stopWorkers()
 
 	// Graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)